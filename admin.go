@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminAuthMiddleware guards operator endpoints with the shared JOBSCHEDULER_ADMIN_KEY,
+// sent in the X-ADMIN-KEY header. User API keys never grant admin access.
+func adminAuthMiddleware(c *gin.Context) {
+	startTime := time.Now()
+	callerMethod := "adminAuthMiddleware"
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	if config.AdminKey == "" {
+		respondError(c, http.StatusForbidden, codeAdminDisabled, "Admin API is disabled")
+		return
+	}
+
+	adminKey := c.GetHeader("X-ADMIN-KEY")
+	if subtle.ConstantTimeCompare([]byte(adminKey), []byte(config.AdminKey)) != 1 {
+		respondError(c, http.StatusUnauthorized, codeInvalidAdminKey, "Invalid admin key")
+		return
+	}
+
+	c.Next() // Pass control to the next middleware/handler
+}
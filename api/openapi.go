@@ -0,0 +1,9 @@
+package api
+
+import _ "embed"
+
+// OpenAPI is the OpenAPI 3 document of the API. The server serves it at /openapi.json and
+// validates request bodies against its schemas, so it is the one place constraints live.
+//
+//go:embed openapi.json
+var OpenAPI []byte
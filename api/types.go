@@ -0,0 +1,386 @@
+// Package api holds the request and response types of the jobScheduler HTTP API. The
+// server and the client package both use them, so the two cannot drift apart.
+package api
+
+import "time"
+
+// Task is a scheduled task as stored in daria_tasks and returned by the API.
+type Task struct {
+	TaskID              string                 `json:"taskId"`
+	LastExecution       time.Time              `json:"lastExecution"`
+	TotalExecutions     int                    `json:"totalExecutions"`
+	APIMethod           string                 `json:"apiMethod"`
+	APIURL              string                 `json:"apiURL"`
+	AvgTimePerExecution float64                `json:"avgTimePerExecution"`
+	TimeOutAfter        int                    `json:"timeOutAfter"`
+	StartFrom           string                 `json:"startFrom"`
+	UserID              string                 `json:"userId"`
+	Frequency           int                    `json:"frequency"`
+	APIBody             map[string]interface{} `json:"apiBody"`
+	NextExecution       time.Time              `json:"nextExecution"`
+	// Name is an optional user-chosen identifier, unique per user, used by manifests
+	Name string `json:"name,omitempty"`
+	// Paused tasks are not queued or run until resumed
+	Paused bool `json:"paused,omitempty"`
+	// Set while an instance owns the current run; every mode but single claims runs
+	LeaseOwner   string `json:"leaseOwner,omitempty"`
+	LeaseExpiry  int64  `json:"leaseExpiry,omitempty"`
+	FencingToken int64  `json:"fencingToken,omitempty"`
+	// atLeastOnce (the default) or atMostOnce; decides whether a run interrupted by a crash is repeated
+	DeliveryGuarantee string `json:"deliveryGuarantee,omitempty"`
+	// Failed or short-circuited runs since the last successful one
+	ConsecutiveFailures int `json:"consecutiveFailures"`
+}
+
+// CreateTaskInput is the body of POST /tasks, and an element of POST /tasks:batch and
+// of a manifest. Its constraints are in the CreateTaskInput schema of openapi.json.
+type CreateTaskInput struct {
+	APIMethod string                 `json:"apiMethod"`
+	APIURL    string                 `json:"apiURL"`
+	StartFrom string                 `json:"startFrom"`
+	Frequency int                    `json:"frequency"`
+	APIBody   map[string]interface{} `json:"apiBody"`
+	// Optional; see Task.DeliveryGuarantee
+	DeliveryGuarantee string `json:"deliveryGuarantee,omitempty"`
+	// Optional; see Task.Name
+	Name string `json:"name,omitempty"`
+}
+
+// UpdateTaskInput is the body of PATCH /tasks/:taskID; only the fields given are changed.
+type UpdateTaskInput struct {
+	Name              *string                `json:"name,omitempty"`
+	APIMethod         *string                `json:"apiMethod,omitempty"`
+	APIURL            *string                `json:"apiURL,omitempty"`
+	StartFrom         *string                `json:"startFrom,omitempty"`
+	Frequency         *int                   `json:"frequency,omitempty"`
+	APIBody           map[string]interface{} `json:"apiBody,omitempty"`
+	DeliveryGuarantee *string                `json:"deliveryGuarantee,omitempty"`
+}
+
+// CreateTaskResult is the response of POST /tasks.
+type CreateTaskResult struct {
+	TaskID string `json:"taskId"`
+}
+
+// TaskList is the response of GET /tasks.
+type TaskList struct {
+	Tasks []Task `json:"tasks"`
+}
+
+// BatchItemResult is the outcome of creating one task of a batch or import. Status is the
+// HTTP status the item would have had as a single POST /tasks.
+type BatchItemResult struct {
+	Index  int    `json:"index"`
+	Status int    `json:"status"`
+	TaskID string `json:"taskId,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Fields lists the item's validation errors
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// BatchResult is the response of POST /tasks:batch and POST /tasks:import.
+type BatchResult struct {
+	Created int               `json:"created"`
+	Failed  int               `json:"failed"`
+	Results []BatchItemResult `json:"results"`
+}
+
+// ExportedTask is a task as written by GET /tasks:export and read by POST /tasks:import.
+// taskId is informational: an import always creates new tasks. totalExecutions carries
+// over, so an imported task only has the runs left that the exported one had.
+type ExportedTask struct {
+	TaskID            string                 `json:"taskId,omitempty"`
+	Name              string                 `json:"name,omitempty"`
+	APIMethod         string                 `json:"apiMethod"`
+	APIURL            string                 `json:"apiURL"`
+	StartFrom         string                 `json:"startFrom"`
+	Frequency         int                    `json:"frequency"`
+	APIBody           map[string]interface{} `json:"apiBody"`
+	DeliveryGuarantee string                 `json:"deliveryGuarantee,omitempty"`
+	// NextExecution is in the startFrom format. When present the imported task's first
+	// run is at this time rather than at startFrom, so a restored schedule keeps its phase.
+	// It is empty for a task that has finished all its runs, which is imported finished.
+	NextExecution   string `json:"nextExecution,omitempty"`
+	TotalExecutions int    `json:"totalExecutions,omitempty"`
+}
+
+// Manifest is the body of POST /tasks:apply, as JSON or YAML. Every task needs a name.
+type Manifest struct {
+	Tasks []CreateTaskInput `json:"tasks"`
+}
+
+// PlannedChange is one line of a manifest plan. Action is create, update, delete or
+// unchanged. Status (applied or failed) and Error are only set once applied.
+type PlannedChange struct {
+	Action string   `json:"action"`
+	Name   string   `json:"name"`
+	TaskID string   `json:"taskId,omitempty"`
+	Fields []string `json:"fields,omitempty"` // changed fields, for updates
+	Status string   `json:"status,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// ApplyResult is the response of POST /tasks:apply.
+type ApplyResult struct {
+	DryRun  bool            `json:"dryRun"`
+	Summary map[string]int  `json:"summary"`
+	Failed  int             `json:"failed"`
+	Changes []PlannedChange `json:"changes"`
+}
+
+// Execution is one run of a task as journalled in daria_executions.
+type Execution struct {
+	ExecutionID       string `json:"executionId"`
+	TaskID            string `json:"taskId"`
+	UserID            string `json:"userId"`
+	ScheduledAt       int64  `json:"scheduledAt"`
+	State             string `json:"state"` // pending, running or done
+	DeliveryGuarantee string `json:"deliveryGuarantee"`
+	InstanceID        string `json:"instanceId"`
+	StartedAt         int64  `json:"startedAt"`
+	FinishedAt        int64  `json:"finishedAt,omitempty"`
+	Outcome           string `json:"outcome,omitempty"` // success, failure, skipped, abandoned or short-circuited
+	Error             string `json:"error,omitempty"`
+	ExpiresAt         int64  `json:"expiresAt,omitempty"` // TTL attribute, set once done
+	// RateLimitDelayMs is how long the run was held back by a rate limit before its API
+	// call, and RateLimitedBy which limit held it back longest: user or host
+	RateLimitDelayMs int64  `json:"rateLimitDelayMs,omitempty"`
+	RateLimitedBy    string `json:"rateLimitedBy,omitempty"`
+	// Attempts is how many calls the run made; a failed call of an at-least-once task is retried
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// History is the response of GET /tasks/:taskID/history, newest run first.
+type History struct {
+	TaskID     string      `json:"taskId"`
+	Executions []Execution `json:"executions"`
+}
+
+// LogLines is the response of GET /tasks/:taskID/logs. Pass Cursor back to get the lines
+// logged since.
+type LogLines struct {
+	InstanceID string   `json:"instanceId"`
+	Lines      []string `json:"lines"`
+	Cursor     int64    `json:"cursor"`
+}
+
+// Allowlist is what a user's tasks may call despite being in a private, loopback or
+// reserved range. Entries are hostnames, IP addresses or CIDR networks.
+type Allowlist struct {
+	UserID    string    `json:"userId"`
+	Entries   []string  `json:"entries"`
+	UpdatedAt time.Time `json:"updatedAt,omitempty"`
+}
+
+// AllowlistInput is the body of PUT /admin/users/:userId/allowlist.
+type AllowlistInput struct {
+	Entries []string `json:"entries"`
+}
+
+// RequestSnapshot is a call to a task's API exactly as a run made it.
+type RequestSnapshot struct {
+	Method  string                 `json:"method"`
+	URL     string                 `json:"url"`
+	Headers map[string]string      `json:"headers"`
+	Body    map[string]interface{} `json:"body"`
+}
+
+// ResponseSnapshot is what the task's API answered. Body is cut off after 16 KB.
+type ResponseSnapshot struct {
+	StatusCode int    `json:"statusCode"`
+	Body       string `json:"body"`
+	Truncated  bool   `json:"truncated,omitempty"`
+}
+
+// DeadLetter is a run that failed on every attempt, kept for 30 days so it can be
+// inspected and replayed. Response is absent if no response arrived.
+type DeadLetter struct {
+	DeadLetterID string            `json:"deadLetterId"`
+	ExecutionID  string            `json:"executionId"`
+	TaskID       string            `json:"taskId"`
+	UserID       string            `json:"userId"`
+	ScheduledAt  int64             `json:"scheduledAt"`
+	FailedAt     int64             `json:"failedAt"` // Unix seconds
+	Attempts     int               `json:"attempts"`
+	Request      RequestSnapshot   `json:"request"`
+	Response     *ResponseSnapshot `json:"response,omitempty"`
+	LastError    string            `json:"lastError"`
+	State        string            `json:"state"` // failed, or replayed once a replay succeeds
+	Replays      int               `json:"replays"`
+	LastReplay   *Replay           `json:"lastReplay,omitempty"`
+	ExpiresAt    int64             `json:"expiresAt"` // TTL attribute
+}
+
+// Replay is the result of sending a dead letter's request again.
+type Replay struct {
+	At         int64             `json:"at"` // Unix seconds
+	BodyEdited bool              `json:"bodyEdited"`
+	Outcome    string            `json:"outcome"` // success or failure
+	Response   *ResponseSnapshot `json:"response,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// DeadLetterList is the response of GET /dead-letters, newest first.
+type DeadLetterList struct {
+	DeadLetters []DeadLetter `json:"deadLetters"`
+}
+
+// ReplayInput is the optional body of POST /dead-letters/:deadLetterId/replay. Body, if
+// given, is sent instead of the original request body.
+type ReplayInput struct {
+	Body map[string]interface{} `json:"body,omitempty"`
+}
+
+// RateLimit is the token bucket for the runs of one user's tasks, or for the runs calling
+// one host: up to Burst calls at once, refilled at RatePerSecond. A RatePerSecond of 0
+// means unlimited. Default is set when no override exists and the service default applies.
+type RateLimit struct {
+	Scope         string     `json:"scope"` // user or host
+	Key           string     `json:"key"`   // the user ID or hostname
+	RatePerSecond float64    `json:"ratePerSecond"`
+	Burst         int        `json:"burst"`
+	Default       bool       `json:"default"`
+	UpdatedAt     *time.Time `json:"updatedAt,omitempty"`
+}
+
+// RateLimitInput is the body of PUT /admin/users/:userId/rate-limit and
+// PUT /admin/hosts/:host/rate-limit.
+type RateLimitInput struct {
+	RatePerSecond float64 `json:"ratePerSecond"`
+	Burst         int     `json:"burst"`
+}
+
+// CircuitBreaker is the state of the breaker for calls to one host on one instance: closed,
+// open or halfOpen. Failures counts failed calls in a row.
+type CircuitBreaker struct {
+	Host           string     `json:"host"`
+	State          string     `json:"state"`
+	Failures       int        `json:"failures"`
+	OpenUntil      *time.Time `json:"openUntil,omitempty"`
+	LastFailureAt  *time.Time `json:"lastFailureAt,omitempty"`
+	LastError      string     `json:"lastError,omitempty"`
+	ShortCircuited int64      `json:"shortCircuited"` // runs not called since the instance started
+	InstanceID     string     `json:"instanceId"`
+}
+
+// BreakerList is the response of GET /admin/breakers, open breakers first.
+type BreakerList struct {
+	InstanceID string           `json:"instanceId"`
+	Breakers   []CircuitBreaker `json:"breakers"`
+}
+
+// NotificationRule sends a notification when one of the user's tasks, or only TaskID if it
+// is set, has one of Events: failure (a run failed or was short-circuited),
+// consecutiveFailures (the ConsecutiveFailures-th failed run in a row), recovery (a run
+// succeeded after failed ones) or completion (the task made its last run). Notifications go
+// to WebhookURL or EmailTo depending on Channel. The same event for the same task is sent
+// at most once every DedupSeconds.
+type NotificationRule struct {
+	RuleID              string    `json:"ruleId"`
+	UserID              string    `json:"userId"`
+	TaskID              string    `json:"taskId,omitempty"`
+	Events              []string  `json:"events"`
+	ConsecutiveFailures int       `json:"consecutiveFailures,omitempty"`
+	Channel             string    `json:"channel"` // webhook or email
+	WebhookURL          string    `json:"webhookUrl,omitempty"`
+	EmailTo             []string  `json:"emailTo,omitempty"`
+	SubjectTemplate     string    `json:"subjectTemplate,omitempty"` // text/template over a Notification
+	BodyTemplate        string    `json:"bodyTemplate,omitempty"`
+	DedupSeconds        int       `json:"dedupSeconds"`
+	CreatedAt           time.Time `json:"createdAt"`
+	UpdatedAt           time.Time `json:"updatedAt"`
+	// LastDelivery is the latest notification the rule sent or failed to send
+	LastDelivery *NotificationDelivery `json:"lastDelivery,omitempty"`
+}
+
+// NotificationRuleInput is the body of POST /notification-rules and of
+// PUT /notification-rules/:ruleId. DedupSeconds defaults to an hour; 0 sends every event.
+type NotificationRuleInput struct {
+	TaskID              string   `json:"taskId,omitempty"`
+	Events              []string `json:"events"`
+	ConsecutiveFailures int      `json:"consecutiveFailures,omitempty"`
+	Channel             string   `json:"channel"`
+	WebhookURL          string   `json:"webhookUrl,omitempty"`
+	EmailTo             []string `json:"emailTo,omitempty"`
+	SubjectTemplate     string   `json:"subjectTemplate,omitempty"`
+	BodyTemplate        string   `json:"bodyTemplate,omitempty"`
+	DedupSeconds        *int     `json:"dedupSeconds,omitempty"`
+}
+
+// NotificationRuleList is the response of GET /notification-rules.
+type NotificationRuleList struct {
+	Rules []NotificationRule `json:"rules"`
+}
+
+// Notification is what a rule sends: the body of a webhook call, and the data its
+// templates are executed with. Subject and Message are the rendered templates.
+type Notification struct {
+	Event               string    `json:"event"` // failure, consecutiveFailures, recovery, completion or test
+	RuleID              string    `json:"ruleId"`
+	UserID              string    `json:"userId"`
+	TaskID              string    `json:"taskId"`
+	TaskName            string    `json:"taskName,omitempty"`
+	URL                 string    `json:"url"`
+	ExecutionID         string    `json:"executionId"`
+	ScheduledAt         time.Time `json:"scheduledAt"`
+	Outcome             string    `json:"outcome"`
+	Error               string    `json:"error,omitempty"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	At                  time.Time `json:"at"`
+	Subject             string    `json:"subject"`
+	Message             string    `json:"message"`
+}
+
+// NotificationDelivery is the result of sending a notification. Error is empty if it was
+// delivered.
+type NotificationDelivery struct {
+	Event   string    `json:"event"`
+	At      time.Time `json:"at"`
+	Channel string    `json:"channel"`
+	Subject string    `json:"subject"`
+	Message string    `json:"message"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// CapturedEmail is an email kept in memory instead of sent, when the server's SMTP address
+// is "capture".
+type CapturedEmail struct {
+	From    string    `json:"from"`
+	To      []string  `json:"to"`
+	Subject string    `json:"subject"`
+	Body    string    `json:"body"`
+	SentAt  time.Time `json:"sentAt"`
+}
+
+// Outbox is the response of GET /admin/outbox, oldest first.
+type Outbox struct {
+	InstanceID string          `json:"instanceId"`
+	Emails     []CapturedEmail `json:"emails"`
+}
+
+// ErrorResponse is the body of every /v1 error response.
+type ErrorResponse struct {
+	Error Error `json:"error"`
+}
+
+// Error describes what went wrong. Code is stable and meant for programs; Message is for
+// people. Field names the offending field of a validation error, the first one if several
+// are listed in Fields. Quote RequestID, also sent as X-Request-ID, when reporting a problem.
+type Error struct {
+	Code      string                 `json:"code"`
+	Message   string                 `json:"message"`
+	Field     string                 `json:"field,omitempty"`
+	Fields    []FieldError           `json:"fields,omitempty"`
+	RequestID string                 `json:"requestId,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+}
+
+// FieldError is one field that failed validation. Code is the schema keyword it broke
+// (required, type, enum, format, minimum, maximum, minLength, maxLength, minItems or
+// maxItems), unique for a name used twice in a manifest, or blocked for a URL in a range
+// tasks may not call.
+type FieldError struct {
+	Field   string `json:"field"` // e.g. frequency, or tasks[2].apiURL
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
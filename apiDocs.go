@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+
+	"daria.com/jobScheduler/api"
+	"github.com/gin-gonic/gin"
+)
+
+// apiDocsTemplate lays out /docs. The page is rendered from api.OpenAPI on the server,
+// so it needs no scripts and nothing from outside the binary.
+//
+//go:embed apiDocs.html
+var apiDocsTemplate string
+
+// apiDocsPage is the rendered /docs page.
+var apiDocsPage = renderAPIDocs()
+
+// getOpenAPI serves the OpenAPI document requests are validated against.
+func getOpenAPI(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json; charset=utf-8", api.OpenAPI)
+}
+
+func getAPIDocs(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", apiDocsPage)
+}
+
+// The parts of the OpenAPI document the docs page shows. Schemas use the same type as
+// request validation.
+type docsDocument struct {
+	Info struct {
+		Title       string `json:"title"`
+		Version     string `json:"version"`
+		Description string `json:"description"`
+	} `json:"info"`
+	Tags []struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	} `json:"tags"`
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Parameters map[string]docsParameter `json:"parameters"`
+		Responses  map[string]docsResponse  `json:"responses"`
+		Schemas    map[string]*schema       `json:"schemas"`
+	} `json:"components"`
+}
+
+type docsOperation struct {
+	Tags        []string                `json:"tags"`
+	OperationID string                  `json:"operationId"`
+	Summary     string                  `json:"summary"`
+	Description string                  `json:"description"`
+	Parameters  []docsParameter         `json:"parameters"`
+	RequestBody *docsBody               `json:"requestBody"`
+	Responses   map[string]docsResponse `json:"responses"`
+}
+
+type docsParameter struct {
+	Ref         string  `json:"$ref"`
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Required    bool    `json:"required"`
+	Description string  `json:"description"`
+	Schema      *schema `json:"schema"`
+}
+
+type docsBody struct {
+	Required bool                `json:"required"`
+	Content  map[string]docsType `json:"content"`
+}
+
+type docsResponse struct {
+	Ref         string              `json:"$ref"`
+	Description string              `json:"description"`
+	Content     map[string]docsType `json:"content"`
+}
+
+type docsType struct {
+	Schema *schema `json:"schema"`
+}
+
+// docsMethods are the operations of a path in the order they are listed.
+var docsMethods = []string{"get", "post", "put", "patch", "delete"}
+
+// The page as the template sees it
+type docsPage struct {
+	docsDocument
+	Sections []docsSection
+	Schemas  []docsSchema
+}
+
+type docsSection struct {
+	Name, Description string
+	Operations        []docsEndpoint
+}
+
+type docsEndpoint struct {
+	docsOperation
+	Method, Path string
+	Parameters   []docsParameter
+	Responses    []docsStatus
+}
+
+type docsStatus struct {
+	Code string
+	docsResponse
+}
+
+type docsSchema struct {
+	Name   string
+	Schema *schema
+}
+
+func renderAPIDocs() []byte {
+	var document docsDocument
+	if err := json.Unmarshal(api.OpenAPI, &document); err != nil {
+		panic(fmt.Sprintf("openapi.json is invalid: %s", err.Error()))
+	}
+
+	page := docsPage{docsDocument: document}
+	for _, tag := range document.Tags {
+		page.Sections = append(page.Sections, docsSection{Name: tag.Name, Description: tag.Description})
+	}
+	paths := make([]string, 0, len(document.Paths))
+	for path := range document.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		for _, method := range docsMethods {
+			raw, ok := document.Paths[path][method]
+			if !ok {
+				continue
+			}
+			var operation docsOperation
+			if err := json.Unmarshal(raw, &operation); err != nil {
+				panic(fmt.Sprintf("openapi.json: %s %s: %s", method, path, err.Error()))
+			}
+			endpoint := docsEndpoint{docsOperation: operation, Method: strings.ToUpper(method), Path: path}
+			for _, parameter := range operation.Parameters {
+				if name, ok := strings.CutPrefix(parameter.Ref, "#/components/parameters/"); ok {
+					parameter = document.Components.Parameters[name]
+				}
+				endpoint.Parameters = append(endpoint.Parameters, parameter)
+			}
+			for code, response := range operation.Responses {
+				if name, ok := strings.CutPrefix(response.Ref, "#/components/responses/"); ok {
+					response = document.Components.Responses[name]
+				}
+				endpoint.Responses = append(endpoint.Responses, docsStatus{Code: code, docsResponse: response})
+			}
+			sort.Slice(endpoint.Responses, func(i, j int) bool { return endpoint.Responses[i].Code < endpoint.Responses[j].Code })
+
+			// An operation is listed under its first tag
+			for i := range page.Sections {
+				if len(operation.Tags) > 0 && page.Sections[i].Name == operation.Tags[0] {
+					page.Sections[i].Operations = append(page.Sections[i].Operations, endpoint)
+				}
+			}
+		}
+	}
+	for name, s := range document.Components.Schemas {
+		page.Schemas = append(page.Schemas, docsSchema{Name: name, Schema: s})
+	}
+	sort.Slice(page.Schemas, func(i, j int) bool { return page.Schemas[i].Name < page.Schemas[j].Name })
+
+	docs := template.Must(template.New("docs").Funcs(template.FuncMap{
+		"paragraphs":  func(text string) []string { return strings.Split(text, "\n\n") },
+		"schemaType":  docsSchemaType,
+		"constraints": docsConstraints,
+		"required": func(s *schema, property string) bool {
+			for _, name := range s.Required {
+				if name == property {
+					return true
+				}
+			}
+			return false
+		},
+		"sortedProperties": func(s *schema) []string {
+			names := make([]string, 0, len(s.Properties))
+			for name := range s.Properties {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return names
+		},
+	}).Parse(apiDocsTemplate))
+	var out bytes.Buffer
+	if err := docs.Execute(&out, page); err != nil {
+		panic(fmt.Sprintf("rendering the API docs: %s", err.Error()))
+	}
+	return out.Bytes()
+}
+
+// docsSchemaType describes a schema's type in a word or two, linking to named schemas.
+func docsSchemaType(s *schema) template.HTML {
+	if s == nil {
+		return ""
+	}
+	if name, ok := strings.CutPrefix(s.Ref, "#/components/schemas/"); ok {
+		name = template.HTMLEscapeString(name)
+		return template.HTML(fmt.Sprintf(`<a href="#schema-%s">%s</a>`, name, name))
+	}
+	if len(s.AllOf) > 0 {
+		parts := make([]string, len(s.AllOf))
+		for i, part := range s.AllOf {
+			parts[i] = string(docsSchemaType(part))
+		}
+		return template.HTML(strings.Join(parts, " and "))
+	}
+	switch {
+	case s.Type == "array":
+		return "array of " + docsSchemaType(s.Items)
+	case s.Type == "object" && len(s.Properties) > 0:
+		return "object (see below)"
+	case s.Format != "":
+		return template.HTML(template.HTMLEscapeString(fmt.Sprintf("%s (%s)", s.Type, s.Format)))
+	}
+	return template.HTML(template.HTMLEscapeString(s.Type))
+}
+
+// docsConstraints lists a schema's enum, default and bounds.
+func docsConstraints(s *schema) []string {
+	if s == nil {
+		return nil
+	}
+	constraints := make([]string, 0)
+	if len(s.Enum) > 0 {
+		values := make([]string, len(s.Enum))
+		for i, value := range s.Enum {
+			values[i] = fmt.Sprint(value)
+		}
+		constraints = append(constraints, "one of "+strings.Join(values, ", "))
+	}
+	if s.Default != nil {
+		constraints = append(constraints, fmt.Sprintf("default %v", s.Default))
+	}
+	if s.Minimum != nil {
+		constraints = append(constraints, fmt.Sprintf("at least %v", *s.Minimum))
+	}
+	if s.Maximum != nil {
+		constraints = append(constraints, fmt.Sprintf("at most %v", *s.Maximum))
+	}
+	if s.MinLength != nil {
+		constraints = append(constraints, fmt.Sprintf("at least %d characters", *s.MinLength))
+	}
+	if s.MaxLength != nil {
+		constraints = append(constraints, fmt.Sprintf("at most %d characters", *s.MaxLength))
+	}
+	if s.MinItems != nil {
+		constraints = append(constraints, fmt.Sprintf("at least %d items", *s.MinItems))
+	}
+	if s.MaxItems != nil {
+		constraints = append(constraints, fmt.Sprintf("at most %d items", *s.MaxItems))
+	}
+	return constraints
+}
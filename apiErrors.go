@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"daria.com/jobScheduler/api"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Codes of the error envelope. They are part of the API contract: add new ones freely but
+// never change the meaning of an existing one within a version.
+const (
+	codeInvalidRequest        = "invalid_request"
+	codeValidationFailed      = "validation_failed"
+	codeAPIKeyRequired        = "api_key_required"
+	codeInvalidAPIKey         = "invalid_api_key"
+	codeInvalidAdminKey       = "invalid_admin_key"
+	codeAdminDisabled         = "admin_disabled"
+	codeForbidden             = "forbidden"
+	codeNoQuota               = "no_quota"
+	codeNotFound              = "not_found"
+	codeNotAcceptable         = "not_acceptable"
+	codeNameTaken             = "name_taken"
+	codeTaskPaused            = "task_paused"
+	codeTaskFinished          = "task_finished"
+	codeShardingDisabled      = "sharding_disabled"
+	codeOutboxDisabled        = "outbox_disabled"
+	codeIdempotencyInProgress = "idempotency_in_progress"
+	codeIdempotencyMismatch   = "idempotency_key_reused"
+	codeReplayConflict        = "replay_conflict"
+	codePayloadTooLarge       = "payload_too_large"
+	codeUnsupportedMediaType  = "unsupported_media_type"
+	codeQuotaExceeded         = "quota_exceeded"
+	codeInternal              = "internal_error"
+	codeUnavailable           = "unavailable"
+)
+
+// Routes without a version prefix predate /v1. They keep their original error bodies and
+// are served until unversionedSunset.
+var (
+	unversionedDeprecatedAt = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+	unversionedSunset       = time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC)
+)
+
+var versionedPath = regexp.MustCompile(`^/v[0-9]+(/|$)`)
+
+const maxRequestIDLength = 128
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]+$`)
+
+// requestIDMiddleware tags every request with an ID, taken from the caller's X-Request-ID
+// if it sent a usable one. The ID is echoed in the response header and in error bodies.
+func requestIDMiddleware(c *gin.Context) {
+	requestID := c.GetHeader("X-Request-ID")
+	if len(requestID) > maxRequestIDLength || !validRequestID.MatchString(requestID) {
+		requestID = uuid.NewString()
+	}
+	c.Set("requestId", requestID)
+	c.Header("X-Request-ID", requestID)
+	c.Next()
+}
+
+// deprecationMiddleware marks every response of a route group as deprecated since
+// deprecatedAt (RFC 9745), to be removed at sunset (RFC 8594), and links the same route
+// under successorPrefix. When /v2 arrives, /v1 gets this middleware too.
+func deprecationMiddleware(deprecatedAt time.Time, sunset time.Time, successorPrefix string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Deprecation", fmt.Sprintf("@%d", deprecatedAt.Unix()))
+		c.Header("Sunset", sunset.UTC().Format(http.TimeFormat))
+		c.Header("Link", fmt.Sprintf("<%s%s>; rel=\"successor-version\"", successorPrefix, c.Request.URL.Path))
+		c.Next()
+	}
+}
+
+// respondError aborts the request with an error response.
+func respondError(c *gin.Context, status int, code string, message string) {
+	writeError(c, status, api.Error{Code: code, Message: message})
+}
+
+// writeError aborts the request with apiErr in the envelope of the route's API version.
+// Unversioned routes get their original {"error": message} body, with any details as
+// top-level fields.
+func writeError(c *gin.Context, status int, apiErr api.Error) {
+	if !versionedPath.MatchString(c.Request.URL.Path) {
+		body := gin.H{"error": apiErr.Message}
+		if len(apiErr.Fields) > 0 {
+			body["fields"] = apiErr.Fields
+		}
+		for key, value := range apiErr.Details {
+			body[key] = value
+		}
+		c.AbortWithStatusJSON(status, body)
+		return
+	}
+	apiErr.RequestID = c.GetString("requestId")
+	c.AbortWithStatusJSON(status, api.ErrorResponse{Error: apiErr})
+}
+
+// routeNotFound answers requests that match no route, in the same envelope as the rest.
+func routeNotFound(c *gin.Context) {
+	respondError(c, http.StatusNotFound, codeNotFound, fmt.Sprintf("No route for %s %s", c.Request.Method, c.Request.URL.Path))
+}
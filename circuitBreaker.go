@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"daria.com/jobScheduler/api"
+	"github.com/gin-gonic/gin"
+)
+
+// When a target is down, every task aimed at it would keep calling it on schedule. Each
+// destination host has a circuit breaker in the executor:
+//
+//	closed    calls go through; config.BreakerFailures failures in a row open it
+//	open      runs are not called but recorded as short-circuited, until
+//	          config.BreakerOpenDuration has passed
+//	halfOpen  up to config.BreakerProbes runs are called as trials; a success closes the
+//	          breaker, a failure opens it again
+//
+// A call fails when it gets no response or a 5xx one. Breakers are kept in memory, so
+// each instance has its own and the admin routes show and reset those of the instance
+// that answers.
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "halfOpen"
+)
+
+// outcomeShortCircuited is the outcome of a run that was not called because its host's
+// breaker was open.
+const outcomeShortCircuited = "short-circuited"
+
+var errCircuitOpen = errors.New("circuit is open")
+
+// circuitOpenError is why a run was short-circuited; it matches errCircuitOpen.
+type circuitOpenError struct {
+	host  string
+	until time.Time
+}
+
+func (e *circuitOpenError) Error() string {
+	if e.until.IsZero() {
+		return fmt.Sprintf("circuit for %s is half-open and its trial calls are in flight", e.host)
+	}
+	return fmt.Sprintf("circuit for %s is open until %s", e.host, e.until.UTC().Format("2006-01-02 15:04:05"))
+}
+
+func (e *circuitOpenError) Is(target error) bool {
+	return target == errCircuitOpen
+}
+
+// circuitBreaker is the state of one host's breaker.
+type circuitBreaker struct {
+	state          string
+	failures       int    // in a row
+	probes         int    // trial calls of the current half-open period in flight
+	period         uint64 // counts half-open periods and resets, so stale trials are told apart
+	openUntil      time.Time
+	lastFailureAt  time.Time
+	lastError      string
+	shortCircuited int64 // runs short-circuited since this instance started
+}
+
+func (b *circuitBreaker) view(host string) api.CircuitBreaker {
+	view := api.CircuitBreaker{
+		Host:           host,
+		State:          b.state,
+		Failures:       b.failures,
+		LastError:      b.lastError,
+		ShortCircuited: b.shortCircuited,
+		InstanceID:     config.InstanceID,
+	}
+	if !b.openUntil.IsZero() {
+		openUntil := b.openUntil.UTC()
+		view.OpenUntil = &openUntil
+	}
+	if !b.lastFailureAt.IsZero() {
+		lastFailureAt := b.lastFailureAt.UTC()
+		view.LastFailureAt = &lastFailureAt
+	}
+	return view
+}
+
+var breakers = struct {
+	sync.Mutex
+	hosts map[string]*circuitBreaker
+}{hosts: make(map[string]*circuitBreaker)}
+
+// breakerFor returns the host's breaker, creating it closed. The caller holds breakers.
+func breakerFor(host string) *circuitBreaker {
+	breaker := breakers.hosts[host]
+	if breaker == nil {
+		breaker = &circuitBreaker{state: breakerClosed}
+		breakers.hosts[host] = breaker
+	}
+	return breaker
+}
+
+// breakerPass is a call allowCall let through. probe is the half-open period the call is
+// a trial of, or 0 if the breaker was closed.
+type breakerPass struct {
+	host  string
+	probe uint64
+}
+
+// allowCall reports whether a run may call host now, or a circuitOpenError if not. Every
+// call allowed must be followed by recordCall or releaseCall with the pass it returns.
+func allowCall(host string, now time.Time) (breakerPass, error) {
+	breakers.Lock()
+	defer breakers.Unlock()
+	breaker := breakerFor(host)
+	pass := breakerPass{host: host}
+	if breaker.state == breakerOpen {
+		if now.Before(breaker.openUntil) {
+			breaker.shortCircuited++
+			return pass, &circuitOpenError{host: host, until: breaker.openUntil}
+		}
+		breaker.state = breakerHalfOpen
+		breaker.probes = 0
+		breaker.period++
+		log("allowCall", fmt.Sprintf("Circuit for %s is half-open", host))
+	}
+	if breaker.state == breakerHalfOpen {
+		if breaker.probes >= config.BreakerProbes {
+			breaker.shortCircuited++
+			return pass, &circuitOpenError{host: host}
+		}
+		breaker.probes++
+		pass.probe = breaker.period
+	}
+	return pass, nil
+}
+
+// endProbe stops counting pass as a trial in flight, if it is one of the current period.
+// Calls let through before the breaker opened, or before a reset, are not counted.
+func (b *circuitBreaker) endProbe(pass breakerPass) {
+	if b.state == breakerHalfOpen && pass.probe == b.period {
+		b.probes--
+	}
+}
+
+// recordCall updates the breaker with the result of a call allowCall let through.
+func recordCall(pass breakerPass, now time.Time, result JobExecutionResult) {
+	breakers.Lock()
+	defer breakers.Unlock()
+	host := pass.host
+	breaker := breakerFor(host)
+	// A 4xx means the host is up, even though the run failed
+	failed := result.StatusCode >= http.StatusInternalServerError || (result.StatusCode == 0 && result.Error != nil)
+	breaker.endProbe(pass)
+	if !failed {
+		if breaker.state != breakerClosed {
+			log("recordCall", fmt.Sprintf("Circuit for %s is closed", host))
+		}
+		// Trials still in flight are no longer counted once closed
+		breaker.state = breakerClosed
+		breaker.failures = 0
+		breaker.probes = 0
+		breaker.openUntil = time.Time{}
+		return
+	}
+
+	breaker.failures++
+	breaker.lastFailureAt = now
+	if result.Error != nil {
+		breaker.lastError = result.Error.Error()
+	} else {
+		breaker.lastError = fmt.Sprintf("responded %d", result.StatusCode)
+	}
+	if breaker.state == breakerHalfOpen || (breaker.state == breakerClosed && breaker.failures >= config.BreakerFailures) {
+		breaker.state = breakerOpen
+		breaker.probes = 0
+		breaker.openUntil = now.Add(config.BreakerOpenDuration)
+		log("recordCall", fmt.Sprintf("Circuit for %s is open until %s after %d failures: %s", host,
+			breaker.openUntil.UTC().Format("2006-01-02 15:04:05"), breaker.failures, breaker.lastError))
+	}
+}
+
+// releaseCall gives back a call allowCall let through that was never made.
+func releaseCall(pass breakerPass) {
+	breakers.Lock()
+	defer breakers.Unlock()
+	breakerFor(pass.host).endProbe(pass)
+}
+
+// getBreakers handles GET /admin/breakers: this instance's breakers, open ones first.
+func getBreakers(c *gin.Context) {
+	callerMethod := "getBreakers"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	breakers.Lock()
+	list := make([]api.CircuitBreaker, 0, len(breakers.hosts))
+	for host, breaker := range breakers.hosts {
+		list = append(list, breaker.view(host))
+	}
+	breakers.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		if (list[i].State == breakerClosed) != (list[j].State == breakerClosed) {
+			return list[j].State == breakerClosed
+		}
+		return list[i].Host < list[j].Host
+	})
+	c.JSON(http.StatusOK, api.BreakerList{InstanceID: config.InstanceID, Breakers: list})
+}
+
+// getBreaker handles GET /admin/hosts/:host/breaker.
+func getBreaker(c *gin.Context) {
+	callerMethod := "getBreaker"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	host, ok := hostParam(c)
+	if !ok {
+		return
+	}
+	breakers.Lock()
+	breaker, found := breakers.hosts[host]
+	if !found {
+		breaker = &circuitBreaker{state: breakerClosed}
+	}
+	view := breaker.view(host)
+	breakers.Unlock()
+	c.JSON(http.StatusOK, view)
+}
+
+// resetBreaker handles POST /admin/hosts/:host/breaker/reset, closing the host's breaker
+// on this instance.
+func resetBreaker(c *gin.Context) {
+	callerMethod := "resetBreaker"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	host, ok := hostParam(c)
+	if !ok {
+		return
+	}
+	breakers.Lock()
+	breaker := breakerFor(host)
+	// Trial calls still in flight belong to the old period and are not counted
+	*breaker = circuitBreaker{state: breakerClosed, period: breaker.period + 1, shortCircuited: breaker.shortCircuited}
+	reset := breaker.view(host)
+	breakers.Unlock()
+	log(callerMethod, fmt.Sprintf("Circuit for %s reset", host))
+	c.JSON(http.StatusOK, reset)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"daria.com/jobScheduler/scheduler"
+	"github.com/gin-gonic/gin"
+)
+
+const breakerHost = "api.example.com"
+
+var (
+	callFailed    = JobExecutionResult{Status: "failure", StatusCode: http.StatusServiceUnavailable}
+	callTimedOut  = JobExecutionResult{Status: "failure", Error: errors.New("context deadline exceeded")}
+	callRejected  = JobExecutionResult{Status: "failure", StatusCode: http.StatusNotFound}
+	callSucceeded = JobExecutionResult{Status: "success", StatusCode: http.StatusOK}
+)
+
+// useBreakers starts the test with no breakers, opening after three failures for a
+// minute with two trial calls, on a fake clock.
+func useBreakers(t *testing.T) *scheduler.FakeClock {
+	t.Helper()
+	t.Chdir(t.TempDir()) // log() appends to logfile.txt in the working directory
+	saved := config
+	config.BreakerFailures, config.BreakerOpenDuration, config.BreakerProbes = 3, time.Minute, 2
+	breakers.Lock()
+	breakers.hosts = make(map[string]*circuitBreaker)
+	breakers.Unlock()
+	t.Cleanup(func() {
+		config = saved
+		breakers.Lock()
+		breakers.hosts = make(map[string]*circuitBreaker)
+		breakers.Unlock()
+	})
+	return scheduler.NewFakeClock(time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC))
+}
+
+// call lets a call through the breaker and records its result.
+func call(t *testing.T, clock *scheduler.FakeClock, result JobExecutionResult) {
+	t.Helper()
+	pass, err := allowCall(breakerHost, clock.Now())
+	if err != nil {
+		t.Fatalf("call refused: %v", err)
+	}
+	recordCall(pass, clock.Now(), result)
+}
+
+func breakerState(host string) circuitBreaker {
+	breakers.Lock()
+	defer breakers.Unlock()
+	return *breakerFor(host)
+}
+
+func TestBreakerOpensAfterFailuresInARow(t *testing.T) {
+	clock := useBreakers(t)
+
+	call(t, clock, callFailed)
+	call(t, clock, callTimedOut)
+	call(t, clock, callSucceeded) // ends the streak
+	call(t, clock, callFailed)
+	call(t, clock, callFailed)
+	if state := breakerState(breakerHost); state.state != breakerClosed || state.failures != 2 {
+		t.Fatalf("after two failures in a row the breaker is %s with %d failures; want closed with 2", state.state, state.failures)
+	}
+	call(t, clock, callTimedOut)
+	state := breakerState(breakerHost)
+	if state.state != breakerOpen || !state.openUntil.Equal(clock.Now().Add(time.Minute)) || state.lastError != "context deadline exceeded" {
+		t.Fatalf("after three failures the breaker is %+v; want open for a minute", state)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := allowCall(breakerHost, clock.Now().Add(59*time.Second))
+		var open *circuitOpenError
+		if !errors.As(err, &open) || !errors.Is(err, errCircuitOpen) || !open.until.Equal(state.openUntil) {
+			t.Fatalf("allowCall while open = %v; want a circuitOpenError until %s", err, state.openUntil)
+		}
+	}
+	if n := breakerState(breakerHost).shortCircuited; n != 2 {
+		t.Fatalf("%d runs short-circuited; want 2", n)
+	}
+	if _, err := allowCall("other.example.com", clock.Now()); err != nil {
+		t.Fatalf("another host's call was refused: %v", err)
+	}
+}
+
+func TestBreakerIgnoresClientErrors(t *testing.T) {
+	clock := useBreakers(t)
+	for i := 0; i < 10; i++ {
+		call(t, clock, callRejected)
+	}
+	if state := breakerState(breakerHost); state.state != breakerClosed || state.failures != 0 {
+		t.Fatalf("after ten 404s the breaker is %s with %d failures; want closed", state.state, state.failures)
+	}
+	call(t, clock, callFailed)
+	call(t, clock, callFailed)
+	call(t, clock, callRejected) // the host answered, so the streak ends
+	call(t, clock, callFailed)
+	if state := breakerState(breakerHost); state.state != breakerClosed || state.failures != 1 {
+		t.Fatalf("a 404 between failures left %s with %d failures; want closed with 1", state.state, state.failures)
+	}
+}
+
+// openBreaker fails calls until the breaker opens and moves the clock to when it expires.
+func openBreaker(t *testing.T, clock *scheduler.FakeClock) {
+	t.Helper()
+	for i := 0; i < config.BreakerFailures; i++ {
+		call(t, clock, callFailed)
+	}
+	if state := breakerState(breakerHost); state.state != breakerOpen {
+		t.Fatalf("breaker is %s; want open", state.state)
+	}
+	clock.Advance(config.BreakerOpenDuration)
+}
+
+func TestBreakerHalfOpenAfterOpenPeriod(t *testing.T) {
+	clock := useBreakers(t)
+	openBreaker(t, clock)
+
+	// A failed trial opens it for another period
+	call(t, clock, callFailed)
+	state := breakerState(breakerHost)
+	if state.state != breakerOpen || !state.openUntil.Equal(clock.Now().Add(time.Minute)) {
+		t.Fatalf("after a failed trial the breaker is %s until %s; want open for another minute", state.state, state.openUntil)
+	}
+	if _, err := allowCall(breakerHost, clock.Now()); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("allowCall after a failed trial = %v; want the circuit open", err)
+	}
+
+	// A successful one closes it
+	clock.Advance(time.Minute)
+	call(t, clock, callSucceeded)
+	if state := breakerState(breakerHost); state.state != breakerClosed || state.failures != 0 || !state.openUntil.IsZero() {
+		t.Fatalf("after a successful trial the breaker is %+v; want closed", state)
+	}
+}
+
+func TestBreakerLimitsTrialCalls(t *testing.T) {
+	clock := useBreakers(t)
+	openBreaker(t, clock)
+
+	first, err := allowCall(breakerHost, clock.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := allowCall(breakerHost, clock.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = allowCall(breakerHost, clock.Now())
+	var open *circuitOpenError
+	if !errors.As(err, &open) || !open.until.IsZero() || !strings.Contains(err.Error(), "half-open") {
+		t.Fatalf("a third trial = %v; want it refused while two are in flight", err)
+	}
+
+	// A trial that was never made frees its place
+	releaseCall(first)
+	third, err := allowCall(breakerHost, clock.Now())
+	if err != nil {
+		t.Fatalf("a trial after one was released = %v", err)
+	}
+	if state := breakerState(breakerHost); state.probes != 2 {
+		t.Fatalf("%d trials in flight; want 2", state.probes)
+	}
+	recordCall(second, clock.Now(), callSucceeded)
+	recordCall(third, clock.Now(), callSucceeded)
+	if state := breakerState(breakerHost); state.state != breakerClosed || state.probes != 0 {
+		t.Fatalf("after the trials succeeded the breaker is %s with %d in flight; want closed with none", state.state, state.probes)
+	}
+}
+
+func TestBreakerResetWithTrialsInFlight(t *testing.T) {
+	clock := useBreakers(t)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/admin/hosts/:host/breaker/reset", resetBreaker)
+	reset := func() {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/hosts/"+breakerHost+"/breaker/reset", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("reset: %d %s", w.Code, w.Body)
+		}
+	}
+
+	openBreaker(t, clock)
+	stale, err := allowCall(breakerHost, clock.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	staleReleased, err := allowCall(breakerHost, clock.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reset()
+	if state := breakerState(breakerHost); state.state != breakerClosed || state.probes != 0 || state.shortCircuited != 0 {
+		t.Fatalf("after a reset the breaker is %+v; want closed", state)
+	}
+
+	// The breaker opens again and its next trials are in flight when the old ones finish
+	openBreaker(t, clock)
+	if _, err := allowCall(breakerHost, clock.Now()); err != nil {
+		t.Fatal(err)
+	}
+	releaseCall(staleReleased)
+	recordCall(stale, clock.Now(), callRejected) // a 4xx: the host is up, so it closes
+	if state := breakerState(breakerHost); state.state != breakerClosed {
+		t.Fatalf("a trial from before the reset that reached the host left the breaker %s; want closed", state.state)
+	}
+
+	openBreaker(t, clock)
+	current, err := allowCall(breakerHost, clock.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseCall(staleReleased)
+	releaseCall(stale)
+	if state := breakerState(breakerHost); state.probes != 1 {
+		t.Fatalf("%d trials in flight after stale ones were given back; want the current one", state.probes)
+	}
+	if _, err := allowCall(breakerHost, clock.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := allowCall(breakerHost, clock.Now()); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("a third trial = %v; want the limit of two kept", err)
+	}
+	recordCall(current, clock.Now(), callSucceeded)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// In claim mode every replica queues every task, so several of them wake up for the same
+// run. Before executing, a replica claims the run with a conditional write on the task
+// row that sets a lease (leaseOwner/leaseExpiry) and bumps fencingToken. The condition
+// requires the fencingToken the replica read and an expired lease, so of the replicas
+// that read the same version of the task one wins. The winner's final write releases the
+// lease and bumps fencingToken again, so a replica that read the task while the run was
+// claimed cannot claim it once it is done. That write is also conditioned on the
+// winner's token: a replica whose lease ran out and was taken over can no longer record
+// its stale result.
+//
+// Leader and shard modes claim every run too; leader.go and sharding.go explain why.
+
+var errClaimHeld = errors.New("run is claimed by another instance")
+
+// claimExecution takes the lease on the task's current run. It returns the new fencing
+// token, or errClaimHeld if another instance holds the lease or claimed the run first.
+func claimExecution(task *Task, now time.Time) (int64, error) {
+	startTime := time.Now()
+	callerMethod := "claimExecution"
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String("daria_tasks"), // Specify your DynamoDB tasks table name
+		Key: map[string]*dynamodb.AttributeValue{
+			"taskId": {
+				S: aws.String(task.TaskID),
+			},
+		},
+		UpdateExpression: aws.String("SET leaseOwner = :me, leaseExpiry = :exp ADD fencingToken :one"),
+		ConditionExpression: aws.String("attribute_exists(taskId)" +
+			" AND (attribute_not_exists(fencingToken) OR fencingToken = :seen)" +
+			" AND (attribute_not_exists(leaseExpiry) OR leaseExpiry < :now)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":me": {
+				S: aws.String(config.InstanceID),
+			},
+			":exp": {
+				N: aws.String(strconv.FormatInt(now.Add(config.LeaseDuration).Unix(), 10)),
+			},
+			":one": {
+				N: aws.String("1"),
+			},
+			":seen": {
+				N: aws.String(strconv.FormatInt(task.FencingToken, 10)),
+			},
+			":now": {
+				N: aws.String(strconv.FormatInt(now.Unix(), 10)),
+			},
+		},
+		ReturnValues: aws.String("UPDATED_NEW"),
+	}
+
+	result, err := db.svc.UpdateItem(input)
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			log(callerMethod, fmt.Sprintf("Run of %s is claimed elsewhere", task.TaskID))
+			return 0, errClaimHeld
+		}
+		log(callerMethod, err.Error())
+		return 0, err
+	}
+
+	token, err := strconv.ParseInt(aws.StringValue(result.Attributes["fencingToken"].N), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	log(callerMethod, fmt.Sprintf("Claimed run of %s with fencing token %d", task.TaskID, token))
+	return token, nil
+}
+
+// claimRecheckTime is when a replica that lost a claim should look at the task again: once
+// the current holder's lease has run out, in case the holder died before finishing.
+func claimRecheckTime(task *Task, now time.Time) time.Time {
+	if task.LeaseExpiry > now.Unix() {
+		return time.Unix(task.LeaseExpiry+1, 0)
+	}
+	return now.Add(config.LeaseDuration)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTaskRow stands in for one row of daria_tasks, enough for claims and final writes.
+// It evaluates the conditions claimExecution and updateTaskInDb use.
+type fakeTaskRow struct {
+	mu           sync.Mutex
+	fencingToken int64 // 0 if absent
+	leaseOwner   string
+	leaseExpiry  int64 // 0 if absent
+	writes       int
+}
+
+func (f *fakeTaskRow) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target, req, ok := decodeFakeRequest(w, r)
+	if !ok {
+		return
+	}
+	values := req.ExpressionAttributeValues
+	number := func(name string) int64 {
+		n, _ := strconv.ParseInt(values[name].N, 10, 64)
+		return n
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case target == "DynamoDB_20120810.GetItem":
+		item := map[string]fakeAttribute{"taskId": {S: "task_1"}, "userId": {S: "user_1"}}
+		if f.fencingToken != 0 {
+			item["fencingToken"] = fakeAttribute{N: strconv.FormatInt(f.fencingToken, 10)}
+		}
+		if f.leaseExpiry != 0 {
+			item["leaseOwner"] = fakeAttribute{S: f.leaseOwner}
+			item["leaseExpiry"] = fakeAttribute{N: strconv.FormatInt(f.leaseExpiry, 10)}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Item": item})
+	case target == "DynamoDB_20120810.UpdateItem" && strings.Contains(req.UpdateExpression, "leaseOwner = :me"):
+		// (attribute_not_exists(fencingToken) OR fencingToken = :seen)
+		// AND (attribute_not_exists(leaseExpiry) OR leaseExpiry < :now)
+		if (f.fencingToken != 0 && f.fencingToken != number(":seen")) || (f.leaseExpiry != 0 && f.leaseExpiry >= number(":now")) {
+			writeConditionalCheckFailed(w)
+			return
+		}
+		f.leaseOwner, f.leaseExpiry = values[":me"].S, number(":exp")
+		f.fencingToken++
+		json.NewEncoder(w).Encode(map[string]interface{}{"Attributes": map[string]fakeAttribute{
+			"fencingToken": {N: strconv.FormatInt(f.fencingToken, 10)},
+		}})
+	case target == "DynamoDB_20120810.UpdateItem":
+		if strings.Contains(req.ConditionExpression, "fencingToken = :ft") && f.fencingToken != number(":ft") {
+			writeConditionalCheckFailed(w)
+			return
+		}
+		f.writes++
+		if strings.Contains(req.UpdateExpression, "ADD fencingToken :one") {
+			f.fencingToken++
+		}
+		if strings.Contains(req.UpdateExpression, "REMOVE leaseOwner, leaseExpiry") {
+			f.leaseOwner, f.leaseExpiry = "", 0
+		}
+		w.Write([]byte(`{}`))
+	default:
+		writeFakeError(w, "ValidationException", "unexpected call to "+target)
+	}
+}
+
+// useFakeTaskRow points db at a fake task_1 and gives replicas a one-minute lease.
+func useFakeTaskRow(t *testing.T) *fakeTaskRow {
+	t.Helper()
+	row := &fakeTaskRow{}
+	useFakeDynamoDB(t, row)
+	saved := config
+	config.LeaseDuration = time.Minute
+	t.Cleanup(func() { config = saved })
+	return row
+}
+
+// claimAs claims task as the named replica.
+func claimAs(instanceID string, task *Task, now time.Time) (int64, error) {
+	config.InstanceID = instanceID
+	return claimExecution(task, now)
+}
+
+func readTask(t *testing.T) *Task {
+	t.Helper()
+	task, err := getTaskFromDB("task_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return task
+}
+
+func TestClaimExecutionAfterRelease(t *testing.T) {
+	row := useFakeTaskRow(t)
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	// A and B wake up for the same run and read the same version of the task
+	a, b := readTask(t), readTask(t)
+	tokenA, err := claimAs("a", a, now)
+	if err != nil {
+		t.Fatalf("A's claim: %v", err)
+	}
+	if _, err := claimAs("b", b, now); !errors.Is(err, errClaimHeld) {
+		t.Fatalf("B's claim of the same read = %v; want errClaimHeld", err)
+	}
+
+	// B reads again while A holds the run, then waits out its rate limit while A finishes
+	b = readTask(t)
+	if b.FencingToken != tokenA || b.LeaseOwner != "a" {
+		t.Fatalf("B read token %d owned by %q; want A's token %d", b.FencingToken, b.LeaseOwner, tokenA)
+	}
+	if err := updateTaskInDb(a, tokenA); err != nil {
+		t.Fatalf("A's final write: %v", err)
+	}
+	if row.leaseExpiry != 0 {
+		t.Fatal("A's final write left its lease")
+	}
+	if _, err := claimAs("b", b, now.Add(10*time.Second)); !errors.Is(err, errClaimHeld) {
+		t.Fatalf("B's claim from a read taken during A's run = %v; want errClaimHeld, or B runs the run A finished", err)
+	}
+
+	// A fresh read sees the released run and can claim the next one
+	c := readTask(t)
+	if _, err := claimAs("c", c, now.Add(time.Hour)); err != nil {
+		t.Fatalf("claim after a fresh read: %v", err)
+	}
+}
+
+func TestClaimExecutionTakeover(t *testing.T) {
+	row := useFakeTaskRow(t)
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	a := readTask(t)
+	tokenA, err := claimAs("a", a, now)
+	if err != nil {
+		t.Fatalf("A's claim: %v", err)
+	}
+	b := readTask(t)
+	if _, err := claimAs("b", b, now.Add(30*time.Second)); !errors.Is(err, errClaimHeld) {
+		t.Fatalf("B's claim during A's lease = %v; want errClaimHeld", err)
+	}
+	if recheck := claimRecheckTime(b, now.Add(30*time.Second)); recheck.Unix() != b.LeaseExpiry+1 {
+		t.Fatalf("B rechecks at %s; want just after A's lease ends at %d", recheck, b.LeaseExpiry)
+	}
+
+	// A stalls past its lease and B takes the run over
+	tokenB, err := claimAs("b", b, now.Add(2*time.Minute))
+	if err != nil {
+		t.Fatalf("B's takeover: %v", err)
+	}
+	if err := updateTaskInDb(a, tokenA); !errors.Is(err, errTaskNotFound) {
+		t.Fatalf("A's stale final write = %v; want it refused", err)
+	}
+	if err := updateTaskInDb(b, tokenB); err != nil {
+		t.Fatalf("B's final write: %v", err)
+	}
+	if row.writes != 1 {
+		t.Fatalf("%d final writes recorded; want only B's", row.writes)
+	}
+}
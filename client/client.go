@@ -0,0 +1,394 @@
+// Package client is a Go client for the jobScheduler API.
+//
+//	c := client.New("https://jobs.example.com", apiKey)
+//	taskID, err := c.CreateTask(ctx, api.CreateTaskInput{...})
+//	if errors.Is(err, client.ErrQuotaExceeded) {
+//		...
+//	}
+//
+// Requests that fail with a 5xx status or a network error are retried with exponential
+// backoff. Creates carry a generated Idempotency-Key, so retrying them never creates a
+// task twice.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"daria.com/jobScheduler/api"
+	"github.com/google/uuid"
+)
+
+// apiVersion prefixes every path; the client speaks this version of the API.
+const apiVersion = "/v1"
+
+// Client calls the API on behalf of one user. Its fields may be changed before first use.
+type Client struct {
+	BaseURL    string
+	APIKey     string
+	HTTPClient *http.Client
+	// MaxRetries is how many times a request is retried after a 5xx or network error
+	MaxRetries int
+	// RetryBackoff is the wait before the first retry; it doubles for each one after
+	RetryBackoff time.Duration
+}
+
+// New returns a client with three retries starting at half a second apart.
+func New(baseURL string, apiKey string) *Client {
+	return &Client{
+		BaseURL:      strings.TrimRight(baseURL, "/"),
+		APIKey:       apiKey,
+		HTTPClient:   &http.Client{Timeout: time.Minute},
+		MaxRetries:   3,
+		RetryBackoff: 500 * time.Millisecond,
+	}
+}
+
+// Error is an error response from the API. Code is one of the stable error codes of
+// api.Error; Fields lists the offending fields of a validation error.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	Fields     []api.FieldError
+	RequestID  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Errors to test an *Error against with errors.Is.
+var (
+	ErrInvalid       = errors.New("invalid request")   // 400 and 422
+	ErrUnauthorized  = errors.New("invalid API key")   // 401
+	ErrForbidden     = errors.New("forbidden")         // 403
+	ErrNotFound      = errors.New("not found")         // 404
+	ErrConflict      = errors.New("conflict")          // 409
+	ErrQuotaExceeded = errors.New("job limit reached") // 429
+	ErrServer        = errors.New("server error")      // 5xx
+)
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrInvalid:
+		return e.StatusCode == http.StatusBadRequest || e.StatusCode == http.StatusUnprocessableEntity
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict
+	case ErrQuotaExceeded:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrServer:
+		return e.StatusCode >= 500
+	}
+	return false
+}
+
+// CreateTask creates a task and returns its ID.
+func (c *Client) CreateTask(ctx context.Context, input api.CreateTaskInput) (string, error) {
+	var result api.CreateTaskResult
+	err := c.do(ctx, request{method: http.MethodPost, path: "/tasks", body: input, idempotent: true}, &result)
+	return result.TaskID, err
+}
+
+// CreateTasks creates up to 500 tasks in one request. Each is created independently, so
+// check the result of every item.
+func (c *Client) CreateTasks(ctx context.Context, inputs []api.CreateTaskInput) (*api.BatchResult, error) {
+	var result api.BatchResult
+	err := c.do(ctx, request{method: http.MethodPost, path: "/tasks:batch", body: inputs, idempotent: true}, &result)
+	return &result, err
+}
+
+func (c *Client) ListTasks(ctx context.Context) ([]api.Task, error) {
+	var result api.TaskList
+	err := c.do(ctx, request{method: http.MethodGet, path: "/tasks"}, &result)
+	return result.Tasks, err
+}
+
+func (c *Client) GetTask(ctx context.Context, taskID string) (*api.Task, error) {
+	var task api.Task
+	err := c.do(ctx, request{method: http.MethodGet, path: taskPath(taskID, "")}, &task)
+	return &task, err
+}
+
+// UpdateTask changes the fields set in input and returns the updated task.
+func (c *Client) UpdateTask(ctx context.Context, taskID string, input api.UpdateTaskInput) (*api.Task, error) {
+	var task api.Task
+	err := c.do(ctx, request{method: http.MethodPatch, path: taskPath(taskID, ""), body: input}, &task)
+	return &task, err
+}
+
+func (c *Client) DeleteTask(ctx context.Context, taskID string) error {
+	return c.do(ctx, request{method: http.MethodDelete, path: taskPath(taskID, "")}, nil)
+}
+
+func (c *Client) PauseTask(ctx context.Context, taskID string) (*api.Task, error) {
+	return c.taskAction(ctx, taskID, "pause")
+}
+
+func (c *Client) ResumeTask(ctx context.Context, taskID string) (*api.Task, error) {
+	return c.taskAction(ctx, taskID, "resume")
+}
+
+// RunTaskNow moves the task's next run to now.
+func (c *Client) RunTaskNow(ctx context.Context, taskID string) (*api.Task, error) {
+	return c.taskAction(ctx, taskID, "run")
+}
+
+func (c *Client) taskAction(ctx context.Context, taskID string, action string) (*api.Task, error) {
+	var task api.Task
+	err := c.do(ctx, request{method: http.MethodPost, path: taskPath(taskID, action)}, &task)
+	return &task, err
+}
+
+// History returns up to limit of the task's most recent executions, newest first.
+func (c *Client) History(ctx context.Context, taskID string, limit int) ([]api.Execution, error) {
+	var result api.History
+	path := taskPath(taskID, "history") + "?limit=" + strconv.Itoa(limit)
+	err := c.do(ctx, request{method: http.MethodGet, path: path}, &result)
+	return result.Executions, err
+}
+
+// Logs returns the server's log lines about the task from cursor on. A negative cursor
+// returns the most recent lines; pass the returned Cursor to get only newer ones.
+func (c *Client) Logs(ctx context.Context, taskID string, cursor int64) (*api.LogLines, error) {
+	path := taskPath(taskID, "logs")
+	if cursor >= 0 {
+		path += "?cursor=" + strconv.FormatInt(cursor, 10)
+	}
+	var result api.LogLines
+	err := c.do(ctx, request{method: http.MethodGet, path: path}, &result)
+	return &result, err
+}
+
+// DeadLetters returns up to limit of the user's dead letters, newest first, only those of
+// taskID if it is not empty.
+func (c *Client) DeadLetters(ctx context.Context, taskID string, limit int) ([]api.DeadLetter, error) {
+	var result api.DeadLetterList
+	query := url.Values{"limit": {strconv.Itoa(limit)}}
+	if taskID != "" {
+		query.Set("taskId", taskID)
+	}
+	err := c.do(ctx, request{method: http.MethodGet, path: "/dead-letters?" + query.Encode()}, &result)
+	return result.DeadLetters, err
+}
+
+func (c *Client) DeadLetter(ctx context.Context, deadLetterID string) (*api.DeadLetter, error) {
+	var result api.DeadLetter
+	err := c.do(ctx, request{method: http.MethodGet, path: "/dead-letters/" + url.PathEscape(deadLetterID)}, &result)
+	return &result, err
+}
+
+// ReplayDeadLetter sends the dead letter's request again, with body instead of the
+// original one if it is not nil. The replay's result is in the returned LastReplay. It is
+// not retried.
+func (c *Client) ReplayDeadLetter(ctx context.Context, deadLetterID string, body map[string]interface{}) (*api.DeadLetter, error) {
+	var result api.DeadLetter
+	path := "/dead-letters/" + url.PathEscape(deadLetterID) + "/replay"
+	err := c.do(ctx, request{method: http.MethodPost, path: path, body: api.ReplayInput{Body: body}, once: true}, &result)
+	return &result, err
+}
+
+// NotificationRules returns the user's notification rules, only those watching taskID if
+// it is not empty.
+func (c *Client) NotificationRules(ctx context.Context, taskID string) ([]api.NotificationRule, error) {
+	var result api.NotificationRuleList
+	path := "/notification-rules"
+	if taskID != "" {
+		path += "?taskId=" + url.QueryEscape(taskID)
+	}
+	err := c.do(ctx, request{method: http.MethodGet, path: path}, &result)
+	return result.Rules, err
+}
+
+// CreateNotificationRule adds a rule. It is not retried, since a second request would
+// add a second rule.
+func (c *Client) CreateNotificationRule(ctx context.Context, input api.NotificationRuleInput) (*api.NotificationRule, error) {
+	var rule api.NotificationRule
+	err := c.do(ctx, request{method: http.MethodPost, path: "/notification-rules", body: input, once: true}, &rule)
+	return &rule, err
+}
+
+// UpdateNotificationRule replaces the rule with input.
+func (c *Client) UpdateNotificationRule(ctx context.Context, ruleID string, input api.NotificationRuleInput) (*api.NotificationRule, error) {
+	var rule api.NotificationRule
+	err := c.do(ctx, request{method: http.MethodPut, path: "/notification-rules/" + url.PathEscape(ruleID), body: input}, &rule)
+	return &rule, err
+}
+
+func (c *Client) DeleteNotificationRule(ctx context.Context, ruleID string) error {
+	return c.do(ctx, request{method: http.MethodDelete, path: "/notification-rules/" + url.PathEscape(ruleID)}, nil)
+}
+
+// TestNotificationRule sends a sample notification through the rule. The returned
+// delivery's Error is empty if it was delivered. It is not retried.
+func (c *Client) TestNotificationRule(ctx context.Context, ruleID string) (*api.NotificationDelivery, error) {
+	var delivery api.NotificationDelivery
+	path := "/notification-rules/" + url.PathEscape(ruleID) + "/test"
+	err := c.do(ctx, request{method: http.MethodPost, path: path, once: true}, &delivery)
+	return &delivery, err
+}
+
+// Apply converges the user's named tasks on the manifest, or with dryRun only plans it.
+// contentType is application/json or application/yaml.
+func (c *Client) Apply(ctx context.Context, manifest []byte, contentType string, dryRun bool) (*api.ApplyResult, error) {
+	path := "/tasks:apply"
+	if dryRun {
+		path += "?dryRun=true"
+	}
+	var result api.ApplyResult
+	err := c.do(ctx, request{method: http.MethodPost, path: path, raw: manifest, contentType: contentType}, &result)
+	return &result, err
+}
+
+// Export returns all the user's tasks in the given format, json or csv.
+func (c *Client) Export(ctx context.Context, format string) ([]byte, error) {
+	var data []byte
+	err := c.do(ctx, request{method: http.MethodGet, path: "/tasks:export?format=" + url.QueryEscape(format)}, &data)
+	return data, err
+}
+
+// Import creates tasks from data in the export format, json or csv.
+func (c *Client) Import(ctx context.Context, data []byte, format string) (*api.BatchResult, error) {
+	var result api.BatchResult
+	path := "/tasks:import?format=" + url.QueryEscape(format)
+	contentType := "application/json"
+	if format == "csv" {
+		contentType = "text/csv"
+	}
+	err := c.do(ctx, request{method: http.MethodPost, path: path, raw: data, contentType: contentType, idempotent: true}, &result)
+	return &result, err
+}
+
+type request struct {
+	method      string
+	path        string
+	body        interface{} // sent as JSON
+	raw         []byte      // sent as is, with contentType
+	contentType string
+	// idempotent requests get an Idempotency-Key, so retrying them is safe
+	idempotent bool
+	// once requests are never retried, since a second one would have an effect of its own
+	once bool
+}
+
+// do sends the request, retrying 5xx responses and network errors, and decodes a JSON
+// response into out. If out is a *[]byte it gets the raw response instead.
+func (c *Client) do(ctx context.Context, req request, out interface{}) error {
+	body := req.raw
+	contentType := req.contentType
+	if req.body != nil {
+		encoded, err := json.Marshal(req.body)
+		if err != nil {
+			return err
+		}
+		body = encoded
+		contentType = "application/json"
+	}
+	idempotencyKey := ""
+	if req.idempotent {
+		idempotencyKey = uuid.NewString()
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= c.MaxRetries; attempt++ {
+		if attempt > 0 {
+			backoff := c.RetryBackoff << (attempt - 1)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+		}
+
+		data, err := c.send(ctx, req.method, req.path, contentType, body, idempotencyKey)
+		if err == nil {
+			return decode(data, out)
+		}
+		lastErr = err
+		var apiErr *Error
+		if req.once || ctx.Err() != nil || (errors.As(err, &apiErr) && apiErr.StatusCode < 500) {
+			return err
+		}
+	}
+	return lastErr
+}
+
+func (c *Client) send(ctx context.Context, method string, path string, contentType string, body []byte, idempotencyKey string) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, method, c.BaseURL+apiVersion+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("X-API-KEY", c.APIKey)
+	if contentType != "" {
+		httpReq.Header.Set("Content-Type", contentType)
+	}
+	if idempotencyKey != "" {
+		httpReq.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := c.HTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var body api.ErrorResponse
+		if json.Unmarshal(data, &body) != nil || body.Error.Message == "" {
+			body.Error.Message = http.StatusText(resp.StatusCode)
+		}
+		return nil, &Error{
+			StatusCode: resp.StatusCode,
+			Code:       body.Error.Code,
+			Message:    body.Error.Message,
+			Fields:     body.Error.Fields,
+			RequestID:  body.Error.RequestID,
+		}
+	}
+	return data, nil
+}
+
+func decode(data []byte, out interface{}) error {
+	if out == nil {
+		return nil
+	}
+	if raw, ok := out.(*[]byte); ok {
+		*raw = data
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	return nil
+}
+
+func taskPath(taskID string, action string) string {
+	path := "/tasks/" + url.PathEscape(taskID)
+	if action != "" {
+		path += "/" + action
+	}
+	return path
+}
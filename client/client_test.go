@@ -0,0 +1,184 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"daria.com/jobScheduler/api"
+)
+
+// recordedServer answers each request with the next of its responses, repeating the last,
+// and keeps the requests it got.
+type recordedServer struct {
+	mu        sync.Mutex
+	responses []func(w http.ResponseWriter)
+	requests  []*http.Request
+}
+
+func (s *recordedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r)
+	respond := s.responses[min(len(s.requests), len(s.responses))-1]
+	s.mu.Unlock()
+	respond(w)
+}
+
+func (s *recordedServer) calls() []*http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func status(code int, body string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		w.Write([]byte(body))
+	}
+}
+
+// dropConnection closes the connection without a response, like a network error.
+func dropConnection(w http.ResponseWriter) {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err == nil {
+		conn.Close()
+	}
+}
+
+// newTestClient returns a client of a server answering with responses, retrying three
+// times a millisecond apart.
+func newTestClient(t *testing.T, responses ...func(w http.ResponseWriter)) (*Client, *recordedServer) {
+	t.Helper()
+	server := &recordedServer{responses: responses}
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+	c := New(ts.URL, "key_1")
+	c.RetryBackoff = time.Millisecond
+	return c, server
+}
+
+func TestRetriesServerErrors(t *testing.T) {
+	c, server := newTestClient(t,
+		status(http.StatusServiceUnavailable, `{"error": {"code": "unavailable", "message": "Try again"}}`),
+		dropConnection,
+		status(http.StatusCreated, `{"taskId": "task_1"}`),
+	)
+	taskID, err := c.CreateTask(context.Background(), api.CreateTaskInput{APIMethod: "GET", APIURL: "https://example.com"})
+	if err != nil || taskID != "task_1" {
+		t.Fatalf("CreateTask = %q, %v; want task_1", taskID, err)
+	}
+	requests := server.calls()
+	if len(requests) != 3 {
+		t.Fatalf("%d requests; want 3", len(requests))
+	}
+	key := requests[0].Header.Get("Idempotency-Key")
+	for i, r := range requests {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/tasks" || r.Header.Get("X-API-KEY") != "key_1" {
+			t.Fatalf("request %d is %s %s with key %q", i, r.Method, r.URL.Path, r.Header.Get("X-API-KEY"))
+		}
+		if got := r.Header.Get("Idempotency-Key"); key == "" || got != key {
+			t.Fatalf("request %d has Idempotency-Key %q; want the first one's, %q", i, got, key)
+		}
+	}
+
+	// Every retry failing returns the last error
+	c, server = newTestClient(t, status(http.StatusInternalServerError, `not JSON`))
+	_, err = c.GetTask(context.Background(), "task_1")
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || !errors.Is(err, ErrServer) || apiErr.Message != "Internal Server Error" {
+		t.Fatalf("GetTask = %v; want a 500 *Error", err)
+	}
+	if n := len(server.calls()); n != 4 {
+		t.Fatalf("%d requests; want the first and three retries", n)
+	}
+	if key := server.calls()[0].Header.Get("Idempotency-Key"); key != "" {
+		t.Fatalf("a GET was sent with Idempotency-Key %q", key)
+	}
+}
+
+func TestDoesNotRetryClientErrors(t *testing.T) {
+	tests := []struct {
+		status int
+		is     error
+	}{
+		{http.StatusBadRequest, ErrInvalid},
+		{http.StatusUnauthorized, ErrUnauthorized},
+		{http.StatusForbidden, ErrForbidden},
+		{http.StatusNotFound, ErrNotFound},
+		{http.StatusConflict, ErrConflict},
+		{http.StatusUnprocessableEntity, ErrInvalid},
+		{http.StatusTooManyRequests, ErrQuotaExceeded},
+	}
+	for _, test := range tests {
+		c, server := newTestClient(t, status(test.status, `{"error": {"code": "some_code", "message": "No", "requestId": "req_1"}}`))
+		_, err := c.CreateTask(context.Background(), api.CreateTaskInput{})
+		if !errors.Is(err, test.is) || errors.Is(err, ErrServer) {
+			t.Errorf("%d: err = %v; want it to match %v", test.status, err, test.is)
+		}
+		if n := len(server.calls()); n != 1 {
+			t.Errorf("%d: sent %d times; want once", test.status, n)
+		}
+	}
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	c, _ := newTestClient(t, status(http.StatusBadRequest, `{"error": {
+		"code": "validation_failed", "message": "frequency must be at least 1", "field": "frequency",
+		"fields": [{"field": "frequency", "code": "minimum", "message": "frequency must be at least 1"}],
+		"requestId": "req_1"}}`))
+	_, err := c.CreateTask(context.Background(), api.CreateTaskInput{})
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("err = %v; want an *Error", err)
+	}
+	if apiErr.StatusCode != http.StatusBadRequest || apiErr.Code != "validation_failed" || apiErr.Message != "frequency must be at least 1" ||
+		apiErr.RequestID != "req_1" || len(apiErr.Fields) != 1 || apiErr.Fields[0].Field != "frequency" || apiErr.Fields[0].Code != "minimum" {
+		t.Fatalf("err = %+v; want the envelope's code, message, fields and request ID", apiErr)
+	}
+	if want := "400 Bad Request: frequency must be at least 1"; err.Error() != want {
+		t.Fatalf("message = %q; want %q", err.Error(), want)
+	}
+}
+
+func TestOnceRequestsAreSentOnce(t *testing.T) {
+	c, server := newTestClient(t, status(http.StatusBadGateway, `{"error": {"code": "unavailable", "message": "Bad gateway"}}`))
+	_, err := c.CreateNotificationRule(context.Background(), api.NotificationRuleInput{Events: []string{"failure"}, Channel: "email"})
+	if !errors.Is(err, ErrServer) {
+		t.Fatalf("err = %v; want the 502", err)
+	}
+	if n := len(server.calls()); n != 1 {
+		t.Fatalf("sent %d times; want once", n)
+	}
+
+	c, server = newTestClient(t, dropConnection)
+	if _, err := c.ReplayDeadLetter(context.Background(), "letter_1", nil); err == nil {
+		t.Fatal("a dropped replay succeeded")
+	}
+	if n := len(server.calls()); n != 1 {
+		t.Fatalf("replay sent %d times; want once", n)
+	}
+}
+
+func TestHonoursContextDuringBackoff(t *testing.T) {
+	c, server := newTestClient(t, status(http.StatusServiceUnavailable, `{}`))
+	c.RetryBackoff = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := c.ListTasks(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v; want the context's", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("returned after %s; want as soon as the context ended", elapsed)
+	}
+	if n := len(server.calls()); n != 1 {
+		t.Fatalf("sent %d times; want once before the context ended", n)
+	}
+}
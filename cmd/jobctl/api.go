@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"daria.com/jobScheduler/client"
+)
+
+// parseCommand parses the command's flags, with the connection flags added, and resolves
+// the connection. It checks that exactly args positional arguments were given.
+func parseCommand(name string, args []string, positional []string, setup func(flags *flag.FlagSet)) (*connection, []string, error) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	conn := &connection{}
+	conn.register(flags)
+	if setup != nil {
+		setup(flags)
+	}
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: jobctl %s [flags]", name)
+		for _, arg := range positional {
+			fmt.Fprintf(flags.Output(), " <%s>", arg)
+		}
+		fmt.Fprintln(flags.Output())
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if flags.NArg() != len(positional) {
+		flags.Usage()
+		return nil, nil, flag.ErrHelp
+	}
+	if err := conn.resolve(); err != nil {
+		return nil, nil, err
+	}
+	conn.client = client.New(conn.server, conn.apiKey)
+	return conn, flags.Args(), nil
+}
+
+// printJSON writes a response as indented JSON, for -json.
+func printJSON(value interface{}) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(os.Stdout, string(data))
+	return err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"daria.com/jobScheduler/api"
+)
+
+// runApply sends a manifest to the server and prints the resulting plan.
+func runApply(args []string) error {
+	var file string
+	var dryRun bool
+	conn, _, err := parseCommand("apply", args, nil, func(flags *flag.FlagSet) {
+		flags.StringVar(&file, "f", "", "manifest file (.yaml, .yml or .json); - reads standard input")
+		flags.BoolVar(&dryRun, "dry-run", false, "only show what would change")
+	})
+	if err != nil {
+		return err
+	}
+	if file == "" {
+		return fmt.Errorf("apply needs a manifest: -f <file>")
+	}
+
+	var manifest []byte
+	if file == "-" {
+		manifest, err = io.ReadAll(os.Stdin)
+	} else {
+		manifest, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return err
+	}
+	contentType := "application/json"
+	if ext := strings.ToLower(filepath.Ext(file)); ext == ".yaml" || ext == ".yml" || (file == "-" && !json.Valid(manifest)) {
+		contentType = "application/yaml"
+	}
+
+	result, err := conn.client.Apply(context.Background(), manifest, contentType, dryRun)
+	if err != nil {
+		return err
+	}
+	if conn.asJSON {
+		if err := printJSON(result); err != nil {
+			return err
+		}
+	} else {
+		printPlan(os.Stdout, result)
+	}
+	if result.Failed > 0 {
+		return fmt.Errorf("%d changes failed", result.Failed)
+	}
+	return nil
+}
+
+// printPlan lists the changes with a +, ~ or - marker, then a summary line.
+func printPlan(w io.Writer, result *api.ApplyResult) {
+	markers := map[string]string{"create": "+", "update": "~", "delete": "-"}
+	for _, change := range result.Changes {
+		marker, ok := markers[change.Action]
+		if !ok {
+			continue // unchanged
+		}
+		line := fmt.Sprintf("%s %s %s", marker, change.Action, change.Name)
+		if change.TaskID != "" {
+			line += fmt.Sprintf(" (%s)", change.TaskID)
+		}
+		if len(change.Fields) > 0 {
+			line += ": " + strings.Join(change.Fields, ", ")
+		}
+		if change.Status == "failed" {
+			line += " FAILED: " + change.Error
+		}
+		fmt.Fprintln(w, line)
+	}
+
+	verb := "Applied"
+	if result.DryRun {
+		verb = "Plan"
+	}
+	fmt.Fprintf(w, "%s: %d to create, %d to update, %d to delete, %d unchanged\n", verb,
+		result.Summary["create"], result.Summary["update"], result.Summary["delete"], result.Summary["unchanged"])
+}
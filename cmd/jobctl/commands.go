@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"daria.com/jobScheduler/api"
+)
+
+// taskFlags are the task fields create and update take as flags.
+type taskFlags struct {
+	name, method, url, start, body, delivery string
+	every                                    time.Duration
+}
+
+func (f *taskFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&f.name, "name", "", "task name, unique among your tasks")
+	flags.StringVar(&f.method, "method", "POST", "HTTP method of the call")
+	flags.StringVar(&f.url, "url", "", "URL to call")
+	flags.StringVar(&f.start, "start", "", "first run as \"2006-01-02 15:04:05\" UTC (create defaults to now)")
+	flags.DurationVar(&f.every, "every", 0, "how often to run, e.g. 15m or 24h")
+	flags.StringVar(&f.body, "body", "", "JSON body of the call, or @file to read it from a file")
+	flags.StringVar(&f.delivery, "delivery", "", "delivery guarantee: atLeastOnce or atMostOnce")
+}
+
+// update returns the flags the user set as a PATCH body, and how many were set.
+func (f *taskFlags) update(flags *flag.FlagSet) (api.UpdateTaskInput, int, error) {
+	var input api.UpdateTaskInput
+	set := 0
+	var err error
+	flags.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "name":
+			input.Name = &f.name
+		case "method":
+			input.APIMethod = &f.method
+		case "url":
+			input.APIURL = &f.url
+		case "start":
+			input.StartFrom = &f.start
+		case "every":
+			var frequency int
+			if frequency, err = f.frequency(); err == nil {
+				input.Frequency = &frequency
+			}
+		case "body":
+			if input.APIBody, err = f.apiBody(); err == nil && input.APIBody == nil {
+				input.APIBody = map[string]interface{}{}
+			}
+		case "delivery":
+			input.DeliveryGuarantee = &f.delivery
+		default:
+			return
+		}
+		set++
+	})
+	return input, set, err
+}
+
+// create returns all the task flags as a POST /tasks body.
+func (f *taskFlags) create() (api.CreateTaskInput, error) {
+	input := api.CreateTaskInput{
+		Name:              f.name,
+		APIMethod:         f.method,
+		APIURL:            f.url,
+		StartFrom:         f.start,
+		DeliveryGuarantee: f.delivery,
+	}
+	var err error
+	if input.Frequency, err = f.frequency(); err != nil {
+		return input, err
+	}
+	if input.APIBody, err = f.apiBody(); err != nil {
+		return input, err
+	}
+	if input.APIBody == nil {
+		input.APIBody = map[string]interface{}{}
+	}
+	return input, nil
+}
+
+func (f *taskFlags) frequency() (int, error) {
+	if f.every%time.Second != 0 || f.every <= 0 {
+		return 0, errors.New("-every must be a positive whole number of seconds")
+	}
+	return int(f.every / time.Second), nil
+}
+
+// apiBody parses -body, reading it from a file if it starts with @.
+func (f *taskFlags) apiBody() (map[string]interface{}, error) {
+	if f.body == "" {
+		return nil, nil
+	}
+	data := []byte(f.body)
+	if strings.HasPrefix(f.body, "@") {
+		var err error
+		if data, err = os.ReadFile(f.body[1:]); err != nil {
+			return nil, err
+		}
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, fmt.Errorf("-body must be a JSON object: %w", err)
+	}
+	return body, nil
+}
+
+func runCreate(args []string) error {
+	var f taskFlags
+	var file string
+	conn, _, err := parseCommand("create", args, nil, func(fs *flag.FlagSet) {
+		f.register(fs)
+		fs.StringVar(&file, "f", "", "JSON file with the task, in the POST /tasks format; overrides the other task flags")
+	})
+	if err != nil {
+		return err
+	}
+
+	var input api.CreateTaskInput
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &input); err != nil {
+			return fmt.Errorf("reading %s: %w", file, err)
+		}
+	} else {
+		if f.start == "" {
+			f.start = time.Now().UTC().Format("2006-01-02 15:04:05")
+		}
+		if input, err = f.create(); err != nil {
+			return err
+		}
+	}
+
+	taskID, err := conn.client.CreateTask(context.Background(), input)
+	if err != nil {
+		return err
+	}
+	if conn.asJSON {
+		return printJSON(api.CreateTaskResult{TaskID: taskID})
+	}
+	fmt.Println(taskID)
+	return nil
+}
+
+func runList(args []string) error {
+	conn, _, err := parseCommand("list", args, nil, nil)
+	if err != nil {
+		return err
+	}
+	tasks, err := conn.client.ListTasks(context.Background())
+	if err != nil {
+		return err
+	}
+	if conn.asJSON {
+		return printJSON(api.TaskList{Tasks: tasks})
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TASK ID\tNAME\tMETHOD\tURL\tEVERY\tNEXT RUN (UTC)\tRUNS\tSTATE")
+	for _, t := range tasks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\n", t.TaskID, orDash(t.Name), t.APIMethod, t.APIURL,
+			time.Duration(t.Frequency)*time.Second, formatTime(t.NextExecution), t.TotalExecutions, taskState(t))
+	}
+	return tw.Flush()
+}
+
+func runGet(args []string) error {
+	conn, ids, err := parseCommand("get", args, []string{"taskId"}, nil)
+	if err != nil {
+		return err
+	}
+	return printTaskResult(conn)(conn.client.GetTask(context.Background(), ids[0]))
+}
+
+func runUpdate(args []string) error {
+	var f taskFlags
+	var flags *flag.FlagSet
+	conn, ids, err := parseCommand("update", args, []string{"taskId"}, func(fs *flag.FlagSet) {
+		flags = fs
+		f.register(fs)
+	})
+	if err != nil {
+		return err
+	}
+	input, set, err := f.update(flags)
+	if err != nil {
+		return err
+	}
+	if set == 0 {
+		return errors.New("nothing to update: pass at least one task flag")
+	}
+	return printTaskResult(conn)(conn.client.UpdateTask(context.Background(), ids[0], input))
+}
+
+func runDelete(args []string) error {
+	conn, ids, err := parseCommand("delete", args, []string{"taskId"}, nil)
+	if err != nil {
+		return err
+	}
+	if err := conn.client.DeleteTask(context.Background(), ids[0]); err != nil {
+		return err
+	}
+	if conn.asJSON {
+		return printJSON(map[string]string{"taskId": ids[0], "message": "Task deleted successfully"})
+	}
+	fmt.Printf("Deleted %s\n", ids[0])
+	return nil
+}
+
+func runPause(args []string) error {
+	conn, ids, err := parseCommand("pause", args, []string{"taskId"}, nil)
+	if err != nil {
+		return err
+	}
+	return printTaskResult(conn)(conn.client.PauseTask(context.Background(), ids[0]))
+}
+
+func runResume(args []string) error {
+	conn, ids, err := parseCommand("resume", args, []string{"taskId"}, nil)
+	if err != nil {
+		return err
+	}
+	return printTaskResult(conn)(conn.client.ResumeTask(context.Background(), ids[0]))
+}
+
+func runRunNow(args []string) error {
+	conn, ids, err := parseCommand("run-now", args, []string{"taskId"}, nil)
+	if err != nil {
+		return err
+	}
+	return printTaskResult(conn)(conn.client.RunTaskNow(context.Background(), ids[0]))
+}
+
+// printTaskResult returns a function that prints the task an endpoint returned, so
+// commands can pass a client call's results straight to it.
+func printTaskResult(conn *connection) func(t *api.Task, err error) error {
+	return func(t *api.Task, err error) error {
+		if err != nil {
+			return err
+		}
+		if conn.asJSON {
+			return printJSON(t)
+		}
+		printTask(*t)
+		return nil
+	}
+}
+
+func runHistory(args []string) error {
+	var limit int
+	conn, ids, err := parseCommand("history", args, []string{"taskId"}, func(fs *flag.FlagSet) {
+		fs.IntVar(&limit, "limit", 20, "how many executions to show, newest first (at most 100)")
+	})
+	if err != nil {
+		return err
+	}
+	executions, err := conn.client.History(context.Background(), ids[0], limit)
+	if err != nil {
+		return err
+	}
+	if conn.asJSON {
+		return printJSON(api.History{TaskID: ids[0], Executions: executions})
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCHEDULED (UTC)\tSTATE\tOUTCOME\tDURATION\tRATE LIMITED\tINSTANCE\tERROR")
+	for _, e := range executions {
+		duration := "-"
+		if e.FinishedAt != 0 {
+			duration = (time.Duration(e.FinishedAt-e.StartedAt) * time.Second).String()
+		}
+		delayed := "-"
+		if e.RateLimitDelayMs > 0 {
+			delayed = fmt.Sprintf("%s by %s", time.Duration(e.RateLimitDelayMs)*time.Millisecond, e.RateLimitedBy)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", formatTime(time.Unix(e.ScheduledAt, 0)), e.State,
+			orDash(e.Outcome), duration, delayed, e.InstanceID, orDash(e.Error))
+	}
+	return tw.Flush()
+}
+
+// runTailLogs prints the server's recent log lines about the task, and with -f keeps
+// polling for new ones. Each server instance keeps its own log, so this shows the lines
+// of whichever instance answers.
+func runTailLogs(args []string) error {
+	var follow bool
+	var interval time.Duration
+	conn, ids, err := parseCommand("tail-logs", args, []string{"taskId"}, func(fs *flag.FlagSet) {
+		fs.BoolVar(&follow, "f", false, "keep printing new lines as they are logged")
+		fs.DurationVar(&interval, "interval", 2*time.Second, "how often to poll with -f")
+	})
+	if err != nil {
+		return err
+	}
+
+	cursor := int64(-1)
+	for {
+		result, err := conn.client.Logs(context.Background(), ids[0], cursor)
+		if err != nil {
+			return err
+		}
+		for _, line := range result.Lines {
+			fmt.Println(line)
+		}
+		if !follow {
+			return nil
+		}
+		cursor = result.Cursor
+		time.Sleep(interval)
+	}
+}
+
+func printTask(t api.Task) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	body, _ := json.Marshal(t.APIBody)
+	delivery := t.DeliveryGuarantee
+	if delivery == "" {
+		delivery = "atLeastOnce"
+	}
+	fmt.Fprintf(tw, "Task ID:\t%s\n", t.TaskID)
+	fmt.Fprintf(tw, "Name:\t%s\n", orDash(t.Name))
+	fmt.Fprintf(tw, "State:\t%s\n", taskState(t))
+	fmt.Fprintf(tw, "Call:\t%s %s\n", t.APIMethod, t.APIURL)
+	fmt.Fprintf(tw, "Body:\t%s\n", body)
+	fmt.Fprintf(tw, "Starts:\t%s\n", t.StartFrom)
+	fmt.Fprintf(tw, "Every:\t%s\n", time.Duration(t.Frequency)*time.Second)
+	fmt.Fprintf(tw, "Delivery:\t%s\n", delivery)
+	fmt.Fprintf(tw, "Runs:\t%d\n", t.TotalExecutions)
+	fmt.Fprintf(tw, "Last run (UTC):\t%s\n", formatTime(t.LastExecution))
+	fmt.Fprintf(tw, "Next run (UTC):\t%s\n", formatTime(t.NextExecution))
+	tw.Flush()
+}
+
+func taskState(t api.Task) string {
+	if t.Paused {
+		return "paused"
+	}
+	return "active"
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() || t.Year() < 2018 {
+		return "-" // createTaskStruct's placeholder for never
+	}
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"daria.com/jobScheduler/api"
+)
+
+func runDeadLetters(args []string) error {
+	var taskID string
+	var limit int
+	conn, _, err := parseCommand("dead-letters", args, nil, func(fs *flag.FlagSet) {
+		fs.StringVar(&taskID, "task", "", "only show this task's dead letters")
+		fs.IntVar(&limit, "limit", 20, "how many to show, newest first (at most 100)")
+	})
+	if err != nil {
+		return err
+	}
+	letters, err := conn.client.DeadLetters(context.Background(), taskID, limit)
+	if err != nil {
+		return err
+	}
+	if conn.asJSON {
+		return printJSON(api.DeadLetterList{DeadLetters: letters})
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEAD LETTER ID\tFAILED (UTC)\tATTEMPTS\tSTATUS\tSTATE\tREPLAYS\tERROR")
+	for _, letter := range letters {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%d\t%s\n", letter.DeadLetterID, formatTime(time.Unix(letter.FailedAt, 0)),
+			letter.Attempts, responseStatus(letter.Response), letter.State, letter.Replays, orDash(letter.LastError))
+	}
+	return tw.Flush()
+}
+
+// runReplay sends a dead letter's request again and prints how it went. It exits
+// non-zero if the replay failed.
+func runReplay(args []string) error {
+	var f taskFlags
+	conn, ids, err := parseCommand("replay", args, []string{"deadLetterId"}, func(fs *flag.FlagSet) {
+		fs.StringVar(&f.body, "body", "", "JSON body to send instead of the original, or @file to read it from a file")
+	})
+	if err != nil {
+		return err
+	}
+	body, err := f.apiBody()
+	if err != nil {
+		return err
+	}
+	letter, err := conn.client.ReplayDeadLetter(context.Background(), ids[0], body)
+	if err != nil {
+		return err
+	}
+	if conn.asJSON {
+		if err := printJSON(letter); err != nil {
+			return err
+		}
+	} else {
+		replay := letter.LastReplay
+		fmt.Printf("Replay %d of %s: %s (%s)\n", letter.Replays, letter.DeadLetterID, replay.Outcome, responseStatus(replay.Response))
+		if replay.Response != nil && replay.Response.Body != "" {
+			fmt.Println(replay.Response.Body)
+		}
+	}
+	if letter.LastReplay.Outcome != "success" {
+		return fmt.Errorf("replay failed: %s", orDash(letter.LastReplay.Error))
+	}
+	return nil
+}
+
+func responseStatus(response *api.ResponseSnapshot) string {
+	if response == nil {
+		return "no response"
+	}
+	return fmt.Sprint(response.StatusCode)
+}
@@ -0,0 +1,184 @@
+// Command jobctl manages scheduled tasks through the jobScheduler API.
+//
+//	jobctl list
+//	jobctl create -url https://example.com/hook -start "2024-01-01 09:00:00" -every 3600
+//	jobctl apply -f tasks.yaml -dry-run
+//
+// The server and API key come from the -server and -api-key flags, then the
+// JOBCTL_SERVER and JOBCTL_API_KEY environment variables, then the profile named by
+// -profile or JOBCTL_PROFILE (default "default") in the config file. The config file is
+// $JOBCTL_CONFIG, or jobctl/config.json under the user config directory:
+//
+//	{"profiles": {"default": {"server": "https://jobs.example.com", "apiKey": "..."}}}
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"daria.com/jobScheduler/client"
+)
+
+// commands maps each command to its implementation and a one-line description.
+var commands = []struct {
+	name        string
+	run         func(args []string) error
+	description string
+}{
+	{"create", runCreate, "create a task"},
+	{"list", runList, "list your tasks"},
+	{"get", runGet, "show one task"},
+	{"update", runUpdate, "change some of a task's fields"},
+	{"delete", runDelete, "delete a task"},
+	{"pause", runPause, "stop a task from running until it is resumed"},
+	{"resume", runResume, "let a paused task run again"},
+	{"run-now", runRunNow, "run a task right away"},
+	{"history", runHistory, "show a task's recent executions"},
+	{"tail-logs", runTailLogs, "print the server's log lines about a task"},
+	{"dead-letters", runDeadLetters, "list your runs that failed on every attempt"},
+	{"replay", runReplay, "send a dead letter's request again"},
+	{"notifications", runNotifications, "list your notification rules"},
+	{"notify", runNotify, "add a rule that notifies a webhook or email addresses about task runs"},
+	{"notify-test", runNotifyTest, "send a sample notification through a rule"},
+	{"notify-delete", runNotifyDelete, "delete a notification rule"},
+	{"apply", runApply, "converge your named tasks on a manifest file"},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	if name := os.Args[1]; name == "help" || name == "-h" || name == "--help" {
+		usage()
+		return
+	}
+
+	for _, command := range commands {
+		if command.name != os.Args[1] {
+			continue
+		}
+		if err := command.run(os.Args[2:]); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				os.Exit(2)
+			}
+			fmt.Fprintln(os.Stderr, "jobctl:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "jobctl: unknown command %q\n", os.Args[1])
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	var b strings.Builder
+	b.WriteString("Usage: jobctl <command> [flags] [args]\n\nCommands:\n")
+	for _, command := range commands {
+		fmt.Fprintf(&b, "  %-13s %s\n", command.name, command.description)
+	}
+	b.WriteString("\nRun \"jobctl <command> -h\" for the command's flags.")
+	fmt.Fprintln(os.Stderr, b.String())
+}
+
+// connection holds the flags every command takes to reach the API.
+type connection struct {
+	server  string
+	apiKey  string
+	profile string
+	asJSON  bool
+	client  *client.Client
+}
+
+func (conn *connection) register(flags *flag.FlagSet) {
+	flags.StringVar(&conn.server, "server", "", "base URL of the jobScheduler API (default from env or profile, else http://localhost:8080)")
+	flags.StringVar(&conn.apiKey, "api-key", "", "API key sent as X-API-KEY (default from env or profile)")
+	flags.StringVar(&conn.profile, "profile", "", "profile in the config file (default $JOBCTL_PROFILE or \"default\")")
+	flags.BoolVar(&conn.asJSON, "json", false, "print the server's response as JSON")
+}
+
+// profile is an entry of the config file.
+type profile struct {
+	Server string `json:"server"`
+	APIKey string `json:"apiKey"`
+}
+
+// resolve fills in whatever the flags left unset from the environment and the profile.
+func (conn *connection) resolve() error {
+	if conn.server == "" {
+		conn.server = os.Getenv("JOBCTL_SERVER")
+	}
+	if conn.apiKey == "" {
+		conn.apiKey = os.Getenv("JOBCTL_API_KEY")
+	}
+	if conn.server == "" || conn.apiKey == "" {
+		name := conn.profile
+		if name == "" {
+			name = envOrDefault("JOBCTL_PROFILE", "default")
+		}
+		selected, err := loadProfile(name, conn.profile != "")
+		if err != nil {
+			return err
+		}
+		if conn.server == "" {
+			conn.server = selected.Server
+		}
+		if conn.apiKey == "" {
+			conn.apiKey = selected.APIKey
+		}
+	}
+
+	if conn.server == "" {
+		conn.server = "http://localhost:8080"
+	}
+	conn.server = strings.TrimRight(conn.server, "/")
+	if conn.apiKey == "" {
+		return errors.New("no API key: set JOBCTL_API_KEY, pass -api-key or add it to a profile")
+	}
+	return nil
+}
+
+// loadProfile reads the named profile. A missing config file or profile is only an error
+// if the profile was asked for explicitly.
+func loadProfile(name string, required bool) (profile, error) {
+	path := os.Getenv("JOBCTL_CONFIG")
+	if path == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return profile{}, nil
+		}
+		path = filepath.Join(dir, "jobctl", "config.json")
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		return profile{}, nil
+	}
+	if err != nil {
+		return profile{}, err
+	}
+	var file struct {
+		Profiles map[string]profile `json:"profiles"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return profile{}, fmt.Errorf("reading %s: %w", path, err)
+	}
+	selected, ok := file.Profiles[name]
+	if !ok && required {
+		return profile{}, fmt.Errorf("no profile %q in %s", name, path)
+	}
+	return selected, nil
+}
+
+func envOrDefault(name string, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"daria.com/jobScheduler/api"
+)
+
+func runNotifications(args []string) error {
+	var taskID string
+	conn, _, err := parseCommand("notifications", args, nil, func(fs *flag.FlagSet) {
+		fs.StringVar(&taskID, "task", "", "only show the rules watching this task")
+	})
+	if err != nil {
+		return err
+	}
+	rules, err := conn.client.NotificationRules(context.Background(), taskID)
+	if err != nil {
+		return err
+	}
+	if conn.asJSON {
+		return printJSON(api.NotificationRuleList{Rules: rules})
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RULE ID\tTASK\tEVENTS\tCHANNEL\tTO\tLAST SENT (UTC)\tLAST ERROR")
+	for _, rule := range rules {
+		to := rule.WebhookURL
+		if rule.Channel == "email" {
+			to = strings.Join(rule.EmailTo, ",")
+		}
+		lastSent, lastError := "-", "-"
+		if rule.LastDelivery != nil {
+			lastSent, lastError = formatTime(rule.LastDelivery.At), orDash(rule.LastDelivery.Error)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", rule.RuleID, orDash(rule.TaskID), ruleEvents(rule), rule.Channel, to, lastSent, lastError)
+	}
+	return tw.Flush()
+}
+
+// runNotify adds a notification rule and prints its ID.
+func runNotify(args []string) error {
+	var taskID, events, webhook, email, subject, body string
+	var after int
+	var dedup time.Duration
+	var flags *flag.FlagSet
+	conn, _, err := parseCommand("notify", args, nil, func(fs *flag.FlagSet) {
+		flags = fs
+		fs.StringVar(&taskID, "task", "", "task to watch (default all your tasks)")
+		fs.StringVar(&events, "on", "failure", "comma-separated events: failure, consecutiveFailures, recovery, completion")
+		fs.IntVar(&after, "after", 0, "failed runs in a row that fire consecutiveFailures")
+		fs.StringVar(&webhook, "webhook", "", "URL to post notifications to")
+		fs.StringVar(&email, "email", "", "comma-separated addresses to email notifications to")
+		fs.StringVar(&subject, "subject", "", "subject template, or @file to read it from a file")
+		fs.StringVar(&body, "body", "", "body template, or @file to read it from a file")
+		fs.DurationVar(&dedup, "dedup", time.Hour, "send the same event for the same task at most once in this window; 0 sends every one")
+	})
+	if err != nil {
+		return err
+	}
+
+	input := api.NotificationRuleInput{TaskID: taskID, Events: strings.Split(events, ","), ConsecutiveFailures: after}
+	switch {
+	case webhook != "" && email != "":
+		return errors.New("pass -webhook or -email, not both")
+	case webhook != "":
+		input.Channel, input.WebhookURL = "webhook", webhook
+	case email != "":
+		input.Channel, input.EmailTo = "email", strings.Split(email, ",")
+	default:
+		return errors.New("pass -webhook or -email")
+	}
+	if after != 0 && !strings.Contains(events, "consecutiveFailures") {
+		input.Events = append(input.Events, "consecutiveFailures")
+	}
+	if input.SubjectTemplate, err = readTemplate(subject); err != nil {
+		return err
+	}
+	if input.BodyTemplate, err = readTemplate(body); err != nil {
+		return err
+	}
+	flags.Visit(func(fl *flag.Flag) {
+		if fl.Name == "dedup" {
+			seconds := int(dedup / time.Second)
+			input.DedupSeconds = &seconds
+		}
+	})
+
+	rule, err := conn.client.CreateNotificationRule(context.Background(), input)
+	if err != nil {
+		return err
+	}
+	if conn.asJSON {
+		return printJSON(rule)
+	}
+	fmt.Println(rule.RuleID)
+	return nil
+}
+
+// runNotifyTest sends a sample notification through a rule. It exits non-zero if it was
+// not delivered.
+func runNotifyTest(args []string) error {
+	conn, ids, err := parseCommand("notify-test", args, []string{"ruleId"}, nil)
+	if err != nil {
+		return err
+	}
+	delivery, err := conn.client.TestNotificationRule(context.Background(), ids[0])
+	if err != nil {
+		return err
+	}
+	if conn.asJSON {
+		if err := printJSON(delivery); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("Subject: %s\n\n%s", delivery.Subject, delivery.Message)
+	}
+	if delivery.Error != "" {
+		return fmt.Errorf("not delivered: %s", delivery.Error)
+	}
+	return nil
+}
+
+func runNotifyDelete(args []string) error {
+	conn, ids, err := parseCommand("notify-delete", args, []string{"ruleId"}, nil)
+	if err != nil {
+		return err
+	}
+	if err := conn.client.DeleteNotificationRule(context.Background(), ids[0]); err != nil {
+		return err
+	}
+	if conn.asJSON {
+		return printJSON(map[string]string{"ruleId": ids[0], "message": "Notification rule deleted successfully"})
+	}
+	fmt.Printf("Deleted %s\n", ids[0])
+	return nil
+}
+
+func ruleEvents(rule api.NotificationRule) string {
+	events := make([]string, len(rule.Events))
+	for i, event := range rule.Events {
+		events[i] = event
+		if event == "consecutiveFailures" {
+			events[i] = fmt.Sprintf("%s(%d)", event, rule.ConsecutiveFailures)
+		}
+	}
+	return strings.Join(events, ",")
+}
+
+// readTemplate returns a template flag's value, reading it from a file if it starts with @.
+func readTemplate(value string) (string, error) {
+	if !strings.HasPrefix(value, "@") {
+		return value, nil
+	}
+	data, err := os.ReadFile(value[1:])
+	return string(data), err
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/mail"
+	"os"
+	"strconv"
+	"time"
+
+	"daria.com/jobScheduler/api"
+	"daria.com/jobScheduler/scheduler"
+)
+
+// Scheduling modes. In single mode this process owns every task; the other modes let
+// several replicas share the same daria_tasks table.
+const (
+	modeSingle = "single"
+	modeClaim  = "claim"  // every replica queues every task and claims each due run with a lease
+	modeLeader = "leader" // only the elected leader runs the scheduler; every replica serves the API
+	modeShard  = "shard"  // runs are split across the live replicas by consistent hashing on taskId; every replica still scans every task
+)
+
+// serviceConfig is read from the environment once at startup.
+type serviceConfig struct {
+	Mode       string
+	InstanceID string
+	// LeaseDuration is how long a claimed run stays owned by its instance. It must be
+	// longer than any execution, or another replica may run the task again.
+	LeaseDuration time.Duration
+	// ResyncInterval is how often every task is reloaded from daria_tasks, so tasks
+	// created or taken over by other replicas get queued here too.
+	ResyncInterval time.Duration
+	// LeaderTTL is how long the leader lease lasts without a heartbeat, and so bounds how
+	// long the replicas go without a leader after the leader dies. In shard mode the same
+	// TTL and heartbeat apply to each node's membership row.
+	LeaderTTL         time.Duration
+	HeartbeatInterval time.Duration
+	// ShardVirtualNodes is how many points each node gets on the hash ring
+	ShardVirtualNodes int
+	// AdminKey guards the /admin routes; they are disabled when it is empty
+	AdminKey string
+	// Queue is the scheduler's queue implementation: "heap", or "wheel" for a timing
+	// wheel that stays cheaper at hundreds of thousands of tasks (see BenchmarkQueue in
+	// the scheduler package)
+	Queue string
+	// IdempotencyHeader is the request header that carries each run's execution ID to the
+	// task's API, so the target can drop a run delivered twice
+	IdempotencyHeader string
+	// IdempotencyRetention is how long an Idempotency-Key sent to POST /tasks is remembered
+	IdempotencyRetention time.Duration
+	// AllowPrivateTargets lets tasks call private, loopback and metadata addresses without
+	// an allowlist entry. Only for development.
+	AllowPrivateTargets bool
+	// UserRateLimit and HostRateLimit are the token buckets every user's runs, and the runs
+	// calling each host, share unless an admin overrides them. Each instance keeps its own
+	// buckets.
+	UserRateLimit api.RateLimit
+	HostRateLimit api.RateLimit
+	// BreakerFailures failed calls in a row to a host open its circuit breaker for
+	// BreakerOpenDuration, after which BreakerProbes trial calls decide whether it closes
+	BreakerFailures     int
+	BreakerOpenDuration time.Duration
+	BreakerProbes       int
+	// MaxAttempts is how many calls a run of an at-least-once task makes before it fails
+	// and is dead-lettered. At-most-once runs make a single call.
+	MaxAttempts int
+	// SMTPAddr is the host:port notification emails are sent through, or "capture" to keep
+	// them in memory for tests, where GET /admin/outbox shows them. Email rules are refused
+	// while it is empty.
+	SMTPAddr     string
+	SMTPUsername string
+	SMTPPassword string
+	SMTPFrom     string
+}
+
+var config serviceConfig // Global variable to hold the service configuration
+
+func loadConfig() (serviceConfig, error) {
+	hostname, _ := os.Hostname()
+	cfg := serviceConfig{
+		Mode:                 envOrDefault("JOBSCHEDULER_MODE", modeSingle),
+		InstanceID:           envOrDefault("JOBSCHEDULER_INSTANCE_ID", fmt.Sprintf("%s-%d", hostname, os.Getpid())),
+		LeaseDuration:        5 * time.Minute,
+		ResyncInterval:       time.Minute,
+		LeaderTTL:            30 * time.Second,
+		HeartbeatInterval:    10 * time.Second,
+		ShardVirtualNodes:    64,
+		AdminKey:             os.Getenv("JOBSCHEDULER_ADMIN_KEY"),
+		Queue:                envOrDefault("JOBSCHEDULER_QUEUE", scheduler.QueueHeap),
+		IdempotencyHeader:    envOrDefault("JOBSCHEDULER_IDEMPOTENCY_HEADER", "Idempotency-Key"),
+		IdempotencyRetention: 24 * time.Hour,
+		UserRateLimit:        api.RateLimit{RatePerSecond: 0, Burst: 1},
+		HostRateLimit:        api.RateLimit{RatePerSecond: 10, Burst: 20},
+		BreakerFailures:      5,
+		BreakerOpenDuration:  time.Minute,
+		BreakerProbes:        1,
+		MaxAttempts:          3,
+		SMTPAddr:             os.Getenv("JOBSCHEDULER_SMTP_ADDR"),
+		SMTPUsername:         os.Getenv("JOBSCHEDULER_SMTP_USERNAME"),
+		SMTPPassword:         os.Getenv("JOBSCHEDULER_SMTP_PASSWORD"),
+		SMTPFrom:             envOrDefault("JOBSCHEDULER_SMTP_FROM", "jobscheduler@localhost"),
+	}
+
+	var err error
+	if cfg.LeaseDuration, err = envDuration("JOBSCHEDULER_LEASE_DURATION", cfg.LeaseDuration); err != nil {
+		return cfg, err
+	}
+	if cfg.ResyncInterval, err = envDuration("JOBSCHEDULER_RESYNC_INTERVAL", cfg.ResyncInterval); err != nil {
+		return cfg, err
+	}
+	if cfg.LeaderTTL, err = envDuration("JOBSCHEDULER_LEADER_TTL", cfg.LeaderTTL); err != nil {
+		return cfg, err
+	}
+	if cfg.HeartbeatInterval, err = envDuration("JOBSCHEDULER_HEARTBEAT_INTERVAL", cfg.HeartbeatInterval); err != nil {
+		return cfg, err
+	}
+	if cfg.IdempotencyRetention, err = envDuration("JOBSCHEDULER_IDEMPOTENCY_RETENTION", cfg.IdempotencyRetention); err != nil {
+		return cfg, err
+	}
+	if cfg.BreakerOpenDuration, err = envDuration("JOBSCHEDULER_BREAKER_OPEN_DURATION", cfg.BreakerOpenDuration); err != nil {
+		return cfg, err
+	}
+
+	if value := os.Getenv("JOBSCHEDULER_ALLOW_PRIVATE_TARGETS"); value != "" {
+		if cfg.AllowPrivateTargets, err = strconv.ParseBool(value); err != nil {
+			return cfg, errors.New("JOBSCHEDULER_ALLOW_PRIVATE_TARGETS must be true or false")
+		}
+	}
+	if cfg.UserRateLimit, err = envRateLimit("JOBSCHEDULER_USER", cfg.UserRateLimit); err != nil {
+		return cfg, err
+	}
+	if cfg.HostRateLimit, err = envRateLimit("JOBSCHEDULER_HOST", cfg.HostRateLimit); err != nil {
+		return cfg, err
+	}
+	if value := os.Getenv("JOBSCHEDULER_BREAKER_FAILURES"); value != "" {
+		if cfg.BreakerFailures, err = strconv.Atoi(value); err != nil || cfg.BreakerFailures < 1 {
+			return cfg, errors.New("JOBSCHEDULER_BREAKER_FAILURES must be a positive integer")
+		}
+	}
+	if value := os.Getenv("JOBSCHEDULER_BREAKER_PROBES"); value != "" {
+		if cfg.BreakerProbes, err = strconv.Atoi(value); err != nil || cfg.BreakerProbes < 1 {
+			return cfg, errors.New("JOBSCHEDULER_BREAKER_PROBES must be a positive integer")
+		}
+	}
+	if value := os.Getenv("JOBSCHEDULER_MAX_ATTEMPTS"); value != "" {
+		if cfg.MaxAttempts, err = strconv.Atoi(value); err != nil || cfg.MaxAttempts < 1 {
+			return cfg, errors.New("JOBSCHEDULER_MAX_ATTEMPTS must be a positive integer")
+		}
+	}
+	if value := os.Getenv("JOBSCHEDULER_SHARD_VIRTUAL_NODES"); value != "" {
+		if cfg.ShardVirtualNodes, err = strconv.Atoi(value); err != nil || cfg.ShardVirtualNodes < 1 {
+			return cfg, errors.New("JOBSCHEDULER_SHARD_VIRTUAL_NODES must be a positive integer")
+		}
+	}
+
+	switch cfg.Mode {
+	case modeSingle, modeClaim, modeLeader, modeShard:
+	default:
+		return cfg, fmt.Errorf("unknown JOBSCHEDULER_MODE %q", cfg.Mode)
+	}
+	if _, ok := scheduler.NewQueue(cfg.Queue, 0); !ok {
+		return cfg, fmt.Errorf("unknown JOBSCHEDULER_QUEUE %q", cfg.Queue)
+	}
+	if cfg.LeaseDuration <= requestTimeout {
+		return cfg, fmt.Errorf("JOBSCHEDULER_LEASE_DURATION must be longer than the %s request timeout", requestTimeout)
+	}
+	if cfg.IdempotencyRetention < idempotencyLockTimeout {
+		return cfg, fmt.Errorf("JOBSCHEDULER_IDEMPOTENCY_RETENTION must be at least %s", idempotencyLockTimeout)
+	}
+	if cfg.SMTPAddr != "" && cfg.SMTPAddr != smtpCapture {
+		if _, _, err := net.SplitHostPort(cfg.SMTPAddr); err != nil {
+			return cfg, fmt.Errorf("JOBSCHEDULER_SMTP_ADDR must be host:port or %q", smtpCapture)
+		}
+	}
+	if _, err := mail.ParseAddress(cfg.SMTPFrom); err != nil {
+		return cfg, errors.New("JOBSCHEDULER_SMTP_FROM must be an email address")
+	}
+	if cfg.BreakerOpenDuration <= 0 {
+		return cfg, errors.New("JOBSCHEDULER_BREAKER_OPEN_DURATION must be positive")
+	}
+	if cfg.HeartbeatInterval <= 0 || cfg.HeartbeatInterval >= cfg.LeaderTTL {
+		return cfg, errors.New("JOBSCHEDULER_HEARTBEAT_INTERVAL must be positive and shorter than JOBSCHEDULER_LEADER_TTL")
+	}
+	return cfg, nil
+}
+
+func envOrDefault(name string, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func envDuration(name string, defaultValue time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	return d, nil
+}
+
+// envRateLimit reads <prefix>_RATE, runs per second with 0 for unlimited, and <prefix>_BURST.
+// Setting only the rate makes the burst one second's worth of runs.
+func envRateLimit(prefix string, defaultValue api.RateLimit) (api.RateLimit, error) {
+	limit := defaultValue
+	if value := os.Getenv(prefix + "_RATE"); value != "" {
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 {
+			return limit, fmt.Errorf("%s_RATE must be a non-negative number", prefix)
+		}
+		limit.RatePerSecond = rate
+		limit.Burst = max(1, int(math.Ceil(rate)))
+	}
+	if value := os.Getenv(prefix + "_BURST"); value != "" {
+		burst, err := strconv.Atoi(value)
+		if err != nil || burst < 1 {
+			return limit, fmt.Errorf("%s_BURST must be a positive integer", prefix)
+		}
+		limit.Burst = burst
+	}
+	return limit, nil
+}
@@ -1,4 +1,27 @@
 package main
 
+import "time"
+
 // const dataFile = "data.json"
 const waitTime = 60
+
+// Tasks stop being rescheduled after this many executions
+const maxExecutions = 30
+
+// How long a shutdown waits for in-flight API requests and job executions
+const shutdownTimeout = 30 * time.Second
+
+// Upper bound on a single call to a task's API
+const requestTimeout = 2 * time.Minute
+
+// Most tasks a single batch or import request may create
+const maxBatchTasks = 500
+
+// Longest a run waits in place for a rate limit; a longer wait puts it back in the queue
+const rateLimitMaxWait = 10 * time.Second
+
+// Wait before retrying a failed call to a task's API, doubled for each further attempt
+const retryBackoff = 2 * time.Second
+
+// How much of a response body a dead letter keeps
+const maxSnapshotBody = 16 << 10
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"time"
 
+	"daria.com/jobScheduler/api"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
 func createTask(c *gin.Context) {
@@ -16,34 +19,78 @@ func createTask(c *gin.Context) {
 	defer func() {
 		endLog(callerMethod, startTime)
 	}()
-	validationStatus, jobCount := validateUserCounts(c)
-	log(callerMethod, fmt.Sprintf("Validation status: %v", validationStatus))
-
 	// Parse and validate request body
 	input, err := parseRequestBody(c)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondInvalid(c, err)
 		return
 	}
 
-	// Generate Task ID
-	taskID, err := generateTaskID(c, jobCount)
+	timeUTC, err := time.Parse("2006-01-02 15:04:05", input.StartFrom)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate task ID"})
+		respondInvalid(c, fieldErrors{{Field: "startFrom", Code: "format", Message: "startFrom must be a UTC time in the format 2000-12-02 01:01:01"}})
 		return
 	}
 
-	timeUTC, err := time.Parse("2006-01-02 15:04:05", input.StartFrom)
+	userId := c.GetString("userId")
+	log(callerMethod, userId)
+	if err := checkTargetURL(c.Request.Context(), userId, input.APIURL); err != nil {
+		respondTargetError(c, "apiURL", err)
+		return
+	}
+	if input.Name != "" {
+		names, err := taskNames(userId)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, codeInternal, "Failed to read tasks")
+			return
+		}
+		if names[input.Name] {
+			respondError(c, http.StatusConflict, codeNameTaken, nameTakenError{input.Name}.Error())
+			return
+		}
+	}
+
+	taskID, err := insertTask(userId, input, timeUTC, 0)
+	if errors.Is(err, errJobLimitReached) {
+		respondQuotaRace(c, 1)
+		return
+	}
+	if errors.Is(err, errJobSlot) {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to update job count")
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Time is in UTC and needs to be in the format: 2000-12-02 01:01:01"})
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to insert into db")
 		return
 	}
 
-	userId := c.GetString("userId")
-	log(callerMethod, userId)
+	c.JSON(http.StatusOK, api.CreateTaskResult{TaskID: taskID})
+}
+
+// insertTask reserves a job slot for the user, stores the task and queues its first run.
+// totalExecutions is the run count of an imported task; one that has used up its runs is
+// stored finished and not queued. It fails with errJobLimitReached if the user has no
+// slot left, or errJobSlot if the slot could not be reserved.
+func insertTask(userId string, input CreateTaskInput, firstRun time.Time, totalExecutions int) (string, error) {
+	callerMethod := "insertTask"
+
+	// Reserve a slot against the user's job limit before writing anything
+	jobCount, err := reserveJobSlot(userId)
+	if errors.Is(err, errJobLimitReached) {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", errJobSlot, err.Error())
+	}
+	log(callerMethod, fmt.Sprintf("jobCount after reservation: %d", jobCount))
+
+	// Generate Task ID
+	taskID := generateTaskID(userId)
 	log(callerMethod, taskID)
 	// Create Task struct
 	task := createTaskStruct(input, taskID, userId)
+	task.NextExecution = firstRun
+	task.TotalExecutions = totalExecutions
 
 	// Append task to file
 	// appendTaskToFile(task)
@@ -51,43 +98,63 @@ func createTask(c *gin.Context) {
 
 	if err != nil {
 		log(callerMethod, err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to insert into db"})
-		return
+		// Give the slot back since the task was never created
+		releaseJobSlot(userId)
+		return "", err
+	}
+
+	// Queue the first run; in shard mode the owning node picks it up on its next resync
+	if ownsTask(taskID) && task.TotalExecutions < maxExecutions {
+		sched.Schedule(taskID, firstRun)
 	}
+	return taskID, nil
+}
 
-	updatetJobCount(c, jobCount+1)
+// nameTakenError fails a create whose name another of the user's tasks already has. Names
+// identify tasks in manifests, so they must stay unique per user.
+type nameTakenError struct {
+	name string
+}
 
-	// Create Job and add to heap
-	job := Job{taskID, timeUTC.Unix()}
-	go addToHeap(job)
+func (e nameTakenError) Error() string {
+	return fmt.Sprintf("Another task is already named %q", e.name)
+}
 
-	c.JSON(http.StatusOK, gin.H{"taskId": taskID})
+// taskNames returns the names of the user's tasks.
+func taskNames(userID string) (map[string]bool, error) {
+	tasks, err := listUserTasks(userID)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(tasks))
+	for _, task := range tasks {
+		if task.Name != "" {
+			names[task.Name] = true
+		}
+	}
+	return names, nil
 }
 
+// parseRequestBody validates the body against the CreateTaskInput schema before decoding it.
 func parseRequestBody(c *gin.Context) (CreateTaskInput, error) {
 	var input CreateTaskInput
-	if err := c.ShouldBindJSON(&input); err != nil {
-		return CreateTaskInput{}, err
+	body, err := c.GetRawData()
+	if err != nil {
+		return input, errors.New("Failed to read request body")
+	}
+	if err := validateRequest("CreateTaskInput", body); err != nil {
+		return input, err
 	}
-	if input.APIMethod == "" || input.APIURL == "" || input.StartFrom == "" {
-		return CreateTaskInput{}, errors.New("apiMethod, apiURL, startFrom are required fields")
+	if err := json.Unmarshal(body, &input); err != nil {
+		return input, err
 	}
 	return input, nil
 }
 
-func generateTaskID(c *gin.Context, jobCount int64) (string, error) {
-	callerMethod := "generateTaskID"
-	// Fetch userID and jobCount from the context
-	userID := c.GetString("userId")
-
-	jobCount += 1
-	log(callerMethod, fmt.Sprintf("Updated count %d", jobCount))
-
-	// Construct the task ID
-	taskID := fmt.Sprintf("%s_%d", userID, jobCount)
-	log(callerMethod, taskID)
-
-	return taskID, nil
+// generateTaskID builds a globally unique task ID. The user prefix is kept so
+// IDs stay readable in logs, but uniqueness comes from the UUID alone.
+func generateTaskID(userID string) string {
+	return fmt.Sprintf("%s_%s", userID, uuid.NewString())
 }
 
 func createTaskStruct(input CreateTaskInput, taskID string, userId string) Task {
@@ -106,6 +173,8 @@ func createTaskStruct(input CreateTaskInput, taskID string, userId string) Task
 		UserID:              userId,
 		APIBody:             input.APIBody,
 		NextExecution:       timeUTC,
+		DeliveryGuarantee:   input.DeliveryGuarantee,
+		Name:                input.Name,
 	}
 }
 
@@ -1,14 +1,16 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
+	"daria.com/jobScheduler/scheduler"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
@@ -17,6 +19,13 @@ import (
 
 var db *DynamoDBClient // Global variable to hold the DynamoDB client
 
+var (
+	errJobLimitReached = errors.New("job limit reached")
+	errTaskNotFound    = errors.New("task not found")
+	errUserNotFound    = errors.New("user not found")
+	errJobSlot         = errors.New("failed to reserve job slot")
+)
+
 // DynamoDBClient holds the DynamoDB client
 type DynamoDBClient struct {
 	svc *dynamodb.DynamoDB
@@ -124,15 +133,13 @@ func apiKeyAuthMiddleware(c *gin.Context) {
 	apiKey := c.GetHeader("X-API-KEY")
 
 	if apiKey == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "API key required"})
-		c.Abort()
+		respondError(c, http.StatusUnauthorized, codeAPIKeyRequired, "API key required")
 		return
 	}
 
 	userID, err := db.ValidateAPIKey(apiKey)
 	if err != nil || userID == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
-		c.Abort()
+		respondError(c, http.StatusUnauthorized, codeInvalidAPIKey, "Invalid API key")
 		return
 	}
 
@@ -144,39 +151,6 @@ func apiKeyAuthMiddleware(c *gin.Context) {
 	c.Next() // Pass control to the next middleware/handler
 }
 
-func validateUserCounts(c *gin.Context) (bool, int64) {
-	// Retrieve the userID from the context
-	userID := c.GetString("userId")
-
-	startTime := time.Now()
-	callerMethod := "validateUser"
-	log(callerMethod, "Start")
-	defer func() {
-		endLog(callerMethod, startTime)
-	}()
-
-	// Query the daria_users table to retrieve jobLimit and jobCount for the userID
-	jobLimit, jobCount, err := getUserJobLimits(userID)
-	if err != nil {
-		log(callerMethod, fmt.Sprintf("Error: %s", err.Error()))
-		return false, jobCount
-	}
-
-	log(callerMethod, fmt.Sprintf("UserID: %s, JobLimit: %d, JobCount: %d", userID, jobLimit, jobCount))
-	c.Set("jobCount", jobCount)
-	// Compare jobCount with jobLimit
-	if jobCount >= jobLimit {
-		// Return an error message if jobCount exceeds jobLimit
-		errorMessage := fmt.Sprintf("Maximum job limit (%d) has been reached", jobLimit)
-		c.JSON(http.StatusBadRequest, gin.H{"error": errorMessage})
-		return false, jobCount
-	}
-
-	// User is valid
-
-	return true, jobCount
-}
-
 func getUserJobLimits(userID string) (int64, int64, error) {
 	startTime := time.Now()
 	callerMethod := "getUserJobLimits"
@@ -210,12 +184,16 @@ func getUserJobLimits(userID string) (int64, int64, error) {
 
 	// Check if the item exists
 	if len(result.Item) == 0 {
-		return 0, 0, fmt.Errorf("user not found")
+		return 0, 0, errUserNotFound
 	}
 
 	// Retrieve jobLimit and jobCount from the result
 	jobLimitStr := aws.StringValue(result.Item["jobLimit"].N)
-	jobCountStr := aws.StringValue(result.Item["jobCount"].N)
+	// jobCount is created by the first reservation, so a new user may not have it yet
+	jobCountStr := "0"
+	if jobCountAttr, ok := result.Item["jobCount"]; ok {
+		jobCountStr = aws.StringValue(jobCountAttr.N)
+	}
 
 	// Convert strings to integers
 	jobLimit, err := strconv.ParseInt(jobLimitStr, 10, 64)
@@ -246,9 +224,11 @@ func appendTaskToDynamoDB(task Task) error {
 	}
 	av["UserID"] = &dynamodb.AttributeValue{S: aws.String(task.UserID)}
 
+	// Never overwrite an existing task, even if two task IDs were to collide
 	input := &dynamodb.PutItemInput{
-		Item:      av,
-		TableName: aws.String("daria_tasks"),
+		Item:                av,
+		TableName:           aws.String("daria_tasks"),
+		ConditionExpression: aws.String("attribute_not_exists(taskId)"),
 	}
 
 	// Put the item into DynamoDB
@@ -260,17 +240,16 @@ func appendTaskToDynamoDB(task Task) error {
 	return nil
 }
 
-func updatetJobCount(c *gin.Context, jobCount int64) error {
-	callerMethod := "updatetJobCount"
+// reserveJobSlot atomically increments the user's jobCount, failing with
+// errJobLimitReached if the increment would take it past jobLimit.
+func reserveJobSlot(userId string) (int64, error) {
+	callerMethod := "reserveJobSlot"
 	startTime := time.Now()
 	defer func() {
 		endLog(callerMethod, startTime)
 	}()
 	log(callerMethod, "Start")
 
-	userId := c.GetString("userId")
-	// jobCount := c.GetInt("jobCount")
-
 	input := &dynamodb.UpdateItemInput{
 		TableName: aws.String("daria_users"), // Specify your DynamoDB user table name
 		Key: map[string]*dynamodb.AttributeValue{
@@ -278,39 +257,90 @@ func updatetJobCount(c *gin.Context, jobCount int64) error {
 				S: aws.String(userId),
 			},
 		},
-		UpdateExpression: aws.String("SET jobCount = :c"), // Update the jobCount attribute
+		// ADD treats a missing jobCount as 0, so the condition has to allow for it as well
+		UpdateExpression:    aws.String("ADD jobCount :one"),
+		ConditionExpression: aws.String("attribute_exists(userId) AND (attribute_not_exists(jobCount) OR jobCount < jobLimit)"),
 		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-			":c": {
-				N: aws.String(strconv.FormatInt(jobCount, 10)), // Convert jobCount to string
+			":one": {
+				N: aws.String("1"),
 			},
 		},
 		ReturnValues: aws.String("UPDATED_NEW"), // Return the updated attributes
 	}
 	result, err := db.svc.UpdateItem(input)
 	if err != nil {
+		if isConditionalCheckFailed(err) {
+			log(callerMethod, fmt.Sprintf("Job limit reached for user %s", userId))
+			return 0, errJobLimitReached
+		}
 		log(callerMethod, err.Error())
-		return err
+		return 0, err
 	}
 
-	// Log the updated job count
-	log(callerMethod, fmt.Sprintf("Updated job count for user %s to %d", userId, jobCount))
-
-	// Optional: Print the updated item
-	updatedItem := map[string]interface{}{}
-	err = dynamodbattribute.UnmarshalMap(result.Attributes, &updatedItem)
+	jobCount, err := strconv.ParseInt(aws.StringValue(result.Attributes["jobCount"].N), 10, 64)
 	if err != nil {
-		log(callerMethod, fmt.Sprintf("Error unmarshalling updated attributes: %s", err.Error()))
+		return 0, err
+	}
 
-	} else {
-		log(callerMethod, fmt.Sprintf("Updated attributes: %+v", updatedItem))
+	log(callerMethod, fmt.Sprintf("Reserved job slot for user %s, jobCount is now %d", userId, jobCount))
+	return jobCount, nil
+}
 
+// releaseJobSlot atomically decrements the user's jobCount, never taking it below zero.
+func releaseJobSlot(userId string) error {
+	callerMethod := "releaseJobSlot"
+	startTime := time.Now()
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+	log(callerMethod, "Start")
+
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String("daria_users"), // Specify your DynamoDB user table name
+		Key: map[string]*dynamodb.AttributeValue{
+			"userId": {
+				S: aws.String(userId),
+			},
+		},
+		UpdateExpression:    aws.String("ADD jobCount :minusOne"),
+		ConditionExpression: aws.String("jobCount > :zero"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":minusOne": {
+				N: aws.String("-1"),
+			},
+			":zero": {
+				N: aws.String("0"),
+			},
+		},
+	}
+	_, err := db.svc.UpdateItem(input)
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			log(callerMethod, fmt.Sprintf("jobCount for user %s is already 0", userId))
+			return nil
+		}
+		log(callerMethod, err.Error())
+		return err
 	}
 
+	log(callerMethod, fmt.Sprintf("Released job slot for user %s", userId))
 	return nil
 }
 
-// loadExistingJobs loads existing jobs from the DynamoDB table and adds them to the application
-func loadExistingJobs() error {
+func isConditionalCheckFailed(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+// dynamoJobStore loads the scheduler's jobs from daria_tasks.
+type dynamoJobStore struct{}
+
+func (dynamoJobStore) LoadJobs(ctx context.Context) ([]scheduler.Job, error) {
+	return loadExistingJobs()
+}
+
+// loadExistingJobs loads existing jobs from the DynamoDB table so they can be queued
+func loadExistingJobs() ([]scheduler.Job, error) {
 	startTime := time.Now()
 	callerMethod := "loadExistingJobs"
 	log(callerMethod, "Start")
@@ -323,56 +353,65 @@ func loadExistingJobs() error {
 		TableName: aws.String("daria_tasks"), // Specify your DynamoDB jobs table name
 	}
 
-	// Perform the Scan operation
-	result, err := db.svc.Scan(input)
+	// Perform the Scan operation, page by page since a single Scan stops at 1MB
+	jobs := make([]scheduler.Job, 0)
+	err := db.svc.ScanPages(input, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		// Parse the retrieved tasks into jobs
+		for _, item := range page.Items {
+			if job, ok := jobFromItem(item); ok {
+				jobs = append(jobs, job)
+			}
+		}
+		return true
+	})
 	if err != nil {
 		log(callerMethod, fmt.Sprintf("Error scanning DynamoDB table: %s", err.Error()))
-		return err
+		return nil, err
 	}
+	return jobs, nil
+}
 
-	// Parse and add retrieved jobs to the application
-	for _, item := range result.Items {
-		// log(callerMethod, fmt.Sprintf("Item: %v", item))
-		task := Task{}
-		err := dynamodbattribute.UnmarshalMap(item, &task)
-		if err != nil {
-			log(callerMethod, fmt.Sprintf("Error unmarshalling task: %s", err.Error()))
-			continue
-		}
-
-		// Extract nextExecution attribute value
-		nextExecutionAttributeValue, ok := item["nextExecution"]
-		if !ok {
-			log(callerMethod, "Error: nextExecution not found in item")
-			continue
-		}
-		if nextExecutionAttributeValue == nil {
-			log(callerMethod, "Error: nextExecutionAttributeValue is nil")
-			continue
-		}
-		// log(callerMethod, fmt.Sprintf("nextExecution attribute value: %v", nextExecutionAttributeValue))
-		// Parse the nextExecution timestamp string into a time.Time object
-		nextExecutionTime, err := time.Parse(time.RFC3339, *nextExecutionAttributeValue.S)
-		if err != nil {
-			log(callerMethod, fmt.Sprintf("Error parsing nextExecution time: %s", err.Error()))
-			continue
-		}
-
-		// Convert the nextExecution time to Unix timestamp
-		nextExecutionUnix := nextExecutionTime.Unix()
+// jobFromItem builds the pending job for a daria_tasks item. It returns false for items
+// that should not be queued.
+func jobFromItem(item map[string]*dynamodb.AttributeValue) (scheduler.Job, bool) {
+	callerMethod := "jobFromItem"
+	// log(callerMethod, fmt.Sprintf("Item: %v", item))
+	task := Task{}
+	err := dynamodbattribute.UnmarshalMap(item, &task)
+	if err != nil {
+		log(callerMethod, fmt.Sprintf("Error unmarshalling task: %s", err.Error()))
+		return scheduler.Job{}, false
+	}
 
-		// Create a new job using the retrieved data
-		newJob := Job{ID: task.TaskID, Time: nextExecutionUnix}
+	// Finished tasks keep the time of their last run as nextExecution
+	if task.TotalExecutions >= maxExecutions || task.Paused {
+		return scheduler.Job{}, false
+	}
 
-		// For example, you can add it to a heap using addToHeap(newJob)
-		addToHeap(newJob)
+	// Extract nextExecution attribute value
+	nextExecutionAttributeValue, ok := item["nextExecution"]
+	if !ok {
+		log(callerMethod, "Error: nextExecution not found in item")
+		return scheduler.Job{}, false
+	}
+	if nextExecutionAttributeValue == nil || nextExecutionAttributeValue.S == nil {
+		log(callerMethod, "Error: nextExecutionAttributeValue is nil")
+		return scheduler.Job{}, false
+	}
+	// log(callerMethod, fmt.Sprintf("nextExecution attribute value: %v", nextExecutionAttributeValue))
+	// Parse the nextExecution timestamp string into a time.Time object
+	nextExecutionTime, err := time.Parse(time.RFC3339, *nextExecutionAttributeValue.S)
+	if err != nil {
+		log(callerMethod, fmt.Sprintf("Error parsing nextExecution time: %s", err.Error()))
+		return scheduler.Job{}, false
 	}
 
-	return nil
+	// Create a new job using the retrieved data
+	return scheduler.Job{ID: task.TaskID, Time: nextExecutionTime.Unix()}, true
 }
 
-func verifyOwnership(taskID string, userID string) bool {
-	return strings.HasPrefix(taskID, userID+"_")
+func verifyOwnership(task *Task, userID string) bool {
+	return task.UserID == userID
 }
 
 func deleteTaskFromDb(taskID string) error {
@@ -383,15 +422,119 @@ func deleteTaskFromDb(taskID string) error {
 				S: aws.String(taskID),
 			},
 		},
+		// Only the request that actually removed the item may release the job slot
+		ConditionExpression: aws.String("attribute_exists(taskId)"),
 	}
 
 	_, err := db.svc.DeleteItem(input)
 	if err != nil {
+		if isConditionalCheckFailed(err) {
+			return fmt.Errorf("%w for taskId: %s", errTaskNotFound, taskID)
+		}
 		return err
 	}
 	return nil
 }
 
+// deleteTaskAndReleaseSlot deletes the task and gives its slot back to the owner in one
+// transaction, so a crash between the two can't leave jobCount off by one. If jobCount is
+// already zero the task is deleted on its own.
+func deleteTaskAndReleaseSlot(task *Task) error {
+	callerMethod := "deleteTaskAndReleaseSlot"
+	input := &dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{
+				Delete: &dynamodb.Delete{
+					TableName: aws.String("daria_tasks"),
+					Key: map[string]*dynamodb.AttributeValue{
+						"taskId": {
+							S: aws.String(task.TaskID),
+						},
+					},
+					ConditionExpression: aws.String("attribute_exists(taskId)"),
+				},
+			},
+			{
+				Update: &dynamodb.Update{
+					TableName: aws.String("daria_users"),
+					Key: map[string]*dynamodb.AttributeValue{
+						"userId": {
+							S: aws.String(task.UserID),
+						},
+					},
+					UpdateExpression:    aws.String("ADD jobCount :minusOne"),
+					ConditionExpression: aws.String("jobCount > :zero"),
+					ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+						":minusOne": {
+							N: aws.String("-1"),
+						},
+						":zero": {
+							N: aws.String("0"),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	_, err := db.svc.TransactWriteItems(input)
+	var canceled *dynamodb.TransactionCanceledException
+	if !errors.As(err, &canceled) {
+		return err
+	}
+	// The reasons are in the order of TransactItems
+	failed := func(i int) bool {
+		return i < len(canceled.CancellationReasons) &&
+			aws.StringValue(canceled.CancellationReasons[i].Code) == "ConditionalCheckFailed"
+	}
+	if failed(0) {
+		return fmt.Errorf("%w for taskId: %s", errTaskNotFound, task.TaskID)
+	}
+	if failed(1) {
+		log(callerMethod, fmt.Sprintf("jobCount for user %s is already 0", task.UserID))
+		return deleteTaskFromDb(task.TaskID)
+	}
+	return err
+}
+
+// listUserTasks returns every task the user owns.
+func listUserTasks(userID string) ([]Task, error) {
+	startTime := time.Now()
+	callerMethod := "listUserTasks"
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	input := &dynamodb.ScanInput{
+		TableName:        aws.String("daria_tasks"),
+		FilterExpression: aws.String("userId = :u"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":u": {
+				S: aws.String(userID),
+			},
+		},
+	}
+
+	tasks := make([]Task, 0)
+	err := db.svc.ScanPages(input, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			var task Task
+			if err := dynamodbattribute.UnmarshalMap(item, &task); err != nil {
+				log(callerMethod, fmt.Sprintf("Error unmarshalling task: %s", err.Error()))
+				continue
+			}
+			tasks = append(tasks, task)
+		}
+		return true
+	})
+	if err != nil {
+		log(callerMethod, err.Error())
+		return nil, err
+	}
+	return tasks, nil
+}
+
 // getTask retrieves task details from DynamoDB based on the taskId
 func getTaskFromDB(taskId string) (*Task, error) {
 	startTime := time.Now()
@@ -421,7 +564,7 @@ func getTaskFromDB(taskId string) (*Task, error) {
 	// Check if the item exists
 	if result.Item == nil {
 		log(callerMethod, fmt.Sprintf("Task not found for taskId: %s", taskId))
-		return nil, fmt.Errorf("task not found for taskId: %s", taskId)
+		return nil, fmt.Errorf("%w for taskId: %s", errTaskNotFound, taskId)
 	}
 
 	// Unmarshal the DynamoDB item into a Task struct
@@ -434,7 +577,12 @@ func getTaskFromDB(taskId string) (*Task, error) {
 	return &task, nil
 }
 
-func updateTaskInDb(task *Task) {
+// updateTaskInDb records the result of an execution. It fails if the task was deleted in
+// the meantime rather than recreating a partial item. A non-zero fencingToken is the
+// token from claimExecution: the write then also requires that nobody has claimed the
+// task since, and releases the lease. It bumps the token again on release, so a replica
+// that read the task while it was claimed cannot claim the finished run.
+func updateTaskInDb(task *Task, fencingToken int64) error {
 
 	// Define input for UpdateItem operation
 	input := &dynamodb.UpdateItemInput{
@@ -444,7 +592,8 @@ func updateTaskInDb(task *Task) {
 				S: aws.String(task.TaskID),
 			},
 		},
-		UpdateExpression: aws.String("SET lastExecution = :le, totalExecutions = :te, nextExecution = :ne"),
+		UpdateExpression:    aws.String("SET lastExecution = :le, totalExecutions = :te, nextExecution = :ne, consecutiveFailures = :cf"),
+		ConditionExpression: aws.String("attribute_exists(taskId)"),
 		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
 			":le": {
 				S: aws.String(task.LastExecution.Format(time.RFC3339)),
@@ -455,13 +604,127 @@ func updateTaskInDb(task *Task) {
 			":ne": {
 				S: aws.String(task.NextExecution.Format(time.RFC3339)),
 			},
+			":cf": {
+				N: aws.String(strconv.Itoa(task.ConsecutiveFailures)),
+			},
 		},
 	}
 
+	if fencingToken != 0 {
+		input.UpdateExpression = aws.String(*input.UpdateExpression + " ADD fencingToken :one REMOVE leaseOwner, leaseExpiry")
+		input.ConditionExpression = aws.String("attribute_exists(taskId) AND fencingToken = :ft")
+		input.ExpressionAttributeValues[":ft"] = &dynamodb.AttributeValue{
+			N: aws.String(strconv.FormatInt(fencingToken, 10)),
+		}
+		input.ExpressionAttributeValues[":one"] = &dynamodb.AttributeValue{
+			N: aws.String("1"),
+		}
+	}
+
 	// Perform the UpdateItem operation
 	_, err := db.svc.UpdateItem(input)
 	if err != nil {
 		log("updateTaskInDb", err.Error())
+		if isConditionalCheckFailed(err) {
+			return fmt.Errorf("%w for taskId: %s", errTaskNotFound, task.TaskID)
+		}
+		return err
 	}
 	log("updateTaskInDb", "Updated the task")
+	return nil
+}
+
+// updateTaskDefinition saves a task's user-editable fields and its next run, leaving the
+// execution history alone. It fails with errTaskNotFound if the task was deleted.
+func updateTaskDefinition(task *Task) error {
+	callerMethod := "updateTaskDefinition"
+	apiBody, err := dynamodbattribute.Marshal(task.APIBody)
+	if err != nil {
+		return err
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String("daria_tasks"), // Specify your DynamoDB table name
+		Key: map[string]*dynamodb.AttributeValue{
+			"taskId": {
+				S: aws.String(task.TaskID),
+			},
+		},
+		UpdateExpression: aws.String("SET #name = :name, apiMethod = :method, apiURL = :url, startFrom = :start," +
+			" frequency = :freq, apiBody = :body, deliveryGuarantee = :dg, nextExecution = :ne"),
+		ConditionExpression: aws.String("attribute_exists(taskId)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#name": aws.String("name"), // name is a reserved word
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":name": {
+				S: aws.String(task.Name),
+			},
+			":method": {
+				S: aws.String(task.APIMethod),
+			},
+			":url": {
+				S: aws.String(task.APIURL),
+			},
+			":start": {
+				S: aws.String(task.StartFrom),
+			},
+			":freq": {
+				N: aws.String(strconv.Itoa(task.Frequency)),
+			},
+			":body": apiBody,
+			":dg": {
+				S: aws.String(deliveryGuarantee(task)),
+			},
+			":ne": {
+				S: aws.String(task.NextExecution.Format(time.RFC3339)),
+			},
+		},
+	}
+
+	_, err = db.svc.UpdateItem(input)
+	if err != nil {
+		log(callerMethod, err.Error())
+		if isConditionalCheckFailed(err) {
+			return fmt.Errorf("%w for taskId: %s", errTaskNotFound, task.TaskID)
+		}
+		return err
+	}
+	log(callerMethod, fmt.Sprintf("Updated the definition of %s", task.TaskID))
+	return nil
+}
+
+// updateTaskState saves whether the task is paused and when it next runs. It fails with
+// errTaskNotFound if the task was deleted.
+func updateTaskState(task *Task) error {
+	callerMethod := "updateTaskState"
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String("daria_tasks"), // Specify your DynamoDB table name
+		Key: map[string]*dynamodb.AttributeValue{
+			"taskId": {
+				S: aws.String(task.TaskID),
+			},
+		},
+		UpdateExpression:    aws.String("SET paused = :paused, nextExecution = :ne"),
+		ConditionExpression: aws.String("attribute_exists(taskId)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":paused": {
+				BOOL: aws.Bool(task.Paused),
+			},
+			":ne": {
+				S: aws.String(task.NextExecution.Format(time.RFC3339)),
+			},
+		},
+	}
+
+	_, err := db.svc.UpdateItem(input)
+	if err != nil {
+		log(callerMethod, err.Error())
+		if isConditionalCheckFailed(err) {
+			return fmt.Errorf("%w for taskId: %s", errTaskNotFound, task.TaskID)
+		}
+		return err
+	}
+	log(callerMethod, fmt.Sprintf("Task %s paused: %v, next run: %s", task.TaskID, task.Paused, task.NextExecution))
+	return nil
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// useFakeDynamoDB points db at handler until the test ends, and moves the test into a
+// temporary directory since log() appends to logfile.txt in the working directory.
+// handler speaks DynamoDB's JSON protocol: the operation is in the X-Amz-Target header,
+// e.g. DynamoDB_20120810.PutItem.
+func useFakeDynamoDB(t *testing.T, handler http.Handler) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	srv := httptest.NewServer(handler)
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(srv.URL),
+		Credentials: credentials.NewStaticCredentials("test", "test", ""),
+		MaxRetries:  aws.Int(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := db
+	db = &DynamoDBClient{svc: dynamodb.New(sess)}
+	t.Cleanup(func() {
+		db = saved
+		srv.Close()
+	})
+}
+
+// fakeAttribute is a DynamoDB attribute value on the wire.
+type fakeAttribute struct {
+	S string `json:"S,omitempty"`
+	N string `json:"N,omitempty"`
+}
+
+// fakeRequest is the part of a DynamoDB request the fakes look at.
+type fakeRequest struct {
+	Item                      map[string]fakeAttribute
+	Key                       map[string]fakeAttribute
+	UpdateExpression          string
+	ConditionExpression       string
+	ExpressionAttributeValues map[string]fakeAttribute
+}
+
+func decodeFakeRequest(w http.ResponseWriter, r *http.Request) (string, fakeRequest, bool) {
+	var req fakeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", req, false
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	return r.Header.Get("X-Amz-Target"), req, true
+}
+
+func writeFakeError(w http.ResponseWriter, code string, message string) {
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"__type": "com.amazonaws.dynamodb.v20120810#" + code, "message": message})
+}
+
+func writeConditionalCheckFailed(w http.ResponseWriter) {
+	writeFakeError(w, "ConditionalCheckFailedException", "The conditional request failed")
+}
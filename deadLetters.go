@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"daria.com/jobScheduler/api"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/gin-gonic/gin"
+)
+
+// A run that fails on every attempt is written to daria_dead_letters with the request it
+// made, its last error and the response, if any. Users can list their dead letters and
+// replay one: its request is sent again exactly, or with an edited body. Dead letters are
+// kept as long as executions.
+
+// Dead letter states
+const (
+	deadLetterFailed   = "failed"
+	deadLetterReplayed = "replayed" // a replay succeeded
+)
+
+var (
+	errDeadLetterNotFound = errors.New("dead letter not found")
+	errDeadLetterExists   = errors.New("dead letter already exists")
+	errReplayConflict     = errors.New("dead letter replayed concurrently")
+)
+
+// deadLetterID identifies the dead letter of a run. Like the execution ID it only depends
+// on the run, so a run that fails again after a crash keeps its first dead letter.
+func deadLetterID(executionID string) string {
+	return strings.Replace(executionID, "#", "-", 1)
+}
+
+// saveDeadLetter records a run that failed after all its attempts. Errors are only logged,
+// since the run's outcome is journalled either way.
+func saveDeadLetter(task *Task, execution *executionRecord, result JobExecutionResult) {
+	callerMethod := "saveDeadLetter"
+	now := clock.Now()
+	letter := api.DeadLetter{
+		DeadLetterID: deadLetterID(execution.ExecutionID),
+		ExecutionID:  execution.ExecutionID,
+		TaskID:       task.TaskID,
+		UserID:       task.UserID,
+		ScheduledAt:  execution.ScheduledAt,
+		FailedAt:     now.Unix(),
+		Attempts:     max(execution.Attempts, 1),
+		Request:      taskRequest(*task, execution.ExecutionID),
+		Response:     result.Response,
+		State:        deadLetterFailed,
+		ExpiresAt:    now.Add(executionRetention).Unix(),
+	}
+	if result.Error != nil {
+		letter.LastError = result.Error.Error()
+	}
+	err := putDeadLetter(letter)
+	if errors.Is(err, errDeadLetterExists) {
+		// Its replays, if any, are kept
+		log(callerMethod, fmt.Sprintf("Execution %s of jobId:%s is already dead-lettered as %s", execution.ExecutionID, task.TaskID, letter.DeadLetterID))
+		return
+	}
+	if err != nil {
+		log(callerMethod, fmt.Sprintf("Error saving dead letter of jobId:%s: %s", task.TaskID, err.Error()))
+		return
+	}
+	log(callerMethod, fmt.Sprintf("Dead-lettered execution %s of jobId:%s as %s", execution.ExecutionID, task.TaskID, letter.DeadLetterID))
+}
+
+// putDeadLetter writes a new dead letter, or returns errDeadLetterExists if the run already
+// has one.
+func putDeadLetter(letter api.DeadLetter) error {
+	item, err := dynamodbattribute.MarshalMap(letter)
+	if err != nil {
+		return err
+	}
+	_, err = db.svc.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String("daria_dead_letters"),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(deadLetterId)"),
+	})
+	if isConditionalCheckFailed(err) {
+		return errDeadLetterExists
+	}
+	return err
+}
+
+// recordReplay counts a replay of letter and stores its result, if no other replay was
+// recorded since letter was read. It returns the updated dead letter, or
+// errReplayConflict.
+func recordReplay(letter *api.DeadLetter, replay *api.Replay) (*api.DeadLetter, error) {
+	value, err := dynamodbattribute.Marshal(replay)
+	if err != nil {
+		return nil, err
+	}
+	update := "SET lastReplay = :replay"
+	values := map[string]*dynamodb.AttributeValue{
+		":replay": value,
+		":one":    {N: aws.String("1")},
+		":seen":   {N: aws.String(strconv.Itoa(letter.Replays))},
+	}
+	var names map[string]*string
+	if replay.Outcome == "success" {
+		update += ", #state = :replayed"
+		values[":replayed"] = &dynamodb.AttributeValue{S: aws.String(deadLetterReplayed)}
+		names = map[string]*string{"#state": aws.String("state")}
+	}
+	result, err := db.svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String("daria_dead_letters"),
+		Key: map[string]*dynamodb.AttributeValue{
+			"deadLetterId": {
+				S: aws.String(letter.DeadLetterID),
+			},
+		},
+		UpdateExpression:          aws.String(update + " ADD replays :one"),
+		ConditionExpression:       aws.String("replays = :seen"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		ReturnValues:              aws.String("ALL_NEW"),
+	})
+	if isConditionalCheckFailed(err) {
+		return nil, errReplayConflict
+	}
+	if err != nil {
+		return nil, err
+	}
+	var updated api.DeadLetter
+	if err := dynamodbattribute.UnmarshalMap(result.Attributes, &updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+func getDeadLetter(id string) (*api.DeadLetter, error) {
+	input := &dynamodb.GetItemInput{
+		TableName: aws.String("daria_dead_letters"),
+		Key: map[string]*dynamodb.AttributeValue{
+			"deadLetterId": {
+				S: aws.String(id),
+			},
+		},
+		ConsistentRead: aws.Bool(true),
+	}
+	result, err := db.svc.GetItem(input)
+	if err != nil {
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, errDeadLetterNotFound
+	}
+	var letter api.DeadLetter
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &letter); err != nil {
+		return nil, err
+	}
+	return &letter, nil
+}
+
+// listDeadLetters returns up to limit of the user's dead letters, newest first, only those
+// of taskID if it is given.
+func listDeadLetters(userID string, taskID string, limit int64) ([]api.DeadLetter, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String("daria_dead_letters"),
+		IndexName:              aws.String("userId-failedAt-index"),
+		KeyConditionExpression: aws.String("userId = :u"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":u": {
+				S: aws.String(userID),
+			},
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int64(limit),
+	}
+	if taskID != "" {
+		input.IndexName = aws.String("taskId-failedAt-index")
+		input.KeyConditionExpression = aws.String("taskId = :t")
+		input.FilterExpression = aws.String("userId = :u")
+		input.ExpressionAttributeValues[":t"] = &dynamodb.AttributeValue{S: aws.String(taskID)}
+	}
+
+	letters := make([]api.DeadLetter, 0)
+	for {
+		result, err := db.svc.Query(input)
+		if err != nil {
+			log("listDeadLetters", err.Error())
+			return nil, err
+		}
+		var page []api.DeadLetter
+		if err := dynamodbattribute.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return nil, err
+		}
+		letters = append(letters, page...)
+		// The filter applies after the limit, so a page can come back short
+		if int64(len(letters)) >= limit || len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+	if int64(len(letters)) > limit {
+		letters = letters[:limit]
+	}
+	return letters, nil
+}
+
+// loadOwnedDeadLetter fetches the dead letter named in the path and checks that the
+// caller owns it. When it can't, it writes the error response and returns false.
+func loadOwnedDeadLetter(c *gin.Context) (*api.DeadLetter, bool) {
+	letter, err := getDeadLetter(c.Param("deadLetterId"))
+	if errors.Is(err, errDeadLetterNotFound) {
+		respondError(c, http.StatusNotFound, codeNotFound, "Dead letter not found")
+		return nil, false
+	}
+	if err != nil {
+		log("loadOwnedDeadLetter", err.Error())
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to fetch the dead letter")
+		return nil, false
+	}
+	if letter.UserID != c.GetString("userId") {
+		respondError(c, http.StatusForbidden, codeForbidden, "You do not have permission to access this dead letter")
+		return nil, false
+	}
+	return letter, true
+}
+
+// getDeadLetters handles GET /dead-letters?taskId=&limit=N.
+func getDeadLetters(c *gin.Context) {
+	callerMethod := "getDeadLetters"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	limit := int64(20)
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 1 || parsed > 100 {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "limit must be between 1 and 100")
+			return
+		}
+		limit = parsed
+	}
+
+	letters, err := listDeadLetters(c.GetString("userId"), c.Query("taskId"), limit)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to read dead letters")
+		return
+	}
+	c.JSON(http.StatusOK, api.DeadLetterList{DeadLetters: letters})
+}
+
+// getDeadLetterByID handles GET /dead-letters/:deadLetterId.
+func getDeadLetterByID(c *gin.Context) {
+	callerMethod := "getDeadLetterByID"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	letter, ok := loadOwnedDeadLetter(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, letter)
+}
+
+// replayDeadLetter handles POST /dead-letters/:deadLetterId/replay. The request is sent
+// again with its original idempotency key, so a target that did process it can drop it; an
+// edited body is a different request and gets a key of its own. The replay's result is
+// returned whether or not it succeeded.
+func replayDeadLetter(c *gin.Context) {
+	callerMethod := "replayDeadLetter"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	body, err := c.GetRawData()
+	if err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "Failed to read request body")
+		return
+	}
+	var input api.ReplayInput
+	if len(body) > 0 {
+		if err := validateRequest("ReplayInput", body); err != nil {
+			respondInvalid(c, err)
+			return
+		}
+		if err := json.Unmarshal(body, &input); err != nil {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+	}
+	letter, ok := loadOwnedDeadLetter(c)
+	if !ok {
+		return
+	}
+
+	request := letter.Request
+	request.Headers = make(map[string]string, len(letter.Request.Headers))
+	for name, value := range letter.Request.Headers {
+		request.Headers[name] = value
+	}
+	edited := input.Body != nil
+	if edited {
+		request.Body = input.Body
+		for name, value := range request.Headers {
+			if value == letter.ExecutionID {
+				request.Headers[name] = fmt.Sprintf("%s-replay-%d", letter.DeadLetterID, letter.Replays+1)
+			}
+		}
+	}
+
+	result := sendRequest(c.Request.Context(), letter.UserID, request)
+	replay := &api.Replay{At: clock.Now().Unix(), BodyEdited: edited, Outcome: result.Status, Response: result.Response}
+	if result.Error != nil {
+		replay.Error = result.Error.Error()
+	}
+	log(callerMethod, fmt.Sprintf("Replay %d of %s: %s", letter.Replays+1, letter.DeadLetterID, result.Status))
+	updated, err := recordReplay(letter, replay)
+	if errors.Is(err, errReplayConflict) {
+		respondError(c, http.StatusConflict, codeReplayConflict, "The request was replayed, but so was the dead letter by another request at the same time; fetch it and check lastReplay before replaying again")
+		return
+	}
+	if err != nil {
+		log(callerMethod, err.Error())
+		respondError(c, http.StatusInternalServerError, codeInternal, "The request was replayed but the dead letter could not be updated")
+		return
+	}
+	c.JSON(http.StatusOK, updated)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+
+	"daria.com/jobScheduler/api"
+)
+
+// fakeDeadLetters stands in for daria_dead_letters, keeping the attributes the conditions
+// putDeadLetter and recordReplay write with depend on.
+type fakeDeadLetters struct {
+	mu      sync.Mutex
+	replays map[string]int
+	states  map[string]string
+}
+
+func (f *fakeDeadLetters) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target, req, ok := decodeFakeRequest(w, r)
+	if !ok {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch target {
+	case "DynamoDB_20120810.PutItem":
+		// attribute_not_exists(deadLetterId)
+		id := req.Item["deadLetterId"].S
+		if _, ok := f.replays[id]; ok {
+			writeConditionalCheckFailed(w)
+			return
+		}
+		f.replays[id], _ = strconv.Atoi(req.Item["replays"].N)
+		f.states[id] = req.Item["state"].S
+		w.Write([]byte(`{}`))
+	case "DynamoDB_20120810.UpdateItem":
+		// replays = :seen
+		id := req.Key["deadLetterId"].S
+		seen, _ := strconv.Atoi(req.ExpressionAttributeValues[":seen"].N)
+		if replays, ok := f.replays[id]; !ok || replays != seen {
+			writeConditionalCheckFailed(w)
+			return
+		}
+		f.replays[id]++
+		if state, ok := req.ExpressionAttributeValues[":replayed"]; ok {
+			f.states[id] = state.S
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Attributes": map[string]fakeAttribute{
+			"deadLetterId": {S: id},
+			"replays":      {N: strconv.Itoa(f.replays[id])},
+			"state":        {S: f.states[id]},
+		}})
+	default:
+		writeFakeError(w, "ValidationException", "unexpected call to "+target)
+	}
+}
+
+func TestDeadLetterReplays(t *testing.T) {
+	table := &fakeDeadLetters{replays: make(map[string]int), states: make(map[string]string)}
+	useFakeDynamoDB(t, table)
+	letter := api.DeadLetter{DeadLetterID: "user_1_task_1-1790856000", UserID: "user_1", State: deadLetterFailed}
+
+	if err := putDeadLetter(letter); err != nil {
+		t.Fatal(err)
+	}
+	// The run fails again after a crash, once the letter has been replayed
+	if _, err := recordReplay(&letter, &api.Replay{Outcome: "failure"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := putDeadLetter(letter); !errors.Is(err, errDeadLetterExists) {
+		t.Fatalf("writing the dead letter again = %v; want errDeadLetterExists", err)
+	}
+	if table.replays[letter.DeadLetterID] != 1 {
+		t.Fatal("writing the dead letter again lost its replay")
+	}
+
+	// Two replays of the same read: only the first is recorded
+	a, b := letter, letter
+	a.Replays, b.Replays = 1, 1
+	updated, err := recordReplay(&a, &api.Replay{Outcome: "failure"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Replays != 2 || updated.State != deadLetterFailed {
+		t.Fatalf("after a failed replay the dead letter is %+v; want 2 replays, still failed", updated)
+	}
+	if _, err := recordReplay(&b, &api.Replay{Outcome: "success"}); !errors.Is(err, errReplayConflict) {
+		t.Fatalf("a replay of a stale read = %v; want errReplayConflict", err)
+	}
+
+	updated, err = recordReplay(updated, &api.Replay{Outcome: "success"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Replays != 3 || updated.State != deadLetterReplayed {
+		t.Fatalf("after a successful replay the dead letter is %+v; want 3 replays, replayed", updated)
+	}
+}
@@ -1,20 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
-	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-type DeletedTask struct {
-	TaskID string
-}
-
-var deletedTasks sync.Map
-
 func deleteTask(c *gin.Context) {
 	callerMethod := "deleteTask"
 	startTime := time.Now()
@@ -25,38 +19,52 @@ func deleteTask(c *gin.Context) {
 
 	taskID := c.Param("taskID")
 	if taskID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Task ID is required"})
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "Task ID is required")
 		return
 	}
 
 	// Verify ownership of the task
 	userID := c.GetString("userId")
 
-	if !verifyOwnership(taskID, userID) {
-		c.JSON(http.StatusForbidden, gin.H{"error": "You do not have permission to delete this task"})
+	task, err := getTaskFromDB(taskID)
+	if errors.Is(err, errTaskNotFound) {
+		respondError(c, http.StatusNotFound, codeNotFound, "Task not found")
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to fetch the task")
+		return
+	}
+
+	if !verifyOwnership(task, userID) {
+		respondError(c, http.StatusForbidden, codeForbidden, "You do not have permission to delete this task")
 		return
 	}
 
-	err := deleteTaskFromDb(taskID)
+	err = removeTask(task)
 
+	if errors.Is(err, errTaskNotFound) {
+		// A concurrent delete got there first and already released the slot
+		respondError(c, http.StatusNotFound, codeNotFound, "Task not found")
+		return
+	}
 	if err != nil {
-		log(callerMethod, fmt.Sprintf("Error deleting task: %s", err.Error()))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete the task"})
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to delete the task")
 		return
 	}
 
-	addDeletedTask(taskID)
-
 	c.JSON(http.StatusOK, gin.H{"message": "Task deleted successfully"})
 }
 
-func addDeletedTask(taskID string) {
-	deletedTasks.Store(taskID, DeletedTask{
-		TaskID: taskID,
-	})
-}
+// removeTask deletes the task, gives its slot back to the owner and drops its pending run.
+func removeTask(task *Task) error {
+	callerMethod := "removeTask"
+	if err := deleteTaskAndReleaseSlot(task); err != nil {
+		log(callerMethod, fmt.Sprintf("Error deleting task: %s", err.Error()))
+		return err
+	}
 
-func isTaskDeleted(taskID string) bool {
-	_, ok := deletedTasks.Load(taskID)
-	return ok
+	// An execution already in flight will fail its conditional update and not re-queue itself
+	sched.Cancel(task.TaskID)
+	return nil
 }
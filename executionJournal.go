@@ -0,0 +1,342 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"daria.com/jobScheduler/api"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// Every run of a task is journalled in daria_executions before anything happens, so a crash
+// at any point leaves a record of how far the run got:
+//
+//	pending  the run was dispatched but its API has not been called
+//	running  the API call has started and may have reached the target
+//	done     the task row was advanced to its next run
+//
+// A run left pending is simply run again. A run left running is where the task's delivery
+// guarantee matters: at-least-once runs it again, at-most-once skips it and moves the task
+// on to its next run without calling the API.
+
+const (
+	executionPending = "pending"
+	executionRunning = "running"
+	executionDone    = "done"
+)
+
+// Delivery guarantees a task can ask for
+const (
+	deliveryAtLeastOnce = "atLeastOnce"
+	deliveryAtMostOnce  = "atMostOnce"
+)
+
+// How long finished executions are kept before DynamoDB's TTL removes them
+const executionRetention = 30 * 24 * time.Hour
+
+// executionRecord is a row of daria_executions.
+type executionRecord = api.Execution
+
+// executionID identifies one scheduled run of a task. It only depends on the task and the
+// time the run was scheduled for, so every attempt at the same run shares it.
+func executionID(taskID string, scheduledAt time.Time) string {
+	return fmt.Sprintf("%s#%d", taskID, scheduledAt.Unix())
+}
+
+// deliveryGuarantee returns the task's guarantee, defaulting tasks created before the
+// setting existed to at-least-once.
+func deliveryGuarantee(task *Task) string {
+	if task.DeliveryGuarantee == "" {
+		return deliveryAtLeastOnce
+	}
+	return task.DeliveryGuarantee
+}
+
+// beginExecution journals the task's current run as pending. If an earlier attempt at the
+// same run left a record behind, that record is returned instead, untouched.
+func beginExecution(task *Task, now time.Time) (*executionRecord, bool, error) {
+	startTime := time.Now()
+	callerMethod := "beginExecution"
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	record := &executionRecord{
+		ExecutionID:       executionID(task.TaskID, task.NextExecution),
+		TaskID:            task.TaskID,
+		UserID:            task.UserID,
+		ScheduledAt:       task.NextExecution.Unix(),
+		State:             executionPending,
+		DeliveryGuarantee: deliveryGuarantee(task),
+		InstanceID:        config.InstanceID,
+		StartedAt:         now.Unix(),
+	}
+	av, err := dynamodbattribute.MarshalMap(record)
+	if err != nil {
+		return nil, false, err
+	}
+	input := &dynamodb.PutItemInput{
+		TableName:           aws.String("daria_executions"),
+		Item:                av,
+		ConditionExpression: aws.String("attribute_not_exists(executionId)"),
+	}
+	_, err = db.svc.PutItem(input)
+	if err == nil {
+		return record, true, nil
+	}
+	if !isConditionalCheckFailed(err) {
+		log(callerMethod, err.Error())
+		return nil, false, err
+	}
+
+	existing, err := getExecution(record.ExecutionID)
+	if err != nil {
+		return nil, false, err
+	}
+	log(callerMethod, fmt.Sprintf("Found %s execution %s from %s", existing.State, existing.ExecutionID, existing.InstanceID))
+	return existing, false, nil
+}
+
+// markExecutionRunning records that the API call is about to start, and how long a rate
+// limit held the run back.
+func markExecutionRunning(record *executionRecord, now time.Time) error {
+	record.State = executionRunning
+	record.InstanceID = config.InstanceID
+	record.StartedAt = now.Unix()
+
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String("daria_executions"),
+		Key: map[string]*dynamodb.AttributeValue{
+			"executionId": {
+				S: aws.String(record.ExecutionID),
+			},
+		},
+		UpdateExpression: aws.String("SET #state = :running, instanceId = :me, startedAt = :now"),
+		ExpressionAttributeNames: map[string]*string{
+			"#state": aws.String("state"), // state is a reserved word
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":running": {
+				S: aws.String(executionRunning),
+			},
+			":me": {
+				S: aws.String(config.InstanceID),
+			},
+			":now": {
+				N: aws.String(strconv.FormatInt(record.StartedAt, 10)),
+			},
+		},
+	}
+	if record.RateLimitDelayMs > 0 {
+		*input.UpdateExpression += ", rateLimitDelayMs = :delay, rateLimitedBy = :by"
+		input.ExpressionAttributeValues[":delay"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(record.RateLimitDelayMs, 10))}
+		input.ExpressionAttributeValues[":by"] = &dynamodb.AttributeValue{S: aws.String(record.RateLimitedBy)}
+	}
+	_, err := db.svc.UpdateItem(input)
+	return err
+}
+
+// finishExecution marks the run done with its outcome and starts its retention period.
+func finishExecution(record *executionRecord, now time.Time, outcome string, runErr error) error {
+	record.State = executionDone
+	record.FinishedAt = now.Unix()
+	record.Outcome = outcome
+	record.ExpiresAt = now.Add(executionRetention).Unix()
+
+	update := "SET #state = :done, finishedAt = :now, outcome = :outcome, expiresAt = :exp"
+	values := map[string]*dynamodb.AttributeValue{
+		":done": {
+			S: aws.String(executionDone),
+		},
+		":now": {
+			N: aws.String(strconv.FormatInt(record.FinishedAt, 10)),
+		},
+		":outcome": {
+			S: aws.String(outcome),
+		},
+		":exp": {
+			N: aws.String(strconv.FormatInt(record.ExpiresAt, 10)),
+		},
+	}
+	if record.Attempts > 0 {
+		update += ", attempts = :attempts"
+		values[":attempts"] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(record.Attempts))}
+	}
+	if runErr != nil {
+		record.Error = runErr.Error()
+		update += ", #error = :error"
+		values[":error"] = &dynamodb.AttributeValue{S: aws.String(record.Error)}
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String("daria_executions"),
+		Key: map[string]*dynamodb.AttributeValue{
+			"executionId": {
+				S: aws.String(record.ExecutionID),
+			},
+		},
+		UpdateExpression: aws.String(update),
+		ExpressionAttributeNames: map[string]*string{
+			"#state": aws.String("state"),
+		},
+		ExpressionAttributeValues: values,
+	}
+	if runErr != nil {
+		input.ExpressionAttributeNames["#error"] = aws.String("error")
+	}
+	_, err := db.svc.UpdateItem(input)
+	if err != nil {
+		log("finishExecution", err.Error())
+	}
+	return err
+}
+
+func getExecution(id string) (*executionRecord, error) {
+	input := &dynamodb.GetItemInput{
+		TableName: aws.String("daria_executions"),
+		Key: map[string]*dynamodb.AttributeValue{
+			"executionId": {
+				S: aws.String(id),
+			},
+		},
+		ConsistentRead: aws.Bool(true),
+	}
+	result, err := db.svc.GetItem(input)
+	if err != nil {
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, fmt.Errorf("execution %s not found", id)
+	}
+	var record executionRecord
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// skipExecution moves the task past a run without calling its API and closes the run's
+// journal entry. It reports whether the task should run again.
+func skipExecution(task *Task, record *executionRecord, fencingToken int64, outcome string) (bool, error) {
+	reschedule := recordExecution(task, clock.Now())
+	if err := updateTaskInDb(task, fencingToken); err != nil {
+		return false, err
+	}
+	finishExecution(record, clock.Now(), outcome, nil)
+	return reschedule, nil
+}
+
+// recoverExecutions reconciles the runs that an earlier process left unfinished. It runs
+// before the scheduler starts; runs that are not settled here are settled by the executor
+// when the task next comes due, since the journal is checked on every run.
+func recoverExecutions() error {
+	startTime := time.Now()
+	callerMethod := "recoverExecutions"
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	input := &dynamodb.ScanInput{
+		TableName:        aws.String("daria_executions"),
+		FilterExpression: aws.String("#state <> :done"),
+		ExpressionAttributeNames: map[string]*string{
+			"#state": aws.String("state"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":done": {
+				S: aws.String(executionDone),
+			},
+		},
+	}
+	records := make([]executionRecord, 0)
+	err := db.svc.ScanPages(input, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			var record executionRecord
+			if err := dynamodbattribute.UnmarshalMap(item, &record); err != nil {
+				log(callerMethod, fmt.Sprintf("Error unmarshalling execution: %s", err.Error()))
+				continue
+			}
+			records = append(records, record)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range records {
+		if err := reconcileExecution(&records[i], clock.Now()); err != nil {
+			log(callerMethod, fmt.Sprintf("Error reconciling %s: %s", records[i].ExecutionID, err.Error()))
+		}
+	}
+	log(callerMethod, fmt.Sprintf("Reconciled %d unfinished executions", len(records)))
+	return nil
+}
+
+// reconcileExecution settles one unfinished run found at startup.
+func reconcileExecution(record *executionRecord, now time.Time) error {
+	callerMethod := "reconcileExecution"
+	if !ownsTask(record.TaskID) {
+		return nil
+	}
+
+	task, err := getTaskFromDB(record.TaskID)
+	if errors.Is(err, errTaskNotFound) {
+		return finishExecution(record, now, "abandoned", errTaskNotFound)
+	}
+	if err != nil {
+		return err
+	}
+	if task.NextExecution.Unix() != record.ScheduledAt {
+		// The task row was advanced, so the run completed; only the journal update was lost
+		return finishExecution(record, now, "success", nil)
+	}
+	if config.Mode != modeSingle && (task.LeaseExpiry > now.Unix() || record.StartedAt+int64(config.LeaseDuration/time.Second) > now.Unix()) {
+		// Possibly still in progress on another replica
+		return nil
+	}
+
+	if record.State == executionRunning && record.DeliveryGuarantee == deliveryAtMostOnce {
+		log(callerMethod, fmt.Sprintf("Skipping interrupted run %s of at-most-once task", record.ExecutionID))
+		// The scheduler has not loaded the queue yet, so it picks up the new next run itself
+		_, err := skipExecution(task, record, 0, "abandoned")
+		return err
+	}
+	// A pending run never reached its target, and an at-least-once run is delivered again;
+	// the task is still due, so the scheduler runs it once it starts
+	log(callerMethod, fmt.Sprintf("Run %s was left %s and will run again", record.ExecutionID, record.State))
+	return nil
+}
+
+// listExecutions returns the task's most recent runs, newest first, from the
+// taskId-scheduledAt-index of daria_executions.
+func listExecutions(taskID string, limit int64) ([]executionRecord, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String("daria_executions"),
+		IndexName:              aws.String("taskId-scheduledAt-index"),
+		KeyConditionExpression: aws.String("taskId = :t"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":t": {
+				S: aws.String(taskID),
+			},
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int64(limit),
+	}
+	result, err := db.svc.Query(input)
+	if err != nil {
+		log("listExecutions", err.Error())
+		return nil, err
+	}
+	records := make([]executionRecord, 0, len(result.Items))
+	if err := dynamodbattribute.UnmarshalListOfMaps(result.Items, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
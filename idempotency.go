@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/gin-gonic/gin"
+)
+
+// A client that retries a request after a timeout sends the same Idempotency-Key header.
+// The first request with a key stores the key in daria_idempotency_keys, and once it
+// succeeds its response too; a replay gets that response back instead of creating the
+// tasks again. Failed requests release their key so they can be retried. Keys are scoped
+// to the user and kept for config.IdempotencyRetention.
+
+const maxIdempotencyKeyLength = 255
+
+// How long a key stays locked by a request that has not finished, e.g. because the
+// instance handling it died. The instance handling a request renews the lock every
+// idempotencyLockRefresh, so a long batch keeps its key however long it runs.
+const (
+	idempotencyLockTimeout = time.Minute
+	idempotencyLockRefresh = idempotencyLockTimeout / 3
+)
+
+var (
+	errIdempotencyKeyInUse    = errors.New("a request with this Idempotency-Key is still in progress")
+	errIdempotencyKeyMismatch = errors.New("this Idempotency-Key was already used with a different request body")
+)
+
+// idempotencyRecord is a row of daria_idempotency_keys.
+type idempotencyRecord struct {
+	IdempotencyKey string `json:"idempotencyKey"` // <userId>#<key>
+	UserID         string `json:"userId"`
+	RequestHash    string `json:"requestHash"`
+	StatusCode     int    `json:"statusCode,omitempty"` // zero while the request is in progress
+	ResponseBody   string `json:"responseBody,omitempty"`
+	CreatedAt      int64  `json:"createdAt"`
+	ExpiresAt      int64  `json:"expiresAt"`
+}
+
+// responseRecorder keeps a copy of the response so it can be stored for replays.
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
+
+func (r *responseRecorder) WriteString(s string) (int, error) {
+	r.body.WriteString(s)
+	return r.ResponseWriter.WriteString(s)
+}
+
+// idempotencyMiddleware makes a request replayable when it carries an Idempotency-Key
+// header; requests without one pass straight through. It must run before anything that
+// can reject a replay, such as the job quota check.
+func idempotencyMiddleware(c *gin.Context) {
+	startTime := time.Now()
+	callerMethod := "idempotencyMiddleware"
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	key := c.GetHeader("Idempotency-Key")
+	if key == "" {
+		c.Next()
+		return
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLength))
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "Failed to read request body")
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body)) // Let the handler read it again
+
+	userID := c.GetString("userId")
+	sum := sha256.Sum256(append([]byte(c.Request.Method+" "+c.FullPath()+"\n"), body...))
+	record := &idempotencyRecord{
+		IdempotencyKey: userID + "#" + key,
+		UserID:         userID,
+		RequestHash:    hex.EncodeToString(sum[:]),
+	}
+
+	existing, err := lockIdempotencyKey(record, clock.Now())
+	switch {
+	case errors.Is(err, errIdempotencyKeyMismatch):
+		respondError(c, http.StatusUnprocessableEntity, codeIdempotencyMismatch, err.Error())
+		return
+	case errors.Is(err, errIdempotencyKeyInUse):
+		respondError(c, http.StatusConflict, codeIdempotencyInProgress, err.Error())
+		return
+	case err != nil:
+		log(callerMethod, err.Error())
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to check Idempotency-Key")
+		return
+	case existing != nil:
+		log(callerMethod, fmt.Sprintf("Replaying response for key %s", record.IdempotencyKey))
+		c.Header("Idempotent-Replayed", "true")
+		c.Data(existing.StatusCode, "application/json; charset=utf-8", []byte(existing.ResponseBody))
+		c.Abort()
+		return
+	}
+
+	recorder := &responseRecorder{ResponseWriter: c.Writer}
+	c.Writer = recorder
+	stopRefresh := refreshIdempotencyLock(record)
+	c.Next()
+	stopRefresh()
+
+	status := recorder.Status()
+	if status < 200 || status >= 300 {
+		// Nothing was created, so let the client retry with the same key
+		if err := releaseIdempotencyKey(record); err != nil {
+			log(callerMethod, fmt.Sprintf("Error releasing key %s: %s", record.IdempotencyKey, err.Error()))
+		}
+		return
+	}
+	if err := completeIdempotencyKey(record, status, recorder.body.String(), clock.Now()); err != nil {
+		// The key unlocks after idempotencyLockTimeout, after which a replay would run again
+		log(callerMethod, fmt.Sprintf("Error storing response for key %s: %s", record.IdempotencyKey, err.Error()))
+	}
+}
+
+// lockIdempotencyKey claims the key for a new request. If the key was already used it
+// returns the stored record for a finished request with the same body, or an error.
+func lockIdempotencyKey(record *idempotencyRecord, now time.Time) (*idempotencyRecord, error) {
+	record.CreatedAt = now.Unix()
+	record.ExpiresAt = now.Add(idempotencyLockTimeout).Unix()
+	av, err := dynamodbattribute.MarshalMap(record)
+	if err != nil {
+		return nil, err
+	}
+
+	// DynamoDB's TTL deletes expired keys lazily, so treat them as gone ourselves
+	input := &dynamodb.PutItemInput{
+		TableName:           aws.String("daria_idempotency_keys"),
+		Item:                av,
+		ConditionExpression: aws.String("attribute_not_exists(idempotencyKey) OR expiresAt < :now"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": {
+				N: aws.String(strconv.FormatInt(now.Unix(), 10)),
+			},
+		},
+	}
+	_, err = db.svc.PutItem(input)
+	if err == nil {
+		return nil, nil
+	}
+	if !isConditionalCheckFailed(err) {
+		return nil, err
+	}
+
+	result, err := db.svc.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String("daria_idempotency_keys"),
+		Key: map[string]*dynamodb.AttributeValue{
+			"idempotencyKey": {
+				S: aws.String(record.IdempotencyKey),
+			},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.Item == nil {
+		// Released between our write and read
+		return nil, errIdempotencyKeyInUse
+	}
+	var existing idempotencyRecord
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &existing); err != nil {
+		return nil, err
+	}
+	if existing.RequestHash != record.RequestHash {
+		return nil, errIdempotencyKeyMismatch
+	}
+	if existing.StatusCode == 0 {
+		return nil, errIdempotencyKeyInUse
+	}
+	return &existing, nil
+}
+
+// refreshIdempotencyLock renews the lock on record's key until the returned function is
+// called, which waits for any renewal in flight. It gives up if the lock is lost.
+func refreshIdempotencyLock(record *idempotencyRecord) func() {
+	timer := clock.NewTimer(idempotencyLockRefresh)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		defer timer.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-timer.C():
+			}
+			if err := extendIdempotencyLock(record, clock.Now()); err != nil {
+				log("refreshIdempotencyLock", fmt.Sprintf("Error renewing the lock on key %s: %s", record.IdempotencyKey, err.Error()))
+				if isConditionalCheckFailed(err) {
+					return
+				}
+			}
+			timer.Reset(idempotencyLockRefresh)
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// extendIdempotencyLock pushes back the expiry of our own in-progress lock.
+func extendIdempotencyLock(record *idempotencyRecord, now time.Time) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String("daria_idempotency_keys"),
+		Key: map[string]*dynamodb.AttributeValue{
+			"idempotencyKey": {
+				S: aws.String(record.IdempotencyKey),
+			},
+		},
+		UpdateExpression:    aws.String("SET expiresAt = :exp"),
+		ConditionExpression: aws.String("requestHash = :hash AND attribute_not_exists(statusCode) AND createdAt = :created"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":exp": {
+				N: aws.String(strconv.FormatInt(now.Add(idempotencyLockTimeout).Unix(), 10)),
+			},
+			":hash": {
+				S: aws.String(record.RequestHash),
+			},
+			":created": {
+				N: aws.String(strconv.FormatInt(record.CreatedAt, 10)),
+			},
+		},
+	}
+	_, err := db.svc.UpdateItem(input)
+	return err
+}
+
+// completeIdempotencyKey stores the response to replay and keeps the key for the retention window.
+func completeIdempotencyKey(record *idempotencyRecord, status int, body string, now time.Time) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String("daria_idempotency_keys"),
+		Key: map[string]*dynamodb.AttributeValue{
+			"idempotencyKey": {
+				S: aws.String(record.IdempotencyKey),
+			},
+		},
+		UpdateExpression:    aws.String("SET statusCode = :status, responseBody = :body, expiresAt = :exp"),
+		ConditionExpression: aws.String("requestHash = :hash"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":status": {
+				N: aws.String(strconv.Itoa(status)),
+			},
+			":body": {
+				S: aws.String(body),
+			},
+			":exp": {
+				N: aws.String(strconv.FormatInt(now.Add(config.IdempotencyRetention).Unix(), 10)),
+			},
+			":hash": {
+				S: aws.String(record.RequestHash),
+			},
+		},
+	}
+	_, err := db.svc.UpdateItem(input)
+	return err
+}
+
+func releaseIdempotencyKey(record *idempotencyRecord) error {
+	input := &dynamodb.DeleteItemInput{
+		TableName: aws.String("daria_idempotency_keys"),
+		Key: map[string]*dynamodb.AttributeValue{
+			"idempotencyKey": {
+				S: aws.String(record.IdempotencyKey),
+			},
+		},
+		// Only our own in-progress lock
+		ConditionExpression: aws.String("requestHash = :hash AND attribute_not_exists(statusCode) AND createdAt = :created"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":hash": {
+				S: aws.String(record.RequestHash),
+			},
+			":created": {
+				N: aws.String(strconv.FormatInt(record.CreatedAt, 10)),
+			},
+		},
+	}
+	_, err := db.svc.DeleteItem(input)
+	return err
+}
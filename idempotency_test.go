@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"daria.com/jobScheduler/api"
+	"daria.com/jobScheduler/scheduler"
+	"github.com/gin-gonic/gin"
+)
+
+// fakeIdempotencyKeys stands in for daria_idempotency_keys and evaluates the conditions
+// idempotency.go writes with.
+type fakeIdempotencyKeys struct {
+	mu        sync.Mutex
+	items     map[string]map[string]fakeAttribute
+	renewals  int
+	completes int
+}
+
+func (f *fakeIdempotencyKeys) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target, req, ok := decodeFakeRequest(w, r)
+	if !ok {
+		return
+	}
+	values := req.ExpressionAttributeValues
+	number := func(attr fakeAttribute) int64 {
+		n, _ := strconv.ParseInt(attr.N, 10, 64)
+		return n
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := req.Key["idempotencyKey"].S
+	item := f.items[key]
+	// requestHash = :hash [AND attribute_not_exists(statusCode) AND createdAt = :created]
+	ours := func() bool {
+		if item == nil || item["requestHash"].S != values[":hash"].S {
+			return false
+		}
+		if strings.Contains(req.ConditionExpression, "attribute_not_exists(statusCode)") {
+			_, done := item["statusCode"]
+			return !done && item["createdAt"].N == values[":created"].N
+		}
+		return true
+	}
+
+	switch target {
+	case "DynamoDB_20120810.PutItem":
+		key = req.Item["idempotencyKey"].S
+		// attribute_not_exists(idempotencyKey) OR expiresAt < :now
+		if existing, ok := f.items[key]; ok && number(existing["expiresAt"]) >= number(values[":now"]) {
+			writeConditionalCheckFailed(w)
+			return
+		}
+		f.items[key] = req.Item
+	case "DynamoDB_20120810.GetItem":
+		json.NewEncoder(w).Encode(map[string]interface{}{"Item": item})
+		return
+	case "DynamoDB_20120810.UpdateItem":
+		if !ours() {
+			writeConditionalCheckFailed(w)
+			return
+		}
+		if status, ok := values[":status"]; ok {
+			f.completes++
+			item["statusCode"], item["responseBody"] = status, values[":body"]
+		} else {
+			f.renewals++
+		}
+		item["expiresAt"] = values[":exp"]
+	case "DynamoDB_20120810.DeleteItem":
+		if !ours() {
+			writeConditionalCheckFailed(w)
+			return
+		}
+		delete(f.items, key)
+	default:
+		writeFakeError(w, "ValidationException", "unexpected call to "+target)
+		return
+	}
+	w.Write([]byte(`{}`))
+}
+
+func (f *fakeIdempotencyKeys) renewed() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.renewals
+}
+
+// idempotencyServer serves POST /v1/tasks for user_1 through idempotencyMiddleware.
+// handler stands in for createTask.
+type idempotencyServer struct {
+	router *gin.Engine
+	keys   *fakeIdempotencyKeys
+	clock  *scheduler.FakeClock
+	calls  atomic.Int32
+}
+
+func newIdempotencyServer(t *testing.T, handler gin.HandlerFunc) *idempotencyServer {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	s := &idempotencyServer{
+		router: gin.New(),
+		keys:   &fakeIdempotencyKeys{items: make(map[string]map[string]fakeAttribute)},
+		clock:  scheduler.NewFakeClock(time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)),
+	}
+	useFakeDynamoDB(t, s.keys)
+	savedConfig, savedClock := config, clock
+	config.IdempotencyRetention = 24 * time.Hour
+	clock = s.clock
+	t.Cleanup(func() { config, clock = savedConfig, savedClock })
+
+	s.router.POST("/v1/tasks", func(c *gin.Context) { c.Set("userId", "user_1") }, idempotencyMiddleware, func(c *gin.Context) {
+		s.calls.Add(1)
+		handler(c)
+	})
+	return s
+}
+
+func (s *idempotencyServer) post(key string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/v1/tasks", strings.NewReader(body))
+	req.Header.Set("Idempotency-Key", key)
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	return w
+}
+
+func errorCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var body api.ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("response %q is not an error: %v", w.Body.String(), err)
+	}
+	return body.Error.Code
+}
+
+func TestIdempotencyReplay(t *testing.T) {
+	s := newIdempotencyServer(t, func(c *gin.Context) {
+		c.JSON(http.StatusOK, api.CreateTaskResult{TaskID: "task_" + strconv.Itoa(int(time.Now().UnixNano()))})
+	})
+
+	first := s.post("key-1", `{"apiURL":"https://example.com"}`)
+	if first.Code != http.StatusOK {
+		t.Fatalf("first request: %d %s", first.Code, first.Body)
+	}
+	s.clock.Advance(time.Hour)
+	replay := s.post("key-1", `{"apiURL":"https://example.com"}`)
+	if replay.Code != http.StatusOK || replay.Body.String() != first.Body.String() || replay.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("replay = %d %s (replayed %q); want the first response %s", replay.Code, replay.Body, replay.Header().Get("Idempotent-Replayed"), first.Body)
+	}
+	if calls := s.calls.Load(); calls != 1 {
+		t.Fatalf("handler ran %d times; want once", calls)
+	}
+
+	other := s.post("key-2", `{"apiURL":"https://example.com"}`)
+	if other.Code != http.StatusOK || other.Body.String() == first.Body.String() || s.calls.Load() != 2 {
+		t.Fatalf("another key got %d %s; want a new response", other.Code, other.Body)
+	}
+
+	// The key is forgotten after the retention window
+	s.clock.Advance(25 * time.Hour)
+	if again := s.post("key-1", `{"apiURL":"https://example.com"}`); again.Header().Get("Idempotent-Replayed") != "" || s.calls.Load() != 3 {
+		t.Fatalf("a key past its retention was replayed: %d %s", again.Code, again.Body)
+	}
+}
+
+func TestIdempotencyMismatch(t *testing.T) {
+	s := newIdempotencyServer(t, func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{}) })
+
+	s.post("key-1", `{"apiURL":"https://example.com/a"}`)
+	w := s.post("key-1", `{"apiURL":"https://example.com/b"}`)
+	if w.Code != http.StatusUnprocessableEntity || errorCode(t, w) != codeIdempotencyMismatch {
+		t.Fatalf("reusing a key for another body = %d %s; want 422 %s", w.Code, w.Body, codeIdempotencyMismatch)
+	}
+	if calls := s.calls.Load(); calls != 1 {
+		t.Fatalf("handler ran %d times; want once", calls)
+	}
+}
+
+func TestIdempotencyFailureReleasesKey(t *testing.T) {
+	status := http.StatusBadRequest
+	s := newIdempotencyServer(t, func(c *gin.Context) { c.JSON(status, gin.H{}) })
+
+	if w := s.post("key-1", `{}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("first request: %d", w.Code)
+	}
+	status = http.StatusOK
+	if w := s.post("key-1", `{}`); w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" || s.calls.Load() != 2 {
+		t.Fatalf("retry after a failure = %d %s; want it to run again", w.Code, w.Body)
+	}
+}
+
+// TestIdempotencyInProgress holds the first request in its handler, as a long batch
+// would, well past idempotencyLockTimeout.
+func TestIdempotencyInProgress(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	s := newIdempotencyServer(t, func(c *gin.Context) {
+		started <- struct{}{}
+		<-release
+		c.JSON(http.StatusOK, api.CreateTaskResult{TaskID: "task_1"})
+	})
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- s.post("key-1", `{}`) }()
+	<-started
+
+	w := s.post("key-1", `{}`)
+	if w.Code != http.StatusConflict || errorCode(t, w) != codeIdempotencyInProgress {
+		t.Fatalf("a retry while the first request runs = %d %s; want 409 %s", w.Code, w.Body, codeIdempotencyInProgress)
+	}
+
+	// The lock is renewed while the handler runs, so it outlives idempotencyLockTimeout
+	deadline := time.Now().Add(5 * time.Second)
+	for end := s.clock.Now().Add(3 * idempotencyLockTimeout); s.clock.Now().Before(end); {
+		s.clock.Advance(time.Second)
+		time.Sleep(time.Millisecond) // let the renewal run
+		if time.Now().After(deadline) {
+			t.Fatal("timed out advancing the clock")
+		}
+	}
+	if renewals := s.keys.renewed(); renewals < 6 {
+		t.Fatalf("lock renewed %d times in %s; want every %s", renewals, 3*idempotencyLockTimeout, idempotencyLockRefresh)
+	}
+	if w := s.post("key-1", `{}`); w.Code != http.StatusConflict {
+		t.Fatalf("a retry after %s of a running request = %d %s; want 409", 3*idempotencyLockTimeout, w.Code, w.Body)
+	}
+
+	close(release)
+	if first := <-done; first.Code != http.StatusOK {
+		t.Fatalf("first request: %d %s", first.Code, first.Body)
+	}
+	renewals := s.keys.renewed()
+	s.clock.Advance(time.Hour)
+	if w := s.post("key-1", `{}`); w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("retry after the first request finished = %d %s; want the replay", w.Code, w.Body)
+	}
+	if calls, after := s.calls.Load(), s.keys.renewed(); calls != 1 || after != renewals {
+		t.Fatalf("handler ran %d times and the lock was renewed %d times after the request; want once and none", calls, after-renewals)
+	}
+}
@@ -2,21 +2,35 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"time"
+
+	"daria.com/jobScheduler/api"
 )
 
 type JobExecutionResult struct {
 	Status      string        // Status of the job execution (success or failure)
 	Error       error         // Any error encountered during execution
 	ElapsedTime time.Duration // Time taken to execute the job
+	StatusCode  int           // HTTP status of the response, if one arrived
+	Response    *api.ResponseSnapshot
 }
 
-func jobExecutor(jobId string) bool {
+// taskExecutor runs tasks stored in daria_tasks on behalf of the scheduler.
+type taskExecutor struct{}
+
+func (taskExecutor) Execute(ctx context.Context, taskID string) (time.Time, bool) {
+	return jobExecutor(ctx, taskID)
+}
+
+// jobExecutor runs the task and records the execution. It returns the task's next run
+// time, or false if it should not run again.
+func jobExecutor(ctx context.Context, jobId string) (time.Time, bool) {
 	startTime := time.Now()
 	callerMethod := "jobExecutor"
 	log(callerMethod, "Start")
@@ -24,36 +38,123 @@ func jobExecutor(jobId string) bool {
 		endLog(callerMethod, startTime)
 	}()
 
-	if isTaskDeleted(jobId) {
-		log(callerMethod, fmt.Sprintf("Not executing since jobId:%s is deleted.", jobId))
-		return true
+	if !ownsTask(jobId) {
+		// Queued before a rebalance moved the task to another node
+		log(callerMethod, fmt.Sprintf("jobId:%s belongs to another shard", jobId))
+		return time.Time{}, false
 	}
 
 	task, err := getTaskFromDB(jobId)
 	if err != nil {
 		log(callerMethod, err.Error())
-		return false
+		return time.Time{}, false
+	}
+
+	if task.TotalExecutions >= maxExecutions {
+		log(callerMethod, fmt.Sprintf("jobId:%s has already run %d times", jobId, task.TotalExecutions))
+		return time.Time{}, false
+	}
+	if task.Paused {
+		// Resuming queues it again
+		log(callerMethod, fmt.Sprintf("jobId:%s is paused", jobId))
+		return time.Time{}, false
+	}
+	now := clock.Now()
+	if !isDue(task, now) {
+		// The queue is behind the table, e.g. another instance already ran this occurrence
+		log(callerMethod, fmt.Sprintf("jobId:%s is not due until %s", jobId, task.NextExecution))
+		return task.NextExecution, true
+	}
+
+	// Take the run's rate limit tokens before claiming it; see rateLimit.go
+	wait, ready := waitForTokens(ctx, task, now)
+	if !ready {
+		if ctx.Err() != nil {
+			return time.Time{}, false
+		}
+		log(callerMethod, fmt.Sprintf("jobId:%s is held back by its %s rate limit until %s", jobId, wait.by, wait.ready.UTC().Format("2006-01-02 15:04:05")))
+		return wait.ready, true
+	}
+	now = clock.Now()
+
+	var fencingToken int64
+	var leaseEnd time.Time
+	if config.Mode != modeSingle {
+		fencingToken, err = claimExecution(task, now)
+		if errors.Is(err, errClaimHeld) {
+			return claimRecheckTime(task, now), true
+		}
+		if err != nil {
+			// Try again later rather than running unclaimed
+			return now.Add(config.LeaseDuration), true
+		}
+		leaseEnd = now.Add(config.LeaseDuration)
+	}
+
+	execution, created, err := beginExecution(task, now)
+	if err != nil {
+		// Without a journal entry a crash could not be recovered correctly, so don't run yet
+		return now.Add(config.LeaseDuration), true
+	}
+	if !created && (execution.State == executionDone ||
+		(execution.State == executionRunning && execution.DeliveryGuarantee == deliveryAtMostOnce)) {
+		// An earlier attempt at this run was interrupted after it may have reached the target
+		log(callerMethod, fmt.Sprintf("Not repeating %s execution %s of jobId:%s", execution.State, execution.ExecutionID, jobId))
+		reschedule, err := skipExecution(task, execution, fencingToken, "abandoned")
+		if err != nil {
+			log(callerMethod, fmt.Sprintf("Not rescheduling jobId:%s: %s", jobId, err.Error()))
+			return time.Time{}, false
+		}
+		return task.NextExecution, reschedule
+	}
+	if !wait.since.IsZero() {
+		execution.RateLimitDelayMs = clock.Now().Sub(wait.since).Milliseconds()
+		execution.RateLimitedBy = wait.by
 	}
 
-	log(callerMethod, fmt.Sprintf("Task API URL: %s", task.APIURL))
-	log(callerMethod, fmt.Sprintf("Executing jobId:%s", jobId))
+	// A host whose circuit breaker is open is not called; the run is recorded and the task
+	// moves on to its next run
+	host := targetHost(task.APIURL)
+	var pass breakerPass
+	var breakerErr error
 	if task.APIMethod == "POST" {
-		executePOSTRequest(*task)
+		pass, breakerErr = allowCall(host, clock.Now())
 	}
-	task.LastExecution = time.Now()
-	task.TotalExecutions += 1
-	if task.TotalExecutions != 30 {
-		nextExecution := time.Now().Add(time.Duration(task.Frequency) * time.Second)
-		newJob := Job{
-			ID:   task.TaskID,
-			Time: nextExecution.Unix(),
+	result := JobExecutionResult{Status: "skipped"}
+	if breakerErr != nil {
+		log(callerMethod, fmt.Sprintf("Short-circuiting jobId:%s: %s", jobId, breakerErr.Error()))
+		result = JobExecutionResult{Status: outcomeShortCircuited, Error: breakerErr}
+	} else {
+		if err := markExecutionRunning(execution, clock.Now()); err != nil {
+			log(callerMethod, fmt.Sprintf("Error journalling jobId:%s: %s", jobId, err.Error()))
+			if task.APIMethod == "POST" {
+				releaseCall(pass)
+			}
+			return now.Add(config.LeaseDuration), true
+		}
+
+		log(callerMethod, fmt.Sprintf("Task API URL: %s", task.APIURL))
+		log(callerMethod, fmt.Sprintf("Executing jobId:%s", jobId))
+		if task.APIMethod == "POST" {
+			result, execution.Attempts = callTask(ctx, task, execution.ExecutionID, pass, leaseEnd)
 		}
-		addToHeap(newJob)
-		task.NextExecution = nextExecution
 	}
-	updateTaskInDb(task)
+	if result.Status == "failure" {
+		saveDeadLetter(task, execution, result)
+	}
+	previousFailures := task.ConsecutiveFailures
+	countFailures(task, result.Status)
+	reschedule := recordExecution(task, clock.Now())
+	if err := updateTaskInDb(task, fencingToken); err != nil {
+		// The task was deleted or taken over while executing, or the write failed; either way don't re-queue it
+		log(callerMethod, fmt.Sprintf("Not rescheduling jobId:%s: %s", jobId, err.Error()))
+		finishExecution(execution, clock.Now(), result.Status, err)
+		return time.Time{}, false
+	}
+	finishExecution(execution, clock.Now(), result.Status, result.Error)
+	notifyRun(*task, execution, result, previousFailures, !reschedule)
 
-	return true
+	return task.NextExecution, reschedule
 }
 
 //DO NOT DELETE!!
@@ -90,7 +191,80 @@ func jobExecutor(jobId string) bool {
 // 	return Task{} // Task not found
 // }
 
-func executePOSTRequest(task Task) JobExecutionResult {
+// isDue reports whether the task's stored next run has arrived.
+func isDue(task *Task, now time.Time) bool {
+	return !task.NextExecution.After(now)
+}
+
+// callTask calls the task's API for a run the host's breaker let through with pass. A
+// failed call of an at-least-once task is retried, up to config.MaxAttempts calls in all,
+// if it got no response, a 429 or a 5xx, the breaker still allows it, and the run's lease
+// (if it has one, ending at leaseEnd) leaves room for another call. It returns the last
+// call's result and how many calls were made.
+func callTask(ctx context.Context, task *Task, executionID string, pass breakerPass, leaseEnd time.Time) (JobExecutionResult, int) {
+	maxAttempts := config.MaxAttempts
+	if deliveryGuarantee(task) == deliveryAtMostOnce {
+		maxAttempts = 1
+	}
+	for attempt := 1; ; attempt++ {
+		result := executePOSTRequest(ctx, *task, executionID)
+		recordCall(pass, clock.Now(), result)
+		if result.Status != "failure" || attempt >= maxAttempts || !retryable(result) {
+			return result, attempt
+		}
+
+		backoff := retryBackoff << (attempt - 1)
+		if !leaseEnd.IsZero() && clock.Now().Add(backoff+requestTimeout).After(leaseEnd) {
+			log("callTask", fmt.Sprintf("Not retrying jobId:%s: its lease would run out", task.TaskID))
+			return result, attempt
+		}
+		log("callTask", fmt.Sprintf("Attempt %d of jobId:%s failed, retrying in %s: %s", attempt, task.TaskID, backoff, result.Error.Error()))
+		if !sleepContext(ctx, backoff) {
+			return result, attempt
+		}
+		var err error
+		if pass, err = allowCall(pass.host, clock.Now()); err != nil {
+			log("callTask", fmt.Sprintf("Not retrying jobId:%s: %s", task.TaskID, err.Error()))
+			return result, attempt
+		}
+	}
+}
+
+// retryable reports whether a failed call might succeed if made again.
+func retryable(result JobExecutionResult) bool {
+	return result.StatusCode == 0 || result.StatusCode == http.StatusTooManyRequests ||
+		result.StatusCode >= http.StatusInternalServerError
+}
+
+// sleepContext waits for d, or returns false if ctx is cancelled first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := clock.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// recordExecution updates the task for a run finishing at now and computes its next run.
+// It reports whether the task should run again. The simulator uses it too, so it must
+// stay free of I/O.
+func recordExecution(task *Task, now time.Time) bool {
+	task.LastExecution = now
+	task.TotalExecutions += 1
+	if task.TotalExecutions >= maxExecutions {
+		return false
+	}
+	task.NextExecution = now.Add(time.Duration(task.Frequency) * time.Second)
+	return true
+}
+
+// executePOSTRequest calls the task's API. ctx is only cancelled when a shutdown gives up
+// waiting for the execution. executionID is sent as the idempotency key; it is the same for
+// every attempt at a run, whether retried, recovered or taken over by another instance.
+func executePOSTRequest(ctx context.Context, task Task, executionID string) JobExecutionResult {
 	startTime := time.Now()
 	callerMethod := "executePOSTRequest"
 	log(callerMethod, "Start")
@@ -98,18 +272,34 @@ func executePOSTRequest(task Task) JobExecutionResult {
 		endLog(callerMethod, startTime)
 	}()
 
-	result := JobExecutionResult{} // Initialize the result struct
-
 	if task.APIMethod != "POST" {
 		// Set status to failure and return
-		result.Status = "failure"
-		result.Error = errors.New("API method is not POST")
-		result.ElapsedTime = time.Since(startTime)
-		return result
+		return JobExecutionResult{Status: "failure", Error: errors.New("API method is not POST")}
 	}
+	return sendRequest(ctx, task.UserID, taskRequest(task, executionID))
+}
+
+// taskRequest is the call a run of the task makes.
+func taskRequest(task Task, executionID string) api.RequestSnapshot {
+	return api.RequestSnapshot{
+		Method: task.APIMethod,
+		URL:    task.APIURL,
+		Headers: map[string]string{
+			"Content-Type":           "application/json",
+			config.IdempotencyHeader: executionID,
+		},
+		Body: task.APIBody,
+	}
+}
+
+// sendRequest makes the call on behalf of userID. Any response but a 2xx is a failure.
+func sendRequest(ctx context.Context, userID string, request api.RequestSnapshot) JobExecutionResult {
+	startTime := time.Now()
+	callerMethod := "sendRequest"
+	result := JobExecutionResult{} // Initialize the result struct
 
 	// Marshal the API body into a JSON string
-	reqBodyJSON, err := json.Marshal(task.APIBody)
+	reqBodyJSON, err := json.Marshal(request.Body)
 	if err != nil {
 		result.Status = "failure"
 		result.Error = fmt.Errorf("error marshalling API body: %v", err)
@@ -121,17 +311,20 @@ func executePOSTRequest(task Task) JobExecutionResult {
 	reqBody := bytes.NewBuffer(reqBodyJSON)
 
 	// Create the HTTP request
-	req, err := http.NewRequest("POST", task.APIURL, reqBody)
+	req, err := http.NewRequestWithContext(ctx, request.Method, request.URL, reqBody)
 	if err != nil {
 		result.Status = "failure"
 		result.Error = fmt.Errorf("error creating request: %v", err)
 		result.ElapsedTime = time.Since(startTime)
 		return result
 	}
-	req.Header.Set("Content-Type", "application/json")
+	for name, value := range request.Headers {
+		req.Header.Set(name, value)
+	}
 
-	// Execute the HTTP request
-	client := &http.Client{}
+	// Execute the HTTP request; targetTransport refuses addresses the owner may not call
+	req = req.WithContext(withTargetAllowlist(req.Context(), userID))
+	client := &http.Client{Timeout: requestTimeout, Transport: targetTransport}
 	resp, err := client.Do(req)
 	if err != nil {
 		result.Status = "failure"
@@ -148,12 +341,23 @@ func executePOSTRequest(task Task) JobExecutionResult {
 		result.ElapsedTime = time.Since(startTime)
 		return result
 	}
+	result.StatusCode = resp.StatusCode
+	result.Response = &api.ResponseSnapshot{StatusCode: resp.StatusCode, Body: string(body)}
+	if len(body) > maxSnapshotBody {
+		result.Response.Body = string(body[:maxSnapshotBody])
+		result.Response.Truncated = true
+	}
 
 	// Print the response status and body
 	log(callerMethod, fmt.Sprintf("Response Status: %s", resp.Status))
 	log(callerMethod, fmt.Sprintf("Response Body: %s", body))
 
-	result.Status = "success"
 	result.ElapsedTime = time.Since(startTime)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		result.Status = "failure"
+		result.Error = fmt.Errorf("target responded %s", resp.Status)
+		return result
+	}
+	result.Status = "success"
 	return result
 }
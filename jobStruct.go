@@ -1,6 +0,0 @@
-package main
-
-type Job struct {
-	ID   string
-	Time int64
-}
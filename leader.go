@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// In leader mode one row of daria_scheduler_leases names the replica allowed to run the
+// scheduler. The leader renews it every heartbeat; any other replica may take it over
+// once expiresAt has passed, so a dead leader is replaced within LeaderTTL plus one
+// heartbeat. Every replica serves the API either way: tasks created on a follower are
+// picked up by the leader's resync. A demoted leader lets its running executions finish,
+// so the leader still claims each run like claim mode does: its successor cannot run
+// the same task until the claim's lease runs out, and the old leader's final write fails
+// once the run has been claimed again.
+
+const leaderLeaseName = "heapProcessor"
+
+// leaderElector runs the election loop for this instance and calls onElected/onDemoted as
+// leadership changes hands.
+type leaderElector struct {
+	onElected func()
+	onDemoted func(ctx context.Context) // stops the scheduler, draining within ctx
+
+	isLeader    bool
+	lastRenewed time.Time
+}
+
+// run campaigns until a context arrives on stop, then releases the lease if held and
+// demotes itself, draining within that context.
+func (e *leaderElector) run(stop <-chan context.Context) {
+	callerMethod := "leaderElector"
+	timer := clock.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case ctx := <-stop:
+			if e.isLeader {
+				if err := releaseLeaderLease(); err != nil {
+					log(callerMethod, fmt.Sprintf("Error releasing leader lease: %s", err.Error()))
+				}
+				e.demote(ctx)
+			}
+			return
+		case <-timer.C():
+		}
+
+		now := clock.Now()
+		acquired, err := acquireLeaderLease(now)
+		switch {
+		case err != nil:
+			log(callerMethod, fmt.Sprintf("Error renewing leader lease: %s", err.Error()))
+			// Step down before the lease can expire under us and a standby takes over
+			if e.isLeader && now.Sub(e.lastRenewed) >= config.LeaderTTL-config.HeartbeatInterval {
+				e.demote(context.Background())
+			}
+		case acquired:
+			e.lastRenewed = now
+			if !e.isLeader {
+				log(callerMethod, fmt.Sprintf("%s is now the leader", config.InstanceID))
+				e.isLeader = true
+				e.onElected()
+			}
+		case e.isLeader:
+			log(callerMethod, fmt.Sprintf("%s lost the leader lease", config.InstanceID))
+			e.demote(context.Background())
+		}
+		timer.Reset(config.HeartbeatInterval)
+	}
+}
+
+func (e *leaderElector) demote(ctx context.Context) {
+	e.isLeader = false
+	e.onDemoted(ctx)
+}
+
+// acquireLeaderLease takes or renews the leader lease. It returns false, with no error,
+// if another instance holds an unexpired lease.
+func acquireLeaderLease(now time.Time) (bool, error) {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String("daria_scheduler_leases"),
+		Key: map[string]*dynamodb.AttributeValue{
+			"leaseName": {
+				S: aws.String(leaderLeaseName),
+			},
+		},
+		UpdateExpression:    aws.String("SET ownerId = :me, expiresAt = :exp, heartbeatAt = :now"),
+		ConditionExpression: aws.String("attribute_not_exists(leaseName) OR ownerId = :me OR expiresAt < :now"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":me": {
+				S: aws.String(config.InstanceID),
+			},
+			":exp": {
+				N: aws.String(strconv.FormatInt(now.Add(config.LeaderTTL).Unix(), 10)),
+			},
+			":now": {
+				N: aws.String(strconv.FormatInt(now.Unix(), 10)),
+			},
+		},
+	}
+
+	_, err := db.svc.UpdateItem(input)
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// releaseLeaderLease expires our lease immediately so a standby can take over without
+// waiting out the TTL.
+func releaseLeaderLease() error {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String("daria_scheduler_leases"),
+		Key: map[string]*dynamodb.AttributeValue{
+			"leaseName": {
+				S: aws.String(leaderLeaseName),
+			},
+		},
+		UpdateExpression:    aws.String("SET expiresAt = :zero"),
+		ConditionExpression: aws.String("ownerId = :me"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":me": {
+				S: aws.String(config.InstanceID),
+			},
+			":zero": {
+				N: aws.String("0"),
+			},
+		},
+	}
+
+	_, err := db.svc.UpdateItem(input)
+	if err != nil && !isConditionalCheckFailed(err) {
+		return err
+	}
+	return nil
+}
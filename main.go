@@ -1,28 +1,232 @@
 package main
 
 import (
-	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"daria.com/jobScheduler/scheduler"
 	"github.com/gin-gonic/gin"
 )
 
+var sched *scheduler.Scheduler // Global variable to hold the job scheduler
+
+// stopElection ends the leader election loop in leader mode, or the membership loop in
+// shard mode, and waits for it to hand over. A demoted leader drains its scheduler
+// within ctx.
+var stopElection func(ctx context.Context)
+
+// clock is the source of time for scheduling decisions. The simulator replaces it with
+// the FakeClock its scheduler runs on.
+var clock scheduler.Clock = scheduler.RealClock{}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		if err := runSimulation(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	gin.SetMode(gin.ReleaseMode)
 	executeBeforeStart()
 	r := gin.Default()
-	r.Use(apiKeyAuthMiddleware)
-	r.POST("/tasks", createTask)
-	r.DELETE("/tasks/:taskID", deleteTask)
-	r.Run(":8080")
-	select {}
+	r.Use(requestIDMiddleware)
+	r.NoRoute(routeNotFound)
+	r.GET("/openapi.json", getOpenAPI)
+	r.GET("/docs", getAPIDocs)
+
+	registerRoutes(r.Group("/v1"))
+	// The original unversioned routes, kept for existing clients until the sunset
+	registerRoutes(r.Group("", deprecationMiddleware(unversionedDeprecatedAt, unversionedSunset, "/v1")))
+
+	srv := &http.Server{Addr: ":8080", Handler: r}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log("main", fmt.Sprintf("Error serving API: %s", err.Error()))
+			os.Exit(1)
+		}
+	}()
+
+	// CodeDeploy restarts send SIGTERM; Ctrl-C sends SIGINT
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	<-ctx.Done()
+	shutdown(srv)
+}
+
+// registerRoutes adds the API's routes under the given group, once per API version.
+func registerRoutes(root *gin.RouterGroup) {
+	api := root.Group("", apiKeyAuthMiddleware)
+	api.POST("/tasks", idempotencyMiddleware, jobQuotaMiddleware(1), createTask)
+	api.POST("/tasks\\:batch", idempotencyMiddleware, jobQuotaMiddleware(1), createTaskBatch)
+	api.POST("/tasks\\:import", idempotencyMiddleware, jobQuotaMiddleware(1), importTasks)
+	api.GET("/tasks\\:export", exportTasks)
+	api.POST("/tasks\\:apply", applyManifest)
+	api.GET("/tasks", listTasks)
+	api.GET("/tasks/:taskID", getTask)
+	api.PATCH("/tasks/:taskID", updateTask)
+	api.DELETE("/tasks/:taskID", deleteTask)
+	api.POST("/tasks/:taskID/pause", pauseTask)
+	api.POST("/tasks/:taskID/resume", resumeTask)
+	api.POST("/tasks/:taskID/run", runTaskNow)
+	api.GET("/tasks/:taskID/history", getTaskHistory)
+	api.GET("/tasks/:taskID/logs", getTaskLogs)
+	api.GET("/dead-letters", getDeadLetters)
+	api.GET("/dead-letters/:deadLetterId", getDeadLetterByID)
+	api.POST("/dead-letters/:deadLetterId/replay", replayDeadLetter)
+	api.GET("/notification-rules", getNotificationRules)
+	api.POST("/notification-rules", createNotificationRule)
+	api.GET("/notification-rules/:ruleId", getNotificationRuleByID)
+	api.PUT("/notification-rules/:ruleId", updateNotificationRule)
+	api.DELETE("/notification-rules/:ruleId", deleteNotificationRule)
+	api.POST("/notification-rules/:ruleId/test", testNotificationRule)
+
+	admin := root.Group("/admin", adminAuthMiddleware)
+	admin.GET("/shards", getShards)
+	admin.GET("/breakers", getBreakers)
+	admin.GET("/outbox", getOutbox)
+	admin.DELETE("/outbox", clearOutbox)
+	admin.GET("/users/:userId/allowlist", getTargetAllowlist)
+	admin.PUT("/users/:userId/allowlist", putTargetAllowlist)
+	admin.GET("/users/:userId/rate-limit", getRateLimit)
+	admin.PUT("/users/:userId/rate-limit", putRateLimit)
+	admin.DELETE("/users/:userId/rate-limit", deleteRateLimit)
+	admin.GET("/hosts/:host/rate-limit", getRateLimit)
+	admin.PUT("/hosts/:host/rate-limit", putRateLimit)
+	admin.DELETE("/hosts/:host/rate-limit", deleteRateLimit)
+	admin.GET("/hosts/:host/breaker", getBreaker)
+	admin.POST("/hosts/:host/breaker/reset", resetBreaker)
 }
 
 func executeBeforeStart() {
 	clearLogFile("logfile.txt")
 	log("executeBeforeStart", "Starting executeBeforeStart")
+	var err error
+	if config, err = loadConfig(); err != nil {
+		log("executeBeforeStart", fmt.Sprintf("Error loading config: %s", err.Error()))
+		os.Exit(1)
+	}
+	log("executeBeforeStart", fmt.Sprintf("Mode: %s, InstanceID: %s, Queue: %s", config.Mode, config.InstanceID, config.Queue))
 	initializeDb()
-	jobQueue = make(jobHeap, 0)
-	heap.Init(&jobQueue)
-	go heapProcessor()
-	loadExistingJobs()
+
+	queue, _ := scheduler.NewQueue(config.Queue, clock.Now().Unix()) // validated by loadConfig
+	options := scheduler.Options{
+		Store:    dynamoJobStore{},
+		Executor: taskExecutor{},
+		Clock:    clock,
+		Logger:   log,
+		MaxSleep: waitTime * time.Minute,
+		Queue:    queue,
+	}
+	if config.Mode != modeSingle {
+		// Other replicas create tasks too, and take over ours if we die
+		options.ResyncInterval = config.ResyncInterval
+	}
+	if config.Mode == modeShard {
+		options.Store = shardJobStore{}
+	}
+	sched = scheduler.New(options)
+
+	if config.Mode == modeLeader {
+		startLeaderElection()
+		return
+	}
+	if config.Mode == modeShard {
+		if err := joinShardRing(); err != nil {
+			log("executeBeforeStart", fmt.Sprintf("Error joining the shard ring: %s", err.Error()))
+			os.Exit(1)
+		}
+	}
+	if err := recoverExecutions(); err != nil {
+		// Unsettled runs are still reconciled by the executor when their tasks come due
+		log("executeBeforeStart", fmt.Sprintf("Error recovering executions: %s", err.Error()))
+	}
+	if err := sched.Start(context.Background()); err != nil {
+		// Without the existing jobs the scheduler would silently skip them, so fail the deployment instead
+		log("executeBeforeStart", fmt.Sprintf("Error starting scheduler: %s", err.Error()))
+		os.Exit(1)
+	}
+	if config.Mode == modeShard {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			runShardMembership(ctx)
+		}()
+		stopElection = func(context.Context) {
+			cancel()
+			<-done
+		}
+	}
+}
+
+// startLeaderElection runs the scheduler only while this instance holds the leader lease.
+// Starting the scheduler reloads the queue from daria_tasks, so a new leader picks up
+// where the old one stopped.
+func startLeaderElection() {
+	callerMethod := "startLeaderElection"
+	elector := &leaderElector{
+		onElected: func() {
+			if err := recoverExecutions(); err != nil {
+				log(callerMethod, fmt.Sprintf("Error recovering executions: %s", err.Error()))
+			}
+			if err := sched.Start(context.Background()); err != nil {
+				log(callerMethod, fmt.Sprintf("Error starting scheduler: %s", err.Error()))
+			}
+		},
+		onDemoted: func(ctx context.Context) {
+			// Losing the lease passes no deadline; shutting down passes its own
+			ctx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+			defer cancel()
+			if err := sched.Stop(ctx); err != nil {
+				log(callerMethod, fmt.Sprintf("Scheduler did not drain: %s", err.Error()))
+			}
+		},
+	}
+
+	stop := make(chan context.Context)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		elector.run(stop)
+	}()
+	stopElection = func(ctx context.Context) {
+		stop <- ctx
+		<-done
+	}
+}
+
+// shutdown stops accepting API requests, then stops dispatching jobs and waits for the
+// running executions to finish and persist, all within shutdownTimeout.
+func shutdown(srv *http.Server) {
+	callerMethod := "shutdown"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log(callerMethod, fmt.Sprintf("Error shutting down API: %s", err.Error()))
+	}
+	if stopElection != nil {
+		// Hands the leader lease or our shard over to the other replicas
+		stopElection(ctx)
+	}
+	if err := sched.Stop(ctx); err != nil {
+		log(callerMethod, fmt.Sprintf("Scheduler did not drain: %s", err.Error()))
+	}
+	if err := waitForNotifications(ctx); err != nil {
+		log(callerMethod, fmt.Sprintf("Notifications still in flight: %s", err.Error()))
+	}
 }
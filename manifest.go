@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"daria.com/jobScheduler/api"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// A manifest declares a user's named tasks. Applying it converges daria_tasks on the
+// manifest: tasks it names are created or updated, and named tasks it no longer lists are
+// deleted. Tasks without a name were not created from a manifest and are left alone.
+
+type taskManifest = api.Manifest
+
+// Actions in a manifest plan
+const (
+	planCreate    = "create"
+	planUpdate    = "update"
+	planDelete    = "delete"
+	planUnchanged = "unchanged"
+)
+
+// plannedChange is a line of the plan along with what applying it needs.
+type plannedChange struct {
+	api.PlannedChange
+	input CreateTaskInput
+	task  *Task
+}
+
+// applyManifest handles POST /tasks:apply. With ?dryRun=true it only returns the plan.
+func applyManifest(c *gin.Context) {
+	callerMethod := "applyManifest"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "Failed to read request body")
+		return
+	}
+	manifest, err := parseManifest(body, c.ContentType())
+	if err != nil {
+		respondInvalid(c, err)
+		return
+	}
+	if len(manifest.Tasks) > maxBatchTasks {
+		respondError(c, http.StatusRequestEntityTooLarge, codePayloadTooLarge, fmt.Sprintf("A manifest may declare at most %d tasks", maxBatchTasks))
+		return
+	}
+
+	userID := c.GetString("userId")
+	var blocked fieldErrors
+	for i, input := range manifest.Tasks {
+		err := targetFieldError(fmt.Sprintf("tasks[%d].apiURL", i), checkTargetURL(c.Request.Context(), userID, input.APIURL))
+		var errs fieldErrors
+		if errors.As(err, &errs) {
+			blocked = append(blocked, errs...)
+		} else if err != nil {
+			respondTargetError(c, "apiURL", err)
+			return
+		}
+	}
+	if len(blocked) > 0 {
+		respondInvalid(c, blocked)
+		return
+	}
+
+	existing, err := listUserTasks(userID)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to read tasks")
+		return
+	}
+	plan, err := planManifest(manifest, existing)
+	if err != nil {
+		respondError(c, http.StatusConflict, codeNameTaken, err.Error())
+		return
+	}
+
+	dryRun := c.Query("dryRun") == "true"
+	if !dryRun {
+		applyPlan(userID, plan)
+	}
+
+	result := api.ApplyResult{
+		DryRun:  dryRun,
+		Summary: make(map[string]int),
+		Changes: make([]api.PlannedChange, 0, len(plan)),
+	}
+	for _, change := range plan {
+		result.Summary[change.Action]++
+		if change.Status == "failed" {
+			result.Failed++
+		}
+		result.Changes = append(result.Changes, change.PlannedChange)
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// parseManifest reads a JSON or YAML manifest and validates each task in it.
+func parseManifest(body []byte, contentType string) (taskManifest, error) {
+	var manifest taskManifest
+	if strings.Contains(contentType, "yaml") {
+		// Go through JSON so YAML manifests use the same field names and types
+		var document interface{}
+		if err := yaml.Unmarshal(body, &document); err != nil {
+			return manifest, fmt.Errorf("invalid YAML: %s", err.Error())
+		}
+		converted, err := json.Marshal(document)
+		if err != nil {
+			return manifest, fmt.Errorf("invalid YAML: %s", err.Error())
+		}
+		body = converted
+	}
+	if err := validateRequest("Manifest", body); err != nil {
+		return manifest, err
+	}
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return manifest, fmt.Errorf("invalid manifest: %s", err.Error())
+	}
+
+	seen := make(map[string]bool, len(manifest.Tasks))
+	for i, input := range manifest.Tasks {
+		if seen[input.Name] {
+			field := fmt.Sprintf("tasks[%d].name", i)
+			return manifest, fieldErrors{{Field: field, Code: "unique", Message: fmt.Sprintf("%s: duplicate name %q", field, input.Name)}}
+		}
+		seen[input.Name] = true
+	}
+	return manifest, nil
+}
+
+// planManifest diffs the manifest against the user's tasks. Deletes come first in the plan
+// so their slots are free for the creates. It fails if several of the tasks share a name,
+// since it cannot tell which of them the manifest means.
+func planManifest(manifest taskManifest, existing []Task) ([]plannedChange, error) {
+	byName := make(map[string]*Task)
+	plan := make([]plannedChange, 0, len(manifest.Tasks))
+
+	sort.Slice(existing, func(i, j int) bool { return existing[i].TaskID < existing[j].TaskID })
+	for i := range existing {
+		task := &existing[i]
+		if task.Name == "" {
+			continue
+		}
+		if other, ok := byName[task.Name]; ok {
+			return nil, fmt.Errorf("Tasks %s and %s are both named %q; rename or delete one of them before applying", other.TaskID, task.TaskID, task.Name)
+		}
+		byName[task.Name] = task
+	}
+
+	declared := make(map[string]bool, len(manifest.Tasks))
+	for _, input := range manifest.Tasks {
+		declared[input.Name] = true
+	}
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !declared[name] {
+			plan = append(plan, newPlannedChange(planDelete, name, byName[name]))
+		}
+	}
+
+	for _, input := range manifest.Tasks {
+		task, ok := byName[input.Name]
+		if !ok {
+			change := newPlannedChange(planCreate, input.Name, nil)
+			change.input = input
+			plan = append(plan, change)
+			continue
+		}
+		change := newPlannedChange(planUnchanged, input.Name, task)
+		change.input = input
+		if fields := changedFields(task, input); len(fields) > 0 {
+			change.Action = planUpdate
+			change.Fields = fields
+		}
+		plan = append(plan, change)
+	}
+	return plan, nil
+}
+
+func newPlannedChange(action string, name string, task *Task) plannedChange {
+	change := plannedChange{PlannedChange: api.PlannedChange{Action: action, Name: name}, task: task}
+	if task != nil {
+		change.TaskID = task.TaskID
+	}
+	return change
+}
+
+// changedFields lists the fields of the task that the input would change.
+func changedFields(task *Task, input CreateTaskInput) []string {
+	fields := make([]string, 0)
+	if task.APIMethod != input.APIMethod {
+		fields = append(fields, "apiMethod")
+	}
+	if task.APIURL != input.APIURL {
+		fields = append(fields, "apiURL")
+	}
+	if task.StartFrom != input.StartFrom {
+		fields = append(fields, "startFrom")
+	}
+	if task.Frequency != input.Frequency {
+		fields = append(fields, "frequency")
+	}
+	if !sameAPIBody(task.APIBody, input.APIBody) {
+		fields = append(fields, "apiBody")
+	}
+	if deliveryGuarantee(task) != deliveryGuarantee(&Task{DeliveryGuarantee: input.DeliveryGuarantee}) {
+		fields = append(fields, "deliveryGuarantee")
+	}
+	return fields
+}
+
+// sameAPIBody compares bodies by their JSON form, since numbers read back from DynamoDB
+// and from a manifest need not have the same Go types.
+func sameAPIBody(a, b map[string]interface{}) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	var normalA, normalB interface{}
+	encodedA, errA := json.Marshal(a)
+	encodedB, errB := json.Marshal(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+	json.Unmarshal(encodedA, &normalA)
+	json.Unmarshal(encodedB, &normalB)
+	return reflect.DeepEqual(normalA, normalB)
+}
+
+// applyPlan carries out the plan in order, recording each change's outcome on it.
+func applyPlan(userID string, plan []plannedChange) {
+	for i := range plan {
+		change := &plan[i]
+		var err error
+		switch change.Action {
+		case planUnchanged:
+			continue
+		case planDelete:
+			err = removeTask(change.task)
+			if errors.Is(err, errTaskNotFound) {
+				err = nil // Already gone
+			}
+		case planCreate:
+			firstRun, _ := time.Parse("2006-01-02 15:04:05", change.input.StartFrom)
+			change.TaskID, err = insertTask(userID, change.input, firstRun, 0)
+		case planUpdate:
+			err = updateTaskFromInput(change.task, change.input)
+		}
+		if err != nil {
+			log("applyPlan", fmt.Sprintf("Error applying %s of %s: %s", change.Action, change.Name, err.Error()))
+			change.Status = "failed"
+			change.Error = err.Error()
+			continue
+		}
+		change.Status = "applied"
+	}
+}
+
+// updateTaskFromInput changes an existing task to match the input. If its schedule
+// changed, the next run is recomputed: at startFrom if the task has not run yet or
+// startFrom is still ahead, otherwise one new period after the last run.
+func updateTaskFromInput(task *Task, input CreateTaskInput) error {
+	scheduleChanged := task.StartFrom != input.StartFrom || task.Frequency != input.Frequency
+	task.Name = input.Name
+	task.APIMethod = input.APIMethod
+	task.APIURL = input.APIURL
+	task.StartFrom = input.StartFrom
+	task.Frequency = input.Frequency
+	task.APIBody = input.APIBody
+	task.DeliveryGuarantee = input.DeliveryGuarantee
+	if scheduleChanged {
+		startFrom, _ := time.Parse("2006-01-02 15:04:05", input.StartFrom)
+		if task.TotalExecutions == 0 || startFrom.After(clock.Now()) {
+			task.NextExecution = startFrom
+		} else {
+			task.NextExecution = task.LastExecution.Add(time.Duration(task.Frequency) * time.Second)
+		}
+	}
+
+	if err := updateTaskDefinition(task); err != nil {
+		return err
+	}
+	if scheduleChanged && !task.Paused && ownsTask(task.TaskID) && task.TotalExecutions < maxExecutions {
+		sched.Schedule(task.TaskID, task.NextExecution)
+	}
+	return nil
+}
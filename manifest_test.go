@@ -0,0 +1,73 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func manifestTask(name string, url string) CreateTaskInput {
+	return CreateTaskInput{
+		Name:      name,
+		APIMethod: "POST",
+		APIURL:    url,
+		StartFrom: "2026-10-01 12:00:00",
+		Frequency: 3600,
+		APIBody:   map[string]interface{}{},
+	}
+}
+
+func existingTask(taskID string, input CreateTaskInput) Task {
+	return createTaskStruct(input, taskID, "user_1")
+}
+
+func TestPlanManifest(t *testing.T) {
+	existing := []Task{
+		existingTask("user_1_c", manifestTask("gone", "https://example.com/gone")),
+		existingTask("user_1_a", manifestTask("same", "https://example.com/same")),
+		existingTask("user_1_b", manifestTask("moved", "https://example.com/old")),
+		existingTask("user_1_d", manifestTask("", "https://example.com/unnamed")),
+	}
+	manifest := taskManifest{Tasks: []CreateTaskInput{
+		manifestTask("same", "https://example.com/same"),
+		manifestTask("moved", "https://example.com/new"),
+		manifestTask("new", "https://example.com/new"),
+	}}
+
+	plan, err := planManifest(manifest, existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, change := range plan {
+		got = append(got, change.Action+" "+change.Name+" "+change.TaskID)
+	}
+	want := []string{"delete gone user_1_c", "unchanged same user_1_a", "update moved user_1_b", "create new "}
+	if !slices.Equal(got, want) {
+		t.Fatalf("plan = %q; want %q", got, want)
+	}
+	if fields := plan[2].Fields; !slices.Equal(fields, []string{"apiURL"}) {
+		t.Fatalf("update changes %q; want apiURL", fields)
+	}
+}
+
+func TestPlanManifestRefusesDuplicateNames(t *testing.T) {
+	existing := []Task{
+		existingTask("user_1_b", manifestTask("nightly", "https://example.com/b")),
+		existingTask("user_1_a", manifestTask("nightly", "https://example.com/a")),
+		existingTask("user_1_c", manifestTask("other", "https://example.com/c")),
+	}
+	// Neither the manifest naming the task nor leaving it out may pick one to delete
+	for _, manifest := range []taskManifest{
+		{Tasks: []CreateTaskInput{manifestTask("nightly", "https://example.com/a")}},
+		{Tasks: []CreateTaskInput{manifestTask("other", "https://example.com/c")}},
+	} {
+		plan, err := planManifest(manifest, existing)
+		if err == nil {
+			t.Fatalf("planned %v for two tasks named nightly; want an error", plan)
+		}
+		if !strings.Contains(err.Error(), "user_1_a") || !strings.Contains(err.Error(), "user_1_b") {
+			t.Fatalf("error %q does not name both tasks", err)
+		}
+	}
+}
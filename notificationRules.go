@@ -0,0 +1,440 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"daria.com/jobScheduler/api"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Notification rules are kept in daria_notification_rules. A rule with a taskId watches
+// that task; one without watches all of its owner's tasks. See notifications.go for how
+// they are applied.
+
+// Notification channels
+const (
+	channelWebhook = "webhook"
+	channelEmail   = "email"
+)
+
+// Most notification rules a user may have
+const maxNotificationRules = 50
+
+// Used when a rule doesn't set dedupSeconds
+const defaultDedupSeconds = 3600
+
+var errNotificationRuleNotFound = errors.New("notification rule not found")
+
+func putNotificationRule(rule api.NotificationRule) error {
+	item, err := dynamodbattribute.MarshalMap(rule)
+	if err != nil {
+		return err
+	}
+	_, err = db.svc.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String("daria_notification_rules"),
+		Item:      item,
+	})
+	if err == nil {
+		forgetNotificationRules(rule.UserID)
+	}
+	return err
+}
+
+func getNotificationRule(ruleID string) (*api.NotificationRule, error) {
+	input := &dynamodb.GetItemInput{
+		TableName: aws.String("daria_notification_rules"),
+		Key: map[string]*dynamodb.AttributeValue{
+			"ruleId": {
+				S: aws.String(ruleID),
+			},
+		},
+		ConsistentRead: aws.Bool(true),
+	}
+	result, err := db.svc.GetItem(input)
+	if err != nil {
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, errNotificationRuleNotFound
+	}
+	var rule api.NotificationRule
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &rule); err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+func deleteNotificationRuleRecord(rule *api.NotificationRule) error {
+	_, err := db.svc.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String("daria_notification_rules"),
+		Key: map[string]*dynamodb.AttributeValue{
+			"ruleId": {
+				S: aws.String(rule.RuleID),
+			},
+		},
+	})
+	if err == nil {
+		forgetNotificationRules(rule.UserID)
+	}
+	return err
+}
+
+// listNotificationRules returns all the user's rules.
+func listNotificationRules(userID string) ([]api.NotificationRule, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String("daria_notification_rules"),
+		IndexName:              aws.String("userId-index"),
+		KeyConditionExpression: aws.String("userId = :u"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":u": {
+				S: aws.String(userID),
+			},
+		},
+	}
+
+	rules := make([]api.NotificationRule, 0)
+	err := db.svc.QueryPages(input, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			var rule api.NotificationRule
+			if err := dynamodbattribute.UnmarshalMap(item, &rule); err != nil {
+				log("listNotificationRules", fmt.Sprintf("Error unmarshalling rule: %s", err.Error()))
+				continue
+			}
+			rules = append(rules, rule)
+		}
+		return true
+	})
+	if err != nil {
+		log("listNotificationRules", err.Error())
+		return nil, err
+	}
+	return rules, nil
+}
+
+// recordDelivery saves the result of the rule's latest notification on the rule, unless
+// the rule was deleted meanwhile.
+func recordDelivery(ruleID string, delivery api.NotificationDelivery) error {
+	value, err := dynamodbattribute.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	_, err = db.svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String("daria_notification_rules"),
+		Key: map[string]*dynamodb.AttributeValue{
+			"ruleId": {
+				S: aws.String(ruleID),
+			},
+		},
+		UpdateExpression:          aws.String("SET lastDelivery = :d"),
+		ConditionExpression:       aws.String("attribute_exists(ruleId)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":d": value},
+	})
+	if isConditionalCheckFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// Every run needs its owner's rules, so they are cached like allowlists. Changes made
+// through this instance apply at once; other instances see them within
+// notificationRuleCacheTTL.
+const notificationRuleCacheTTL = time.Minute
+
+type cachedNotificationRules struct {
+	rules     []api.NotificationRule
+	expiresAt time.Time
+}
+
+var notificationRuleCache = struct {
+	sync.Mutex
+	entries map[string]cachedNotificationRules
+}{entries: make(map[string]cachedNotificationRules)}
+
+func loadNotificationRules(userID string) ([]api.NotificationRule, error) {
+	notificationRuleCache.Lock()
+	cached, ok := notificationRuleCache.entries[userID]
+	notificationRuleCache.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.rules, nil
+	}
+
+	rules, err := listNotificationRules(userID)
+	if err != nil {
+		return nil, err
+	}
+	notificationRuleCache.Lock()
+	notificationRuleCache.entries[userID] = cachedNotificationRules{rules: rules, expiresAt: time.Now().Add(notificationRuleCacheTTL)}
+	notificationRuleCache.Unlock()
+	return rules, nil
+}
+
+func forgetNotificationRules(userID string) {
+	notificationRuleCache.Lock()
+	delete(notificationRuleCache.entries, userID)
+	notificationRuleCache.Unlock()
+}
+
+// loadOwnedNotificationRule fetches the rule named in the path and checks that the caller
+// owns it. When it can't, it writes the error response and returns false.
+func loadOwnedNotificationRule(c *gin.Context) (*api.NotificationRule, bool) {
+	rule, err := getNotificationRule(c.Param("ruleId"))
+	if errors.Is(err, errNotificationRuleNotFound) {
+		respondError(c, http.StatusNotFound, codeNotFound, "Notification rule not found")
+		return nil, false
+	}
+	if err != nil {
+		log("loadOwnedNotificationRule", err.Error())
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to fetch the notification rule")
+		return nil, false
+	}
+	if rule.UserID != c.GetString("userId") {
+		respondError(c, http.StatusForbidden, codeForbidden, "You do not have permission to access this notification rule")
+		return nil, false
+	}
+	return rule, true
+}
+
+// bindNotificationRule validates the body of a create or replace and applies it to rule.
+// When it is invalid, it writes the error response and returns false.
+func bindNotificationRule(c *gin.Context, rule *api.NotificationRule) bool {
+	body, err := c.GetRawData()
+	if err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "Failed to read request body")
+		return false
+	}
+	if err := validateRequest("NotificationRuleInput", body); err != nil {
+		respondInvalid(c, err)
+		return false
+	}
+	var input api.NotificationRuleInput
+	if err := json.Unmarshal(body, &input); err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return false
+	}
+
+	// What the schema can't express: the fields the channel and events need
+	var errs fieldErrors
+	required := func(field string, why string) {
+		errs = append(errs, api.FieldError{Field: field, Code: "required", Message: fmt.Sprintf("%s is required %s", field, why)})
+	}
+	switch input.Channel {
+	case channelWebhook:
+		if input.WebhookURL == "" {
+			required("webhookUrl", "for the webhook channel")
+		}
+		input.EmailTo = nil
+	case channelEmail:
+		if len(input.EmailTo) == 0 {
+			required("emailTo", "for the email channel")
+		}
+		input.WebhookURL = ""
+	}
+	if slices.Contains(input.Events, eventConsecutiveFailures) {
+		if input.ConsecutiveFailures == 0 {
+			required("consecutiveFailures", "for the consecutiveFailures event")
+		}
+	} else {
+		input.ConsecutiveFailures = 0
+	}
+	if len(errs) > 0 {
+		respondInvalid(c, errs)
+		return false
+	}
+	if input.Channel == channelEmail && config.SMTPAddr == "" {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "Email notifications are not enabled on this server")
+		return false
+	}
+
+	userID := c.GetString("userId")
+	var task *Task
+	if input.TaskID != "" {
+		task, err = getTaskFromDB(input.TaskID)
+		if errors.Is(err, errTaskNotFound) {
+			respondError(c, http.StatusNotFound, codeNotFound, "Task not found")
+			return false
+		}
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, codeInternal, "Failed to fetch the task")
+			return false
+		}
+		if !verifyOwnership(task, userID) {
+			respondError(c, http.StatusForbidden, codeForbidden, "You do not have permission to access this task")
+			return false
+		}
+	}
+	if input.Channel == channelWebhook {
+		if err := checkTargetURL(c.Request.Context(), userID, input.WebhookURL); err != nil {
+			respondTargetError(c, "webhookUrl", err)
+			return false
+		}
+	}
+
+	rule.TaskID = input.TaskID
+	rule.Events = input.Events
+	rule.ConsecutiveFailures = input.ConsecutiveFailures
+	rule.Channel = input.Channel
+	rule.WebhookURL = input.WebhookURL
+	rule.EmailTo = input.EmailTo
+	rule.SubjectTemplate = input.SubjectTemplate
+	rule.BodyTemplate = input.BodyTemplate
+	rule.DedupSeconds = defaultDedupSeconds
+	if input.DedupSeconds != nil {
+		rule.DedupSeconds = *input.DedupSeconds
+	}
+	// Templates that fail on the sample would fail on every real notification too
+	if _, _, err := renderNotification(*rule, sampleNotification(*rule, task, clock.Now())); err != nil {
+		respondInvalid(c, err)
+		return false
+	}
+	return true
+}
+
+// getNotificationRules handles GET /notification-rules?taskId=.
+func getNotificationRules(c *gin.Context) {
+	callerMethod := "getNotificationRules"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	rules, err := listNotificationRules(c.GetString("userId"))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to read notification rules")
+		return
+	}
+	if taskID := c.Query("taskId"); taskID != "" {
+		rules = slices.DeleteFunc(rules, func(rule api.NotificationRule) bool { return rule.TaskID != taskID })
+	}
+	c.JSON(http.StatusOK, api.NotificationRuleList{Rules: rules})
+}
+
+// createNotificationRule handles POST /notification-rules.
+func createNotificationRule(c *gin.Context) {
+	callerMethod := "createNotificationRule"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	userID := c.GetString("userId")
+	now := clock.Now().UTC()
+	rule := api.NotificationRule{RuleID: uuid.NewString(), UserID: userID, CreatedAt: now, UpdatedAt: now}
+	if !bindNotificationRule(c, &rule) {
+		return
+	}
+	existing, err := listNotificationRules(userID)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to read notification rules")
+		return
+	}
+	if len(existing) >= maxNotificationRules {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("You can have at most %d notification rules", maxNotificationRules))
+		return
+	}
+	if err := putNotificationRule(rule); err != nil {
+		log(callerMethod, err.Error())
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to save the notification rule")
+		return
+	}
+	log(callerMethod, fmt.Sprintf("Created notification rule %s for %s", rule.RuleID, userID))
+	c.JSON(http.StatusOK, rule)
+}
+
+// getNotificationRuleByID handles GET /notification-rules/:ruleId.
+func getNotificationRuleByID(c *gin.Context) {
+	callerMethod := "getNotificationRuleByID"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	rule, ok := loadOwnedNotificationRule(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, rule)
+}
+
+// updateNotificationRule handles PUT /notification-rules/:ruleId, replacing the rule.
+func updateNotificationRule(c *gin.Context) {
+	callerMethod := "updateNotificationRule"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	rule, ok := loadOwnedNotificationRule(c)
+	if !ok {
+		return
+	}
+	if !bindNotificationRule(c, rule) {
+		return
+	}
+	rule.UpdatedAt = clock.Now().UTC()
+	if err := putNotificationRule(*rule); err != nil {
+		log(callerMethod, err.Error())
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to save the notification rule")
+		return
+	}
+	c.JSON(http.StatusOK, rule)
+}
+
+// deleteNotificationRule handles DELETE /notification-rules/:ruleId.
+func deleteNotificationRule(c *gin.Context) {
+	callerMethod := "deleteNotificationRule"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	rule, ok := loadOwnedNotificationRule(c)
+	if !ok {
+		return
+	}
+	if err := deleteNotificationRuleRecord(rule); err != nil {
+		log(callerMethod, err.Error())
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to delete the notification rule")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Notification rule deleted successfully"})
+}
+
+// testNotificationRule handles POST /notification-rules/:ruleId/test: it sends a sample
+// notification through the rule right away, ignoring de-duplication, and returns how it
+// went whether or not it was delivered.
+func testNotificationRule(c *gin.Context) {
+	callerMethod := "testNotificationRule"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	rule, ok := loadOwnedNotificationRule(c)
+	if !ok {
+		return
+	}
+	var task *Task
+	if rule.TaskID != "" {
+		// A rule can outlive its task; the sample then makes do without it
+		task, _ = getTaskFromDB(rule.TaskID)
+	}
+	delivery := deliverNotification(c.Request.Context(), *rule, sampleNotification(*rule, task, clock.Now()))
+	log(callerMethod, fmt.Sprintf("Test notification of rule %s: %s", rule.RuleID, orDelivered(delivery.Error)))
+	c.JSON(http.StatusOK, delivery)
+}
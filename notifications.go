@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"daria.com/jobScheduler/api"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/gin-gonic/gin"
+)
+
+// After a run is recorded, the rules of its owner that watch the task decide whether it
+// is worth a notification:
+//
+//	failure              the run failed or was short-circuited
+//	consecutiveFailures  the run was the rule's consecutiveFailures-th failure in a row
+//	recovery             the run succeeded after one or more failures
+//	completion           the task made its last run
+//
+// Each notification renders the rule's subject and body templates, or the defaults, and is
+// posted as JSON to the rule's webhook or emailed through config.SMTPAddr. The same event
+// for the same task is sent at most once per rule every dedupSeconds, across instances,
+// using daria_notification_log. Notifications are sent in the background; a shutdown waits
+// for those in flight.
+
+// Notification events
+const (
+	eventFailure             = "failure"
+	eventConsecutiveFailures = "consecutiveFailures"
+	eventRecovery            = "recovery"
+	eventCompletion          = "completion"
+	eventTest                = "test" // sent by POST /notification-rules/:ruleId/test
+)
+
+// smtpCapture as JOBSCHEDULER_SMTP_ADDR keeps emails in memory instead of sending them
+const smtpCapture = "capture"
+
+// Upper bound on delivering one notification
+const notifyTimeout = 30 * time.Second
+
+// How many captured emails the outbox keeps
+const maxCapturedEmails = 100
+
+var errEmailDisabled = errors.New("email notifications are not enabled on this server")
+
+var defaultSubjects = map[string]string{
+	eventFailure:             `[jobScheduler] {{or .TaskName .TaskID}} failed`,
+	eventConsecutiveFailures: `[jobScheduler] {{or .TaskName .TaskID}} failed {{.ConsecutiveFailures}} times in a row`,
+	eventRecovery:            `[jobScheduler] {{or .TaskName .TaskID}} recovered`,
+	eventCompletion:          `[jobScheduler] {{or .TaskName .TaskID}} made its last run`,
+	eventTest:                `[jobScheduler] Test notification for {{or .TaskName .TaskID}}`,
+}
+
+const defaultBody = `Task {{or .TaskName .TaskID}} ({{.TaskID}}): {{.Event}}
+Run {{.ExecutionID}}, scheduled for {{.ScheduledAt.Format "2006-01-02 15:04:05"}} UTC, ended {{.Outcome}}{{if .Error}}: {{.Error}}{{end}}
+{{if .ConsecutiveFailures}}Failed runs in a row: {{.ConsecutiveFailures}}
+{{end}}URL: {{.URL}}
+`
+
+// pendingNotifications counts the notifications being sent in the background.
+var pendingNotifications sync.WaitGroup
+
+// countFailures updates the task's failures in a row for a run that ended with outcome.
+// Skipped and abandoned runs leave it alone.
+func countFailures(task *Task, outcome string) {
+	switch outcome {
+	case "success":
+		task.ConsecutiveFailures = 0
+	case "failure", outcomeShortCircuited:
+		task.ConsecutiveFailures++
+	}
+}
+
+// notifyRun sends, in the background, the notifications the owner's rules ask for about a
+// recorded run. previousFailures is the task's failures in a row before the run, and last
+// is set if the task will not run again.
+func notifyRun(task Task, execution *executionRecord, result JobExecutionResult, previousFailures int, last bool) {
+	rules, err := loadNotificationRules(task.UserID)
+	if err != nil {
+		log("notifyRun", fmt.Sprintf("Error loading notification rules of %s: %s", task.UserID, err.Error()))
+		return
+	}
+	failed := result.Status == "failure" || result.Status == outcomeShortCircuited
+	now := clock.Now()
+	for _, rule := range rules {
+		if rule.TaskID != "" && rule.TaskID != task.TaskID {
+			continue
+		}
+		for _, event := range rule.Events {
+			var fires bool
+			switch event {
+			case eventFailure:
+				fires = failed
+			case eventConsecutiveFailures:
+				fires = failed && task.ConsecutiveFailures == rule.ConsecutiveFailures
+			case eventRecovery:
+				fires = result.Status == "success" && previousFailures > 0
+			case eventCompletion:
+				fires = last
+			}
+			if !fires {
+				continue
+			}
+			notification := api.Notification{
+				Event:               event,
+				RuleID:              rule.RuleID,
+				UserID:              task.UserID,
+				TaskID:              task.TaskID,
+				TaskName:            task.Name,
+				URL:                 task.APIURL,
+				ExecutionID:         execution.ExecutionID,
+				ScheduledAt:         time.Unix(execution.ScheduledAt, 0).UTC(),
+				Outcome:             result.Status,
+				ConsecutiveFailures: task.ConsecutiveFailures,
+				At:                  now.UTC(),
+			}
+			if result.Error != nil {
+				notification.Error = result.Error.Error()
+			}
+			pendingNotifications.Add(1)
+			go func(rule api.NotificationRule) {
+				defer pendingNotifications.Done()
+				sendNotification(rule, notification)
+			}(rule)
+		}
+	}
+}
+
+// sendNotification delivers a notification unless the rule sent the same one within its
+// dedup window, and records the result on the rule.
+func sendNotification(rule api.NotificationRule, notification api.Notification) {
+	callerMethod := "sendNotification"
+	dedupKey := fmt.Sprintf("%s#%s#%s", rule.RuleID, notification.TaskID, notification.Event)
+	claimed, err := claimNotification(dedupKey, rule.DedupSeconds, clock.Now())
+	if err != nil {
+		// Better a duplicate than a missed alert
+		log(callerMethod, fmt.Sprintf("Error de-duplicating %s: %s", dedupKey, err.Error()))
+	} else if !claimed {
+		log(callerMethod, fmt.Sprintf("Not repeating %s within %ds", dedupKey, rule.DedupSeconds))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	delivery := deliverNotification(ctx, rule, notification)
+	log(callerMethod, fmt.Sprintf("Notification %s of %s: %s", notification.Event, notification.ExecutionID, orDelivered(delivery.Error)))
+	if delivery.Error != "" && claimed {
+		// Let the next occurrence try again
+		if err := releaseNotification(dedupKey); err != nil {
+			log(callerMethod, err.Error())
+		}
+	}
+	if err := recordDelivery(rule.RuleID, delivery); err != nil {
+		log(callerMethod, fmt.Sprintf("Error recording delivery of rule %s: %s", rule.RuleID, err.Error()))
+	}
+}
+
+// claimNotification reserves dedupKey for dedupSeconds from now. It reports false if the
+// key is still reserved by an earlier notification.
+func claimNotification(dedupKey string, dedupSeconds int, now time.Time) (bool, error) {
+	if dedupSeconds == 0 {
+		return true, nil
+	}
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String("daria_notification_log"),
+		Item: map[string]*dynamodb.AttributeValue{
+			"dedupKey": {
+				S: aws.String(dedupKey),
+			},
+			"sentAt": {
+				N: aws.String(strconv.FormatInt(now.Unix(), 10)),
+			},
+			"expiresAt": {
+				N: aws.String(strconv.FormatInt(now.Unix()+int64(dedupSeconds), 10)),
+			},
+		},
+		// TTL deletion lags, so an expired reservation counts as gone
+		ConditionExpression: aws.String("attribute_not_exists(dedupKey) OR expiresAt <= :now"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": {
+				N: aws.String(strconv.FormatInt(now.Unix(), 10)),
+			},
+		},
+	}
+	_, err := db.svc.PutItem(input)
+	if isConditionalCheckFailed(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func releaseNotification(dedupKey string) error {
+	_, err := db.svc.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String("daria_notification_log"),
+		Key: map[string]*dynamodb.AttributeValue{
+			"dedupKey": {
+				S: aws.String(dedupKey),
+			},
+		},
+	})
+	return err
+}
+
+// waitForNotifications waits for the notifications being sent, or until ctx is done.
+func waitForNotifications(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		pendingNotifications.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sampleNotification is what the test endpoint sends, and what templates are checked
+// against when a rule is saved. task may be nil.
+func sampleNotification(rule api.NotificationRule, task *Task, now time.Time) api.Notification {
+	notification := api.Notification{
+		Event:               eventTest,
+		RuleID:              rule.RuleID,
+		UserID:              rule.UserID,
+		TaskID:              "sample-task",
+		TaskName:            "sample",
+		URL:                 "https://example.com/hook",
+		ScheduledAt:         now.UTC().Truncate(time.Minute),
+		Outcome:             "failure",
+		Error:               "target responded 500 Internal Server Error",
+		ConsecutiveFailures: max(rule.ConsecutiveFailures, 1),
+		At:                  now.UTC(),
+	}
+	if task != nil {
+		notification.TaskID = task.TaskID
+		notification.TaskName = task.Name
+		notification.URL = task.APIURL
+	}
+	notification.ExecutionID = fmt.Sprintf("%s#%d", notification.TaskID, notification.ScheduledAt.Unix())
+	return notification
+}
+
+// renderNotification executes the rule's templates, or the defaults, on the notification.
+// The subject is folded onto one line. Template errors are fieldErrors on the template.
+func renderNotification(rule api.NotificationRule, notification api.Notification) (string, string, error) {
+	subjectTemplate := rule.SubjectTemplate
+	if subjectTemplate == "" {
+		subjectTemplate = defaultSubjects[notification.Event]
+	}
+	bodyTemplate := rule.BodyTemplate
+	if bodyTemplate == "" {
+		bodyTemplate = defaultBody
+	}
+
+	var errs fieldErrors
+	render := func(field string, source string) string {
+		var b strings.Builder
+		tmpl, err := template.New(field).Parse(source)
+		if err == nil {
+			err = tmpl.Execute(&b, notification)
+		}
+		if err != nil {
+			errs = append(errs, api.FieldError{Field: field, Code: "format", Message: fmt.Sprintf("%s is not a valid template: %s", field, err.Error())})
+		}
+		return b.String()
+	}
+	subject := strings.Join(strings.Fields(render("subjectTemplate", subjectTemplate)), " ")
+	body := render("bodyTemplate", bodyTemplate)
+	if len(errs) > 0 {
+		return "", "", errs
+	}
+	return subject, body, nil
+}
+
+// deliverNotification renders the notification and sends it through the rule's channel.
+func deliverNotification(ctx context.Context, rule api.NotificationRule, notification api.Notification) api.NotificationDelivery {
+	delivery := api.NotificationDelivery{Event: notification.Event, At: clock.Now().UTC(), Channel: rule.Channel}
+	subject, body, err := renderNotification(rule, notification)
+	if err == nil {
+		notification.Subject, notification.Message = subject, body
+		delivery.Subject, delivery.Message = subject, body
+		switch rule.Channel {
+		case channelWebhook:
+			err = postWebhook(ctx, rule, notification)
+		case channelEmail:
+			err = sendEmail(rule.EmailTo, subject, body)
+		default:
+			err = fmt.Errorf("unknown channel %q", rule.Channel)
+		}
+	}
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+	return delivery
+}
+
+// postWebhook posts the notification as JSON on behalf of the rule's owner, through the
+// same guarded transport as task calls. Any response but a 2xx is a failure.
+func postWebhook(ctx context.Context, rule api.NotificationRule, notification api.Notification) error {
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(withTargetAllowlist(ctx, rule.UserID), http.MethodPost, rule.WebhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-JobScheduler-Event", notification.Event)
+	client := &http.Client{Timeout: notifyTimeout, Transport: targetTransport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxSnapshotBody))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
+
+// mailer sends notification emails.
+type mailer interface {
+	Send(from string, to []string, subject string, body string) error
+}
+
+// notificationMailer is the mailer config.SMTPAddr names, or nil if email is disabled.
+func notificationMailer() mailer {
+	switch config.SMTPAddr {
+	case "":
+		return nil
+	case smtpCapture:
+		return outbox
+	default:
+		return smtpMailer{addr: config.SMTPAddr, username: config.SMTPUsername, password: config.SMTPPassword}
+	}
+}
+
+func sendEmail(to []string, subject string, body string) error {
+	m := notificationMailer()
+	if m == nil {
+		return errEmailDisabled
+	}
+	return m.Send(config.SMTPFrom, to, subject, body)
+}
+
+// smtpMailer sends through an SMTP server, upgrading to TLS when it offers STARTTLS.
+// Credentials are only sent over TLS or to localhost.
+type smtpMailer struct {
+	addr     string
+	username string
+	password string
+}
+
+func (m smtpMailer) Send(from string, to []string, subject string, body string) error {
+	host, _, err := net.SplitHostPort(m.addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", m.addr, notifyTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(notifyTimeout))
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if m.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.username, m.password, host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, recipient := range to {
+		if err := client.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(composeEmail(from, to, subject, body, time.Now())); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// composeEmail formats a plain text message. subject must be a single line.
+func composeEmail(from string, to []string, subject string, body string, now time.Time) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	body = strings.ReplaceAll(body, "\r\n", "\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return b.Bytes()
+}
+
+// captureMailer is the SMTP stand-in: it keeps the latest maxCapturedEmails emails in
+// memory, where tests can read them through GET /admin/outbox.
+type captureMailer struct {
+	sync.Mutex
+	emails []api.CapturedEmail
+}
+
+var outbox = &captureMailer{}
+
+func (m *captureMailer) Send(from string, to []string, subject string, body string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.emails = append(m.emails, api.CapturedEmail{From: from, To: slices.Clone(to), Subject: subject, Body: body, SentAt: clock.Now().UTC()})
+	if len(m.emails) > maxCapturedEmails {
+		m.emails = slices.Delete(m.emails, 0, len(m.emails)-maxCapturedEmails)
+	}
+	return nil
+}
+
+func (m *captureMailer) list() []api.CapturedEmail {
+	m.Lock()
+	defer m.Unlock()
+	return append(make([]api.CapturedEmail, 0, len(m.emails)), m.emails...)
+}
+
+func (m *captureMailer) clear() {
+	m.Lock()
+	defer m.Unlock()
+	m.emails = nil
+}
+
+// checkOutboxEnabled answers 409 unless emails are being captured.
+func checkOutboxEnabled(c *gin.Context) bool {
+	if config.SMTPAddr != smtpCapture {
+		respondError(c, http.StatusConflict, codeOutboxDisabled, "Emails are only captured when JOBSCHEDULER_SMTP_ADDR is capture")
+		return false
+	}
+	return true
+}
+
+// getOutbox handles GET /admin/outbox: the emails this instance captured, oldest first.
+func getOutbox(c *gin.Context) {
+	callerMethod := "getOutbox"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	if !checkOutboxEnabled(c) {
+		return
+	}
+	c.JSON(http.StatusOK, api.Outbox{InstanceID: config.InstanceID, Emails: outbox.list()})
+}
+
+// clearOutbox handles DELETE /admin/outbox.
+func clearOutbox(c *gin.Context) {
+	callerMethod := "clearOutbox"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	if !checkOutboxEnabled(c) {
+		return
+	}
+	outbox.clear()
+	c.JSON(http.StatusOK, api.Outbox{InstanceID: config.InstanceID, Emails: []api.CapturedEmail{}})
+}
+
+func orDelivered(errMessage string) string {
+	if errMessage == "" {
+		return "delivered"
+	}
+	return errMessage
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"daria.com/jobScheduler/api"
+	"daria.com/jobScheduler/scheduler"
+)
+
+// fakeNotificationLog stands in for DynamoDB: it keeps daria_notification_log in memory
+// and accepts the lastDelivery updates to daria_notification_rules.
+type fakeNotificationLog struct {
+	mu        sync.Mutex
+	expiresAt map[string]int64 // by dedupKey
+	puts      int
+}
+
+func (f *fakeNotificationLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target, req, ok := decodeFakeRequest(w, r)
+	if !ok {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch target {
+	case "DynamoDB_20120810.PutItem":
+		f.puts++
+		key := req.Item["dedupKey"].S
+		now, _ := strconv.ParseInt(req.ExpressionAttributeValues[":now"].N, 10, 64)
+		// attribute_not_exists(dedupKey) OR expiresAt <= :now
+		if expiresAt, ok := f.expiresAt[key]; ok && expiresAt > now {
+			writeConditionalCheckFailed(w)
+			return
+		}
+		f.expiresAt[key], _ = strconv.ParseInt(req.Item["expiresAt"].N, 10, 64)
+	case "DynamoDB_20120810.DeleteItem":
+		delete(f.expiresAt, req.Key["dedupKey"].S)
+	case "DynamoDB_20120810.UpdateItem":
+	default:
+		writeFakeError(w, "ValidationException", "unexpected call to "+target)
+		return
+	}
+	w.Write([]byte(`{}`))
+}
+
+func (f *fakeNotificationLog) claimed(dedupKey string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.expiresAt[dedupKey]
+	return ok
+}
+
+// setupNotifications points db at a fake notification log, captures emails, runs on a fake
+// clock and gives user_1 the rules. It restores everything when the test ends.
+func setupNotifications(t *testing.T, rules ...api.NotificationRule) (*fakeNotificationLog, *scheduler.FakeClock) {
+	t.Helper()
+	fake := &fakeNotificationLog{expiresAt: make(map[string]int64)}
+	useFakeDynamoDB(t, fake)
+
+	savedConfig, savedClock := config, clock
+	fakeClock := scheduler.NewFakeClock(time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC))
+	config.SMTPAddr, config.SMTPFrom = smtpCapture, "jobscheduler@localhost"
+	clock = fakeClock
+	outbox.clear()
+	notificationRuleCache.Lock()
+	notificationRuleCache.entries["user_1"] = cachedNotificationRules{rules: rules, expiresAt: time.Now().Add(time.Hour)}
+	notificationRuleCache.Unlock()
+
+	t.Cleanup(func() {
+		forgetNotificationRules("user_1")
+		outbox.clear()
+		config, clock = savedConfig, savedClock
+	})
+	return fake, fakeClock
+}
+
+func emailRule(ruleID string, events ...string) api.NotificationRule {
+	return api.NotificationRule{
+		RuleID:  ruleID,
+		UserID:  "user_1",
+		Events:  events,
+		Channel: channelEmail,
+		EmailTo: []string{"ops@example.com"},
+	}
+}
+
+// runTask records a run of task with outcome the way the executor does, and returns the
+// subjects of the emails it sent.
+func runTask(t *testing.T, task *Task, outcome string, last bool) []string {
+	t.Helper()
+	outbox.clear()
+	previousFailures := task.ConsecutiveFailures
+	countFailures(task, outcome)
+	scheduledAt := clock.Now().Unix()
+	execution := &executionRecord{ExecutionID: executionID(task.TaskID, clock.Now()), ScheduledAt: scheduledAt}
+	result := JobExecutionResult{Status: outcome}
+	if outcome != "success" {
+		result.Error = errors.New("target responded 500")
+	}
+	notifyRun(*task, execution, result, previousFailures, last)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := waitForNotifications(ctx); err != nil {
+		t.Fatalf("notifications still pending: %v", err)
+	}
+	var subjects []string
+	for _, email := range outbox.list() {
+		subjects = append(subjects, email.Subject)
+	}
+	slices.Sort(subjects)
+	return subjects
+}
+
+func newTestTask() *Task {
+	return &Task{TaskID: "task_1", UserID: "user_1", Name: "nightly", APIURL: "https://example.com/hook"}
+}
+
+func TestNotifyRunFailure(t *testing.T) {
+	other := emailRule("rule_other", eventFailure)
+	other.TaskID = "task_2"
+	setupNotifications(t, emailRule("rule_1", eventFailure), other)
+	task := newTestTask()
+
+	if got := runTask(t, task, "success", false); len(got) != 0 {
+		t.Fatalf("a successful run sent %q", got)
+	}
+	got := runTask(t, task, "failure", false)
+	if want := []string{"[jobScheduler] nightly failed"}; !slices.Equal(got, want) {
+		t.Fatalf("a failed run sent %q; want %q", got, want)
+	}
+	emails := outbox.list()
+	if email := emails[0]; !slices.Equal(email.To, []string{"ops@example.com"}) || email.From != "jobscheduler@localhost" {
+		t.Fatalf("email sent from %s to %v", email.From, email.To)
+	}
+	if got := runTask(t, task, outcomeShortCircuited, false); len(got) != 1 {
+		t.Fatalf("a short-circuited run sent %q; want a failure email", got)
+	}
+}
+
+func TestNotifyRunConsecutiveFailures(t *testing.T) {
+	rule := emailRule("rule_1", eventConsecutiveFailures)
+	rule.ConsecutiveFailures = 3
+	setupNotifications(t, rule)
+	task := newTestTask()
+
+	for run := 1; run <= 5; run++ {
+		got := runTask(t, task, "failure", false)
+		if run != 3 && len(got) != 0 {
+			t.Fatalf("failure %d sent %q", run, got)
+		}
+		if want := []string{"[jobScheduler] nightly failed 3 times in a row"}; run == 3 && !slices.Equal(got, want) {
+			t.Fatalf("failure 3 sent %q; want %q", got, want)
+		}
+	}
+
+	// A success ends the streak, so the next three failures fire again
+	runTask(t, task, "success", false)
+	runTask(t, task, "failure", false)
+	runTask(t, task, "failure", false)
+	if got := runTask(t, task, "failure", false); len(got) != 1 {
+		t.Fatalf("the third failure of a new streak sent %q", got)
+	}
+}
+
+func TestNotifyRunRecovery(t *testing.T) {
+	setupNotifications(t, emailRule("rule_1", eventRecovery))
+	task := newTestTask()
+
+	if got := runTask(t, task, "success", false); len(got) != 0 {
+		t.Fatalf("a success without failures sent %q", got)
+	}
+	runTask(t, task, "failure", false)
+	runTask(t, task, "failure", false)
+	got := runTask(t, task, "success", false)
+	if want := []string{"[jobScheduler] nightly recovered"}; !slices.Equal(got, want) {
+		t.Fatalf("the first success after failures sent %q; want %q", got, want)
+	}
+	if got := runTask(t, task, "success", false); len(got) != 0 {
+		t.Fatalf("a second success sent %q", got)
+	}
+}
+
+func TestNotifyRunCompletion(t *testing.T) {
+	setupNotifications(t, emailRule("rule_1", eventCompletion, eventFailure))
+	task := newTestTask()
+
+	if got := runTask(t, task, "success", false); len(got) != 0 {
+		t.Fatalf("a run that is not the last sent %q", got)
+	}
+	got := runTask(t, task, "failure", true)
+	want := []string{"[jobScheduler] nightly failed", "[jobScheduler] nightly made its last run"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("a failed last run sent %q; want %q", got, want)
+	}
+}
+
+func TestClaimNotification(t *testing.T) {
+	fake, _ := setupNotifications(t)
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	claims := []struct {
+		key     string
+		dedup   int
+		at      time.Duration
+		claimed bool
+	}{
+		{"rule_1#task_1#failure", 60, 0, true},
+		{"rule_1#task_1#failure", 60, 30 * time.Second, false},
+		{"rule_1#task_2#failure", 60, 30 * time.Second, true},
+		{"rule_1#task_1#recovery", 60, 30 * time.Second, true},
+		{"rule_1#task_1#failure", 60, 60 * time.Second, true}, // the first claim expired
+		{"rule_1#task_1#failure", 60, 90 * time.Second, false},
+		{"rule_2#task_1#failure", 0, 0, true},
+		{"rule_2#task_1#failure", 0, 0, true},
+	}
+	for i, c := range claims {
+		claimed, err := claimNotification(c.key, c.dedup, now.Add(c.at))
+		if err != nil {
+			t.Fatalf("claim %d: %v", i, err)
+		}
+		if claimed != c.claimed {
+			t.Fatalf("claim %d of %s at +%s = %v; want %v", i, c.key, c.at, claimed, c.claimed)
+		}
+	}
+	if fake.puts != 6 || fake.claimed("rule_2#task_1#failure") {
+		t.Fatalf("%d conditional puts; want none for a rule without a dedup window", fake.puts)
+	}
+}
+
+func TestNotifyRunDedup(t *testing.T) {
+	rule := emailRule("rule_1", eventFailure)
+	rule.DedupSeconds = 3600
+	fake, fakeClock := setupNotifications(t, rule)
+	task := newTestTask()
+
+	if got := runTask(t, task, "failure", false); len(got) != 1 {
+		t.Fatalf("the first failure sent %q", got)
+	}
+	fakeClock.Advance(30 * time.Minute)
+	if got := runTask(t, task, "failure", false); len(got) != 0 {
+		t.Fatalf("a failure within the dedup window sent %q", got)
+	}
+	fakeClock.Advance(30 * time.Minute)
+	if got := runTask(t, task, "failure", false); len(got) != 1 {
+		t.Fatalf("a failure after the dedup window sent %q", got)
+	}
+
+	// A notification that is not delivered gives its claim back
+	config.SMTPAddr = ""
+	fakeClock.Advance(time.Hour)
+	runTask(t, task, "failure", false)
+	if fake.claimed("rule_1#task_1#failure") {
+		t.Fatal("an undelivered notification kept its dedup claim")
+	}
+	config.SMTPAddr = smtpCapture
+	if got := runTask(t, task, "failure", false); len(got) != 1 {
+		t.Fatalf("the failure after an undelivered one sent %q", got)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"daria.com/jobScheduler/api"
+	"github.com/gin-gonic/gin"
+)
+
+// jobQuotaMiddleware rejects the request unless the user has room for `requested` more jobs.
+// Handlers that only learn how many jobs they create after parsing the body should call
+// checkJobQuota directly instead.
+func jobQuotaMiddleware(requested int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !checkJobQuota(c, requested) {
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// checkJobQuota compares the user's jobCount against jobLimit. When there is no room it
+// writes the error response and returns false; the caller must stop handling the request.
+// This is a fast pre-check only: the authoritative gate is the conditional increment in
+// reserveJobSlot, which callers must still go through.
+func checkJobQuota(c *gin.Context, requested int64) bool {
+	startTime := time.Now()
+	callerMethod := "checkJobQuota"
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	userID := c.GetString("userId")
+
+	// Query the daria_users table to retrieve jobLimit and jobCount for the userID
+	jobLimit, jobCount, err := getUserJobLimits(userID)
+	if errors.Is(err, errUserNotFound) {
+		log(callerMethod, fmt.Sprintf("No quota record for user %s", userID))
+		respondError(c, http.StatusForbidden, codeNoQuota, "No job quota is configured for this user")
+		return false
+	}
+	if err != nil {
+		log(callerMethod, fmt.Sprintf("Error: %s", err.Error()))
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to read job quota")
+		return false
+	}
+
+	log(callerMethod, fmt.Sprintf("UserID: %s, JobLimit: %d, JobCount: %d, Requested: %d", userID, jobLimit, jobCount, requested))
+	if jobCount+requested > jobLimit {
+		respondJobLimitReached(c, jobLimit, jobCount, requested)
+		return false
+	}
+
+	return true
+}
+
+// respondQuotaRace is used when reserveJobSlot fails after checkJobQuota passed, i.e. a
+// concurrent request took the last slot. It re-reads the usage so the response is accurate.
+func respondQuotaRace(c *gin.Context, requested int64) {
+	jobLimit, jobCount, err := getUserJobLimits(c.GetString("userId"))
+	if errors.Is(err, errUserNotFound) {
+		respondError(c, http.StatusForbidden, codeNoQuota, "No job quota is configured for this user")
+		return
+	}
+	if err != nil {
+		log("respondQuotaRace", fmt.Sprintf("Error: %s", err.Error()))
+		respondError(c, http.StatusTooManyRequests, codeQuotaExceeded, "Maximum job limit has been reached")
+		return
+	}
+	respondJobLimitReached(c, jobLimit, jobCount, requested)
+}
+
+func respondJobLimitReached(c *gin.Context, jobLimit int64, jobCount int64, requested int64) {
+	writeError(c, http.StatusTooManyRequests, api.Error{
+		Code:    codeQuotaExceeded,
+		Message: fmt.Sprintf("Maximum job limit (%d) has been reached", jobLimit),
+		Details: map[string]interface{}{
+			"jobLimit":  jobLimit,
+			"jobCount":  jobCount,
+			"requested": requested,
+		},
+	})
+}
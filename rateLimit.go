@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"daria.com/jobScheduler/api"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+// Many users point tasks at the same downstream services, and every run due in the same
+// second would otherwise call out at once. Before a run is claimed it takes a token from
+// its owner's bucket and one from the bucket of its URL's host. A run whose tokens are
+// not ready yet is delayed, never dropped: a short wait happens in place, a longer one
+// puts the run back in the queue for when its tokens are ready. Either way the wait is
+// recorded on the execution.
+//
+// Buckets are kept in memory, so each instance limits the runs it dispatches. In claim
+// mode every replica dispatches every run and takes its tokens even when another replica
+// wins the claim, which keeps the limits close to cluster-wide. Admins can override the
+// default buckets per user and per host in daria_rate_limits.
+
+// Rate limit scopes
+const (
+	rateLimitUser = "user"
+	rateLimitHost = "host"
+)
+
+// rateLimitWait is how a run stands with the rate limits.
+type rateLimitWait struct {
+	since time.Time // when a limit first held the run back; zero if none has
+	ready time.Time // when its tokens are available
+	by    string    // the scope of the limit that held it back longest
+}
+
+var rateLimits = struct {
+	sync.Mutex
+	buckets map[string]*rate.Limiter // by <scope>#<key>
+	waiting map[string]rateLimitWait // by execution ID, runs put back in the queue holding their tokens
+}{
+	buckets: make(map[string]*rate.Limiter),
+	waiting: make(map[string]rateLimitWait),
+}
+
+// reserveRun takes the tokens for the task's current run, unless it already holds them
+// from an earlier dispatch, and returns when the run may call out.
+func reserveRun(task *Task, now time.Time) rateLimitWait {
+	id := executionID(task.TaskID, task.NextExecution)
+	rateLimits.Lock()
+	wait, ok := rateLimits.waiting[id]
+	delete(rateLimits.waiting, id)
+	rateLimits.Unlock()
+	if ok {
+		return wait
+	}
+
+	// Read the limits before locking; a miss in the cache goes to DynamoDB
+	limits := []api.RateLimit{loadRateLimit(rateLimitUser, task.UserID)}
+	if host := targetHost(task.APIURL); host != "" {
+		limits = append(limits, loadRateLimit(rateLimitHost, host))
+	}
+
+	wait = rateLimitWait{ready: now}
+	rateLimits.Lock()
+	defer rateLimits.Unlock()
+	for _, limit := range limits {
+		ready := now.Add(takeToken(limit, now))
+		if ready.After(wait.ready) {
+			wait.since = now
+			wait.ready = ready
+			wait.by = limit.Scope
+		}
+	}
+	return wait
+}
+
+// waitForTokens takes the rate limit tokens for the task's run due at now. A run whose
+// tokens are ready within rateLimitMaxWait waits for them; one held back longer is put
+// back in the queue with holdRun and waitForTokens returns false, as it does if ctx is
+// cancelled while waiting.
+func waitForTokens(ctx context.Context, task *Task, now time.Time) (rateLimitWait, bool) {
+	wait := reserveRun(task, now)
+	delay := wait.ready.Sub(now)
+	if delay > rateLimitMaxWait {
+		holdRun(task, wait)
+		return wait, false
+	}
+	if delay > 0 && !sleepContext(ctx, delay) {
+		return wait, false
+	}
+	return wait, true
+}
+
+// takeToken reserves a token from the limit's bucket and returns how long until it is
+// available. The caller holds rateLimits.
+func takeToken(limit api.RateLimit, now time.Time) time.Duration {
+	every := rate.Inf
+	if limit.RatePerSecond > 0 {
+		every = rate.Limit(limit.RatePerSecond)
+	}
+	// A bucket of 0 could never hand out a token, and ReserveN would refuse rather than
+	// delay, so a limit stored before burst was validated holds at least one
+	burst := max(limit.Burst, 1)
+	bucketKey := limit.Scope + "#" + limit.Key
+	bucket := rateLimits.buckets[bucketKey]
+	if bucket == nil {
+		bucket = rate.NewLimiter(every, burst)
+		rateLimits.buckets[bucketKey] = bucket
+	} else if bucket.Limit() != every || bucket.Burst() != burst {
+		bucket.SetLimitAt(now, every)
+		bucket.SetBurstAt(now, burst)
+	}
+	return bucket.ReserveN(now, 1).DelayFrom(now)
+}
+
+// holdRun remembers a run put back in the queue, so it keeps its place when it comes due
+// again. Runs that never come back, because their task was deleted or paused, are
+// forgotten after an hour.
+func holdRun(task *Task, wait rateLimitWait) {
+	rateLimits.Lock()
+	defer rateLimits.Unlock()
+	now := clock.Now()
+	for id, held := range rateLimits.waiting {
+		if now.Sub(held.ready) > time.Hour {
+			delete(rateLimits.waiting, id)
+		}
+	}
+	rateLimits.waiting[executionID(task.TaskID, task.NextExecution)] = wait
+}
+
+// targetHost is the host a task URL calls, lower-cased, or "" if the URL is invalid.
+func targetHost(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(strings.ToLower(parsed.Hostname()), ".")
+}
+
+// Limits are cached like allowlists: changes made through this instance apply at once,
+// other instances see them within rateLimitCacheTTL.
+const rateLimitCacheTTL = time.Minute
+
+type cachedRateLimit struct {
+	limit     api.RateLimit
+	expiresAt time.Time
+}
+
+var rateLimitCache = struct {
+	sync.Mutex
+	entries map[string]cachedRateLimit
+}{entries: make(map[string]cachedRateLimit)}
+
+// loadRateLimit returns the limit in force for the user or host. If the override cannot
+// be read the default applies.
+func loadRateLimit(scope string, key string) api.RateLimit {
+	cacheKey := scope + "#" + key
+	rateLimitCache.Lock()
+	cached, ok := rateLimitCache.entries[cacheKey]
+	rateLimitCache.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.limit
+	}
+
+	limit, err := getRateLimitRecord(scope, key)
+	if err != nil {
+		log("loadRateLimit", fmt.Sprintf("Error loading rate limit of %s %s: %s", scope, key, err.Error()))
+		return limit
+	}
+	rateLimitCache.Lock()
+	rateLimitCache.entries[cacheKey] = cachedRateLimit{limit: limit, expiresAt: time.Now().Add(rateLimitCacheTTL)}
+	rateLimitCache.Unlock()
+	return limit
+}
+
+// defaultRateLimit is the configured limit for scope, applied to key.
+func defaultRateLimit(scope string, key string) api.RateLimit {
+	limit := config.UserRateLimit
+	if scope == rateLimitHost {
+		limit = config.HostRateLimit
+	}
+	limit.Scope = scope
+	limit.Key = key
+	limit.Default = true
+	return limit
+}
+
+// rateLimitRecord is a row of daria_rate_limits.
+type rateLimitRecord struct {
+	LimitKey      string    `json:"limitKey"` // <scope>#<key>
+	Scope         string    `json:"scope"`
+	Key           string    `json:"key"`
+	RatePerSecond float64   `json:"ratePerSecond"`
+	Burst         int       `json:"burst"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+// getRateLimitRecord reads the override for the user or host, or returns the default if
+// there is none.
+func getRateLimitRecord(scope string, key string) (api.RateLimit, error) {
+	limit := defaultRateLimit(scope, key)
+	input := &dynamodb.GetItemInput{
+		TableName: aws.String("daria_rate_limits"),
+		Key: map[string]*dynamodb.AttributeValue{
+			"limitKey": {
+				S: aws.String(scope + "#" + key),
+			},
+		},
+	}
+	result, err := db.svc.GetItem(input)
+	if err != nil || result.Item == nil {
+		return limit, err
+	}
+	var record rateLimitRecord
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &record); err != nil {
+		return limit, err
+	}
+	return api.RateLimit{
+		Scope:         scope,
+		Key:           key,
+		RatePerSecond: record.RatePerSecond,
+		Burst:         record.Burst,
+		UpdatedAt:     &record.UpdatedAt,
+	}, nil
+}
+
+func putRateLimitRecord(record rateLimitRecord) error {
+	item, err := dynamodbattribute.MarshalMap(record)
+	if err != nil {
+		return err
+	}
+	_, err = db.svc.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String("daria_rate_limits"),
+		Item:      item,
+	})
+	if err == nil {
+		forgetRateLimit(record.LimitKey)
+	}
+	return err
+}
+
+func deleteRateLimitRecord(limitKey string) error {
+	_, err := db.svc.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String("daria_rate_limits"),
+		Key: map[string]*dynamodb.AttributeValue{
+			"limitKey": {
+				S: aws.String(limitKey),
+			},
+		},
+	})
+	if err == nil {
+		forgetRateLimit(limitKey)
+	}
+	return err
+}
+
+func forgetRateLimit(limitKey string) {
+	rateLimitCache.Lock()
+	delete(rateLimitCache.entries, limitKey)
+	rateLimitCache.Unlock()
+}
+
+// rateLimitTarget reads which limit an admin route is about: the userId or host in the
+// path.
+func rateLimitTarget(c *gin.Context) (string, string, bool) {
+	if userID := c.Param("userId"); userID != "" {
+		return rateLimitUser, userID, true
+	}
+	host, ok := hostParam(c)
+	return rateLimitHost, host, ok
+}
+
+// hostParam reads the host in the path, normalised like targetHost. When it is not a
+// hostname or IP address it writes the error response.
+func hostParam(c *gin.Context) (string, bool) {
+	host := strings.TrimSuffix(strings.ToLower(c.Param("host")), ".")
+	if _, err := netip.ParseAddr(host); err != nil && !validHostname(host) {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("%q is not a hostname or IP address", host))
+		return "", false
+	}
+	return host, true
+}
+
+// getRateLimit handles GET /admin/users/:userId/rate-limit and GET /admin/hosts/:host/rate-limit.
+func getRateLimit(c *gin.Context) {
+	callerMethod := "getRateLimit"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	scope, key, ok := rateLimitTarget(c)
+	if !ok {
+		return
+	}
+	limit, err := getRateLimitRecord(scope, key)
+	if err != nil {
+		log(callerMethod, err.Error())
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to read the rate limit")
+		return
+	}
+	c.JSON(http.StatusOK, limit)
+}
+
+// putRateLimit handles PUT /admin/users/:userId/rate-limit and PUT /admin/hosts/:host/rate-limit,
+// overriding the default limit.
+func putRateLimit(c *gin.Context) {
+	callerMethod := "putRateLimit"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	scope, key, ok := rateLimitTarget(c)
+	if !ok {
+		return
+	}
+	body, err := c.GetRawData()
+	if err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "Failed to read request body")
+		return
+	}
+	if err := validateRequest("RateLimitInput", body); err != nil {
+		respondInvalid(c, err)
+		return
+	}
+	var input api.RateLimitInput
+	if err := json.Unmarshal(body, &input); err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	record := rateLimitRecord{
+		LimitKey:      scope + "#" + key,
+		Scope:         scope,
+		Key:           key,
+		RatePerSecond: input.RatePerSecond,
+		Burst:         input.Burst,
+		UpdatedAt:     time.Now().UTC(),
+	}
+	if err := putRateLimitRecord(record); err != nil {
+		log(callerMethod, err.Error())
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to save the rate limit")
+		return
+	}
+	log(callerMethod, fmt.Sprintf("Rate limit of %s %s set to %v/s, burst %d", scope, key, record.RatePerSecond, record.Burst))
+	c.JSON(http.StatusOK, api.RateLimit{
+		Scope:         scope,
+		Key:           key,
+		RatePerSecond: record.RatePerSecond,
+		Burst:         record.Burst,
+		UpdatedAt:     &record.UpdatedAt,
+	})
+}
+
+// deleteRateLimit handles DELETE /admin/users/:userId/rate-limit and
+// DELETE /admin/hosts/:host/rate-limit, returning to the default limit.
+func deleteRateLimit(c *gin.Context) {
+	callerMethod := "deleteRateLimit"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	scope, key, ok := rateLimitTarget(c)
+	if !ok {
+		return
+	}
+	if err := deleteRateLimitRecord(scope + "#" + key); err != nil {
+		log(callerMethod, err.Error())
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to remove the rate limit")
+		return
+	}
+	log(callerMethod, fmt.Sprintf("Rate limit of %s %s reset to the default", scope, key))
+	c.JSON(http.StatusOK, defaultRateLimit(scope, key))
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"daria.com/jobScheduler/api"
+	"daria.com/jobScheduler/scheduler"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+// fakeRateLimits stands in for daria_rate_limits.
+type fakeRateLimits struct {
+	mu    sync.Mutex
+	items map[string]map[string]fakeAttribute
+}
+
+func (f *fakeRateLimits) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target, req, ok := decodeFakeRequest(w, r)
+	if !ok {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch target {
+	case "DynamoDB_20120810.GetItem":
+		if item, ok := f.items[req.Key["limitKey"].S]; ok {
+			json.NewEncoder(w).Encode(map[string]interface{}{"Item": item})
+			return
+		}
+	case "DynamoDB_20120810.PutItem":
+		f.items[req.Item["limitKey"].S] = req.Item
+	default:
+		writeFakeError(w, "ValidationException", "unexpected call to "+target)
+		return
+	}
+	w.Write([]byte(`{}`))
+}
+
+// store writes an override straight to the table, as an older version could have.
+func (f *fakeRateLimits) store(scope string, key string, ratePerSecond float64, burst int) {
+	f.mu.Lock()
+	f.items[scope+"#"+key] = map[string]fakeAttribute{
+		"limitKey":      {S: scope + "#" + key},
+		"scope":         {S: scope},
+		"key":           {S: key},
+		"ratePerSecond": {N: fmt.Sprint(ratePerSecond)},
+		"burst":         {N: fmt.Sprint(burst)},
+		"updatedAt":     {S: "2026-10-01T12:00:00Z"},
+	}
+	f.mu.Unlock()
+	forgetRateLimit(scope + "#" + key)
+}
+
+// useRateLimits starts the test with empty buckets, no overrides, users unlimited and
+// hosts limited to hostLimit, on a fake clock.
+func useRateLimits(t *testing.T, hostLimit api.RateLimit) (*fakeRateLimits, *scheduler.FakeClock) {
+	t.Helper()
+	table := &fakeRateLimits{items: make(map[string]map[string]fakeAttribute)}
+	useFakeDynamoDB(t, table)
+	reset := func() {
+		rateLimits.Lock()
+		rateLimits.buckets = make(map[string]*rate.Limiter)
+		rateLimits.waiting = make(map[string]rateLimitWait)
+		rateLimits.Unlock()
+		rateLimitCache.Lock()
+		rateLimitCache.entries = make(map[string]cachedRateLimit)
+		rateLimitCache.Unlock()
+	}
+	reset()
+	savedConfig, savedClock := config, clock
+	config.UserRateLimit = api.RateLimit{RatePerSecond: 0, Burst: 1}
+	config.HostRateLimit = hostLimit
+	fake := scheduler.NewFakeClock(time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC))
+	clock = fake
+	t.Cleanup(func() {
+		config, clock = savedConfig, savedClock
+		reset()
+	})
+	return table, fake
+}
+
+// limitedTask is a task of user_1 calling api.example.com, due at next.
+func limitedTask(n int, next time.Time) *Task {
+	return &Task{TaskID: fmt.Sprintf("user_1_task_%d", n), UserID: "user_1", APIURL: "https://api.example.com/hook", NextExecution: next}
+}
+
+// runAt takes the tokens for a run due at now that is not expected to wait.
+func runAt(t *testing.T, task *Task, now time.Time) rateLimitWait {
+	t.Helper()
+	wait, ready := waitForTokens(context.Background(), task, now)
+	if !ready {
+		t.Fatalf("%s was held back until %s", task.TaskID, wait.ready)
+	}
+	return wait
+}
+
+// waitInPlace runs waitForTokens for a run that waits, and returns once it is asleep on
+// the clock.
+func waitInPlace(t *testing.T, ctx context.Context, fake *scheduler.FakeClock, task *Task) <-chan bool {
+	t.Helper()
+	done := make(chan bool, 1)
+	go func() {
+		_, ready := waitForTokens(ctx, task, fake.Now())
+		done <- ready
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for fake.Waiters() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the run never waited")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return done
+}
+
+func TestWaitForTokensWaitsInPlace(t *testing.T) {
+	_, fake := useRateLimits(t, api.RateLimit{RatePerSecond: 1, Burst: 2})
+	start := fake.Now()
+
+	for i := 0; i < 2; i++ {
+		if wait := runAt(t, limitedTask(i, start), start); !wait.since.IsZero() {
+			t.Fatalf("run %d within the burst was held back: %+v", i, wait)
+		}
+	}
+
+	done := waitInPlace(t, context.Background(), fake, limitedTask(2, start))
+	fake.Advance(999 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("the third run went ahead before its token was ready")
+	case <-time.After(10 * time.Millisecond):
+	}
+	fake.Advance(time.Millisecond)
+	if ready := <-done; !ready {
+		t.Fatal("the third run was dropped; want it to wait a second and go ahead")
+	}
+
+	// A run cancelled while it waits does not go ahead
+	ctx, cancel := context.WithCancel(context.Background())
+	done = waitInPlace(t, ctx, fake, limitedTask(3, fake.Now()))
+	cancel()
+	if ready := <-done; ready {
+		t.Fatal("a run went ahead after its context was cancelled")
+	}
+}
+
+func TestWaitForTokensRequeuesLongWaits(t *testing.T) {
+	_, fake := useRateLimits(t, api.RateLimit{RatePerSecond: 0.05, Burst: 1}) // a run every 20s
+	start := fake.Now()
+	runAt(t, limitedTask(0, start), start)
+
+	held := limitedTask(1, start)
+	wait, ready := waitForTokens(context.Background(), held, start)
+	if ready || !wait.since.Equal(start) || !wait.ready.Equal(start.Add(20*time.Second)) || wait.by != rateLimitHost {
+		t.Fatalf("a run 20s from its token = %+v ready %t; want it put back until then, held by the host limit", wait, ready)
+	}
+
+	// The held run keeps its token: the next run gets the one after
+	later, ready := waitForTokens(context.Background(), limitedTask(2, start), start)
+	if ready || !later.ready.Equal(start.Add(40*time.Second)) {
+		t.Fatalf("the run after a held one is ready at %s; want %s", later.ready, start.Add(40*time.Second))
+	}
+
+	// Dispatched again when its token is ready, it goes ahead without taking another
+	fake.Advance(20 * time.Second)
+	again := runAt(t, held, fake.Now())
+	if again != wait {
+		t.Fatalf("the held run came back with %+v; want %+v", again, wait)
+	}
+	if next, _ := waitForTokens(context.Background(), limitedTask(3, start), fake.Now()); !next.ready.Equal(start.Add(60 * time.Second)) {
+		t.Fatalf("a new run is ready at %s; want %s, or the held run took a second token", next.ready, start.Add(60*time.Second))
+	}
+	rateLimits.Lock()
+	_, stillHeld := rateLimits.waiting[executionID(held.TaskID, held.NextExecution)]
+	rateLimits.Unlock()
+	if stillHeld {
+		t.Fatal("the run is still held after it went ahead")
+	}
+}
+
+func TestRateLimitOverride(t *testing.T) {
+	table, fake := useRateLimits(t, api.RateLimit{RatePerSecond: 1, Burst: 2})
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.PUT("/v1/admin/hosts/:host/rate-limit", putRateLimit)
+	put := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/v1/admin/hosts/api.example.com/rate-limit", strings.NewReader(body)))
+		return w
+	}
+	start := fake.Now()
+	runAt(t, limitedTask(0, start), start)
+	runAt(t, limitedTask(1, start), start)
+
+	if w := put(`{"ratePerSecond": 1, "burst": 0}`); w.Code != http.StatusBadRequest || errorCode(t, w) != codeValidationFailed {
+		t.Fatalf("PUT with burst 0 = %d %s; want 400", w.Code, w.Body)
+	}
+
+	// A slower limit applies to the next run at once
+	if w := put(`{"ratePerSecond": 0.05, "burst": 1}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+	if wait := reserveRun(limitedTask(2, start), start); !wait.ready.Equal(start.Add(20 * time.Second)) {
+		t.Fatalf("after slowing the host down a run is ready at %s; want %s", wait.ready, start.Add(20*time.Second))
+	}
+
+	// So does lifting it
+	if w := put(`{"ratePerSecond": 0, "burst": 1}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+	for i := 3; i < 10; i++ {
+		runAt(t, limitedTask(i, start), start)
+	}
+
+	// A burst of 0 stored before it was validated limits the user rather than lifting it
+	table.store(rateLimitUser, "user_2", 1, 0)
+	other := func(n int) *Task {
+		return &Task{TaskID: fmt.Sprintf("user_2_task_%d", n), UserID: "user_2", APIURL: "https://other.example.com/hook", NextExecution: start}
+	}
+	runAt(t, other(0), start)
+	if wait := reserveRun(other(1), start); !wait.ready.Equal(start.Add(time.Second)) || wait.by != rateLimitUser {
+		t.Fatalf("with burst 0 stored the user's second run is ready at %s; want %s", wait.ready, start.Add(time.Second))
+	}
+}
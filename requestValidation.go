@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"daria.com/jobScheduler/api"
+	"github.com/gin-gonic/gin"
+)
+
+// schema is the part of an OpenAPI schema object that request bodies are validated against.
+type schema struct {
+	Ref        string             `json:"$ref"`
+	AllOf      []*schema          `json:"allOf"`
+	Type       string             `json:"type"`
+	Required   []string           `json:"required"`
+	Properties map[string]*schema `json:"properties"`
+	Items      *schema            `json:"items"`
+	Enum       []interface{}      `json:"enum"`
+	Format     string             `json:"format"`
+	Minimum    *float64           `json:"minimum"`
+	Maximum    *float64           `json:"maximum"`
+	MinLength  *int               `json:"minLength"`
+	MaxLength  *int               `json:"maxLength"`
+	MinItems   *int               `json:"minItems"`
+	MaxItems   *int               `json:"maxItems"`
+	// Only shown in the docs
+	Description string      `json:"description"`
+	Default     interface{} `json:"default"`
+}
+
+// apiSchemas are the components.schemas of api.OpenAPI, by name.
+var apiSchemas = loadAPISchemas()
+
+func loadAPISchemas() map[string]*schema {
+	var document struct {
+		Components struct {
+			Schemas map[string]*schema `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(api.OpenAPI, &document); err != nil {
+		panic(fmt.Sprintf("openapi.json is invalid: %s", err.Error()))
+	}
+	return document.Components.Schemas
+}
+
+// fieldErrors is the error validation returns when fields break the schema.
+type fieldErrors []api.FieldError
+
+func (errs fieldErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, fieldErr := range errs {
+		messages[i] = fieldErr.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// validateRequest checks a JSON body against the named schema. It returns fieldErrors, or
+// a plain error if the body is not JSON at all.
+func validateRequest(schemaName string, body []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return fmt.Errorf("Body must be valid JSON: %s", err.Error())
+	}
+	return validateValue(schemaName, value)
+}
+
+// validateTaskInput checks a create request that did not arrive as JSON, such as a CSV
+// import row, against the same schema.
+func validateTaskInput(input CreateTaskInput) error {
+	encoded, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	return validateRequest("CreateTaskInput", encoded)
+}
+
+func validateValue(schemaName string, value interface{}) error {
+	var errs fieldErrors
+	checkSchema(apiSchemas[schemaName], "", value, &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// respondInvalid answers 400, listing the offending fields if err is fieldErrors.
+func respondInvalid(c *gin.Context, err error) {
+	var errs fieldErrors
+	if errors.As(err, &errs) {
+		writeError(c, http.StatusBadRequest, api.Error{Code: codeValidationFailed, Message: errs.Error(), Field: errs[0].Field, Fields: errs})
+		return
+	}
+	respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+}
+
+// checkSchema appends to errs every way value breaks s. path is the field's location in
+// the body, empty for the body itself.
+func checkSchema(s *schema, path string, value interface{}, errs *fieldErrors) {
+	s = resolveSchema(s)
+	if s == nil {
+		return
+	}
+	for _, part := range s.AllOf {
+		checkSchema(part, path, value, errs)
+	}
+	fail := func(code string, format string, args ...interface{}) {
+		*errs = append(*errs, api.FieldError{Field: path, Code: code, Message: fieldName(path) + " " + fmt.Sprintf(format, args...)})
+	}
+	if s.Type != "" && !hasSchemaType(value, s.Type) {
+		fail("type", "must be %s", typeDescription(s.Type))
+		return
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if isMissing(v[name]) {
+				field := joinPath(path, name)
+				*errs = append(*errs, api.FieldError{Field: field, Code: "required", Message: field + " is required"})
+			}
+		}
+		names := make([]string, 0, len(s.Properties))
+		for name := range s.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			// Missing, null and empty optional fields are left to their defaults
+			if fieldValue := v[name]; !isMissing(fieldValue) {
+				checkSchema(s.Properties[name], joinPath(path, name), fieldValue, errs)
+			}
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			fail("minItems", "must have at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			fail("maxItems", "must have at most %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				checkSchema(s.Items, fmt.Sprintf("%s[%d]", path, i), item, errs)
+			}
+		}
+	case string:
+		if len(s.Enum) > 0 && !inEnum(s.Enum, v) {
+			fail("enum", "must be one of %s", enumList(s.Enum))
+		}
+		length := utf8.RuneCountInString(v)
+		if s.MinLength != nil && length < *s.MinLength {
+			fail("minLength", "must be at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			fail("maxLength", "must be at most %d characters", *s.MaxLength)
+		}
+		if message := checkFormat(s.Format, v); message != "" {
+			fail("format", "%s", message)
+		}
+	case float64:
+		if len(s.Enum) > 0 && !inEnum(s.Enum, v) {
+			fail("enum", "must be one of %s", enumList(s.Enum))
+		}
+		if s.Minimum != nil && v < *s.Minimum {
+			fail("minimum", "must be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			fail("maximum", "must be at most %v", *s.Maximum)
+		}
+	}
+}
+
+// resolveSchema follows a local $ref such as #/components/schemas/Task.
+func resolveSchema(s *schema) *schema {
+	for s != nil && s.Ref != "" {
+		s = apiSchemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+	}
+	return s
+}
+
+// checkFormat returns why value does not match the format, or "" if it does. Formats
+// that only describe responses are not checked.
+func checkFormat(format string, value string) string {
+	switch format {
+	case "utc-datetime":
+		if _, err := time.Parse("2006-01-02 15:04:05", value); err != nil {
+			return "must be a UTC time in the format 2000-12-02 01:01:01"
+		}
+	case "uri":
+		parsed, err := url.Parse(value)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return "must be an http or https URL"
+		}
+	case "email":
+		if address, err := mail.ParseAddress(value); err != nil || address.Address != value {
+			return "must be an email address such as ops@example.com"
+		}
+	}
+	return ""
+}
+
+func hasSchemaType(value interface{}, schemaType string) bool {
+	switch schemaType {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		number, ok := value.(float64)
+		return ok && number == math.Trunc(number)
+	}
+	return true
+}
+
+func typeDescription(schemaType string) string {
+	switch schemaType {
+	case "object", "array", "integer":
+		return "an " + schemaType
+	}
+	return "a " + schemaType
+}
+
+// isMissing treats an empty string like an absent field, as binding's required did.
+func isMissing(value interface{}) bool {
+	return value == nil || value == ""
+}
+
+func inEnum(enum []interface{}, value interface{}) bool {
+	for _, allowed := range enum {
+		if allowed == value {
+			return true
+		}
+	}
+	return false
+}
+
+func enumList(enum []interface{}) string {
+	values := make([]string, len(enum))
+	for i, allowed := range enum {
+		values[i] = fmt.Sprint(allowed)
+	}
+	return strings.Join(values, ", ")
+}
+
+func joinPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func fieldName(path string) string {
+	if path == "" {
+		return "Body"
+	}
+	return path
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"daria.com/jobScheduler/api"
+	"github.com/gin-gonic/gin"
+)
+
+const validTask = `{"apiMethod": "POST", "apiURL": "https://example.com/hook", "startFrom": "2026-10-01 12:00:00", "frequency": 60, "apiBody": {}`
+
+// taskBody returns a valid CreateTaskInput body with extra fields appended, which override
+// the valid ones since the last duplicate key wins.
+func taskBody(extra string) string {
+	if extra == "" {
+		return validTask + "}"
+	}
+	return validTask + ", " + extra + "}"
+}
+
+func TestValidateRequest(t *testing.T) {
+	tests := []struct {
+		schema string
+		body   string
+		want   []string // field:code
+	}{
+		{"CreateTaskInput", taskBody(""), nil},
+		{"CreateTaskInput", `[]`, []string{":type"}},
+
+		// integer vs number
+		{"CreateTaskInput", taskBody(`"frequency": 60.0`), nil},
+		{"CreateTaskInput", taskBody(`"frequency": 1.5`), []string{"frequency:type"}},
+		{"CreateTaskInput", taskBody(`"frequency": "60"`), []string{"frequency:type"}},
+		{"RateLimitInput", `{"ratePerSecond": 0.5, "burst": 10}`, nil},
+		{"RateLimitInput", `{"ratePerSecond": "fast", "burst": 10}`, []string{"ratePerSecond:type"}},
+
+		// required, with "" counting as missing
+		{"CreateTaskInput", `{"apiMethod": "POST", "apiURL": "", "startFrom": "2026-10-01 12:00:00", "frequency": 60}`, []string{"apiBody:required", "apiURL:required"}},
+		{"CreateTaskInput", taskBody(`"apiBody": null`), []string{"apiBody:required"}},
+		{"CreateTaskInput", taskBody(`"apiBody": []`), []string{"apiBody:type"}},
+		{"CreateTaskInput", taskBody(`"name": "", "deliveryGuarantee": ""`), nil}, // optional and empty
+
+		// enum, also through $ref
+		{"CreateTaskInput", taskBody(`"apiMethod": "FETCH"`), []string{"apiMethod:enum"}},
+		{"CreateTaskInput", taskBody(`"deliveryGuarantee": "sometimes"`), []string{"deliveryGuarantee:enum"}},
+		{"CreateTaskInput", taskBody(`"deliveryGuarantee": "atMostOnce"`), nil},
+		{"NotificationRuleInput", `{"events": ["failure", "sometimes"], "channel": "email"}`, []string{"events[1]:enum"}},
+
+		// minimum, maximum, maxLength
+		{"CreateTaskInput", taskBody(`"frequency": 0`), []string{"frequency:minimum"}},
+		{"NotificationRuleInput", `{"events": ["failure"], "channel": "email", "consecutiveFailures": 1}`, []string{"consecutiveFailures:minimum"}},
+		{"NotificationRuleInput", `{"events": ["failure"], "channel": "email", "consecutiveFailures": 1001}`, []string{"consecutiveFailures:maximum"}},
+		{"RateLimitInput", `{"ratePerSecond": 1, "burst": 0}`, []string{"burst:minimum"}},
+		{"CreateTaskInput", taskBody(fmt.Sprintf(`"name": %q`, strings.Repeat("é", 128))), nil},
+		{"CreateTaskInput", taskBody(fmt.Sprintf(`"name": %q`, strings.Repeat("é", 129))), []string{"name:maxLength"}},
+
+		// minItems, maxItems
+		{"NotificationRuleInput", `{"events": [], "channel": "email"}`, []string{"events:minItems"}},
+		{"NotificationRuleInput", `{"events": ["failure", "failure", "failure", "failure", "failure"], "channel": "email"}`, []string{"events:maxItems"}},
+
+		// formats
+		{"CreateTaskInput", taskBody(`"startFrom": "2026-10-01T12:00:00Z"`), []string{"startFrom:format"}},
+		{"CreateTaskInput", taskBody(`"startFrom": "2026-02-30 12:00:00"`), []string{"startFrom:format"}},
+		{"CreateTaskInput", taskBody(`"apiURL": "ftp://example.com/file"`), []string{"apiURL:format"}},
+		{"CreateTaskInput", taskBody(`"apiURL": "https://"`), []string{"apiURL:format"}},
+		{"CreateTaskInput", taskBody(`"apiURL": "example.com/hook"`), []string{"apiURL:format"}},
+		{"CreateTaskInput", taskBody(`"apiURL": "http://10.0.0.1:8080/hook?x=1"`), nil},
+		{"NotificationRuleInput", `{"events": ["failure"], "channel": "email", "emailTo": ["ops@example.com", "Ops <ops@example.com>", "ops"]}`, []string{"emailTo[1]:format", "emailTo[2]:format"}},
+
+		// $ref and allOf, and paths into arrays
+		{"Manifest", `{}`, []string{"tasks:required"}},
+		{"Manifest", `{"tasks": [` + taskBody(`"name": "a"`) + `, ` + taskBody(`"name": "b", "apiURL": "nope"`) + `]}`, []string{"tasks[1].apiURL:format"}},
+		{"Manifest", `{"tasks": [` + taskBody(`"name": "a"`) + `, ` + taskBody(`"name": "b"`) + `, ` + taskBody(`"name": "c"`) + `, ` + taskBody(`"name": "d", "apiURL": "nope"`) + `]}`, []string{"tasks[3].apiURL:format"}},
+		{"Manifest", `{"tasks": [` + taskBody("") + `, {"name": "b", "frequency": -1}]}`, []string{
+			"tasks[0].name:required", "tasks[1].apiBody:required", "tasks[1].apiMethod:required", "tasks[1].apiURL:required",
+			"tasks[1].frequency:minimum", "tasks[1].startFrom:required",
+		}},
+	}
+	for _, test := range tests {
+		err := validateRequest(test.schema, []byte(test.body))
+		var errs fieldErrors
+		if err != nil && !errors.As(err, &errs) {
+			t.Errorf("%s %s: %v is not a field error", test.schema, test.body, err)
+			continue
+		}
+		var got []string
+		for _, fieldErr := range errs {
+			got = append(got, fieldErr.Field+":"+fieldErr.Code)
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%s %s: got %q; want %q", test.schema, test.body, got, test.want)
+		}
+	}
+}
+
+func TestValidateRequestMessages(t *testing.T) {
+	body := `{"tasks": [` + taskBody(`"name": "a"`) + `, ` + taskBody(`"name": "b", "apiURL": "nope", "frequency": 0.5`) + `]}`
+	var errs fieldErrors
+	if !errors.As(validateRequest("Manifest", []byte(body)), &errs) {
+		t.Fatal("want field errors")
+	}
+	want := "tasks[1].apiURL must be an http or https URL; tasks[1].frequency must be an integer"
+	if errs.Error() != want {
+		t.Fatalf("message = %q; want %q", errs.Error(), want)
+	}
+
+	err := validateRequest("CreateTaskInput", []byte(`{"apiMethod": `))
+	if err == nil || errors.As(err, &errs) || !strings.HasPrefix(err.Error(), "Body must be valid JSON") {
+		t.Fatalf("invalid JSON = %v; want a plain error", err)
+	}
+}
+
+// TestRoutesAreDocumented keeps registerRoutes and openapi.json in step.
+func TestRoutesAreDocumented(t *testing.T) {
+	var document struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(api.OpenAPI, &document); err != nil {
+		t.Fatal(err)
+	}
+	documented := make(map[string]bool)
+	for path, operations := range document.Paths {
+		for method := range operations {
+			if method != "parameters" {
+				documented[strings.ToUpper(method)+" "+path] = true
+			}
+		}
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	registerRoutes(router.Group("/v1"))
+	registered := make(map[string]bool)
+	for _, route := range router.Routes() {
+		segments := strings.Split(strings.ReplaceAll(strings.TrimPrefix(route.Path, "/v1"), `\:`, ":"), "/")
+		for i, segment := range segments {
+			if strings.HasPrefix(segment, ":") {
+				segments[i] = "{" + segment[1:] + "}"
+			}
+		}
+		registered[route.Method+" "+strings.Join(segments, "/")] = true
+	}
+
+	for route := range registered {
+		if !documented[route] {
+			t.Errorf("%s is not in openapi.json", route)
+		}
+	}
+	for route := range documented {
+		if !registered[route] {
+			t.Errorf("%s is in openapi.json but not registered", route)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package scheduler
+
+import (
+	"sync"
+	"time"
+)
+
+// FakeClock is a Clock that only moves when told to. Its timers fire once Advance or Set
+// moves the clock past their deadline.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// NewFakeClock returns a FakeClock reading the given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTimer{clock: c, ch: make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	t.resetLocked(d)
+	return t
+}
+
+// Advance moves the clock forward by d.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setLocked(c.now.Add(d))
+}
+
+// Set moves the clock to t. Moving it backwards is allowed but fires nothing.
+func (c *FakeClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setLocked(t)
+}
+
+// Waiters returns the number of timers that have not fired or been stopped, so a test
+// can wait until the scheduler is asleep before advancing the clock.
+func (c *FakeClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for _, t := range c.timers {
+		if t.active {
+			n++
+		}
+	}
+	return n
+}
+
+func (c *FakeClock) setLocked(now time.Time) {
+	c.now = now
+	for _, t := range c.timers {
+		t.fireLocked()
+	}
+}
+
+type fakeTimer struct {
+	clock    *FakeClock
+	ch       chan time.Time
+	deadline time.Time
+	active   bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.ch }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	wasActive := t.active
+	t.active = false
+	return wasActive
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	return t.resetLocked(d)
+}
+
+func (t *fakeTimer) resetLocked(d time.Duration) bool {
+	wasActive := t.active
+	t.deadline = t.clock.now.Add(d)
+	t.active = true
+	t.fireLocked()
+	return wasActive
+}
+
+func (t *fakeTimer) fireLocked() {
+	if !t.active || t.deadline.After(t.clock.now) {
+		return
+	}
+	t.active = false
+	// Like time.Timer, a value nobody has received yet is not overwritten
+	select {
+	case t.ch <- t.clock.now:
+	default:
+	}
+}
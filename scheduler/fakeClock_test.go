@@ -0,0 +1,134 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+// fired reports whether the timer's channel holds a value, and receives it.
+func fired(timer Timer) (time.Time, bool) {
+	select {
+	case at := <-timer.C():
+		return at, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func TestFakeClockMovesOnlyWhenTold(t *testing.T) {
+	c := NewFakeClock(testEpoch)
+	if !c.Now().Equal(testEpoch) {
+		t.Fatalf("Now() = %s; want %s", c.Now(), testEpoch)
+	}
+	c.Advance(90 * time.Second)
+	if want := testEpoch.Add(90 * time.Second); !c.Now().Equal(want) {
+		t.Fatalf("Now() = %s after Advance; want %s", c.Now(), want)
+	}
+	c.Set(testEpoch)
+	if !c.Now().Equal(testEpoch) {
+		t.Fatalf("Now() = %s after Set; want %s", c.Now(), testEpoch)
+	}
+}
+
+func TestFakeTimerFiresAtItsDeadline(t *testing.T) {
+	c := NewFakeClock(testEpoch)
+	timer := c.NewTimer(10 * time.Second)
+	if c.Waiters() != 1 {
+		t.Fatalf("Waiters() = %d; want 1", c.Waiters())
+	}
+
+	c.Advance(9 * time.Second)
+	if at, ok := fired(timer); ok {
+		t.Fatalf("fired at %s, before its deadline", at)
+	}
+	c.Advance(5 * time.Second)
+	at, ok := fired(timer)
+	if !ok {
+		t.Fatal("did not fire once the clock passed its deadline")
+	}
+	if want := testEpoch.Add(14 * time.Second); !at.Equal(want) {
+		t.Fatalf("fired with %s; want the clock's time %s", at, want)
+	}
+	if c.Waiters() != 0 {
+		t.Fatalf("Waiters() = %d after firing; want 0", c.Waiters())
+	}
+	c.Advance(time.Hour)
+	if _, ok := fired(timer); ok {
+		t.Fatal("fired twice")
+	}
+}
+
+func TestFakeTimerStopAndReset(t *testing.T) {
+	c := NewFakeClock(testEpoch)
+	timer := c.NewTimer(10 * time.Second)
+
+	if !timer.Stop() {
+		t.Fatal("Stop() = false on an active timer")
+	}
+	if timer.Stop() {
+		t.Fatal("Stop() = true on a stopped timer")
+	}
+	c.Advance(time.Minute)
+	if _, ok := fired(timer); ok {
+		t.Fatal("a stopped timer fired")
+	}
+
+	// Reset counts from the clock's current time
+	if timer.Reset(10 * time.Second) {
+		t.Fatal("Reset() = true on a stopped timer")
+	}
+	c.Advance(9 * time.Second)
+	if !timer.Reset(10 * time.Second) {
+		t.Fatal("Reset() = false on an active timer")
+	}
+	c.Advance(9 * time.Second)
+	if _, ok := fired(timer); ok {
+		t.Fatal("fired at the deadline it had before Reset")
+	}
+	c.Advance(time.Second)
+	if _, ok := fired(timer); !ok {
+		t.Fatal("did not fire at the deadline set by Reset")
+	}
+}
+
+func TestFakeTimerDueImmediately(t *testing.T) {
+	c := NewFakeClock(testEpoch)
+	if _, ok := fired(c.NewTimer(0)); !ok {
+		t.Fatal("NewTimer(0) did not fire")
+	}
+	timer := c.NewTimer(time.Hour)
+	timer.Reset(-time.Second)
+	if _, ok := fired(timer); !ok {
+		t.Fatal("Reset to a negative duration did not fire")
+	}
+}
+
+func TestFakeTimerKeepsAnUnreceivedValue(t *testing.T) {
+	c := NewFakeClock(testEpoch)
+	timer := c.NewTimer(time.Second)
+	c.Advance(time.Second)
+	timer.Reset(time.Second)
+	c.Advance(time.Second)
+
+	// Like time.Timer, the second fire is dropped rather than replacing the first
+	at, ok := fired(timer)
+	if !ok || !at.Equal(testEpoch.Add(time.Second)) {
+		t.Fatalf("received %s, %v; want the first fire at %s", at, ok, testEpoch.Add(time.Second))
+	}
+	if _, ok := fired(timer); ok {
+		t.Fatal("received a second value")
+	}
+}
+
+func TestFakeClockSetBackwardsFiresNothing(t *testing.T) {
+	c := NewFakeClock(testEpoch)
+	timer := c.NewTimer(time.Second)
+	c.Set(testEpoch.Add(-time.Hour))
+	if _, ok := fired(timer); ok {
+		t.Fatal("moving the clock back fired a timer")
+	}
+	c.Set(testEpoch.Add(time.Second))
+	if _, ok := fired(timer); !ok {
+		t.Fatal("did not fire once the clock reached its deadline")
+	}
+}
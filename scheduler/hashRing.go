@@ -0,0 +1,71 @@
+package scheduler
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// HashRing assigns keys to nodes by consistent hashing. Each node is placed on the ring
+// at several points (virtual nodes) so keys spread evenly, and adding or removing a node
+// only moves the keys next to its points. A HashRing is immutable; build a new one when
+// membership changes.
+type HashRing struct {
+	nodes  []string
+	points []uint32
+	owners map[uint32]string
+}
+
+// NewHashRing places each node on the ring at virtualNodes points.
+func NewHashRing(nodes []string, virtualNodes int) *HashRing {
+	if virtualNodes < 1 {
+		virtualNodes = 1
+	}
+	r := &HashRing{
+		nodes:  append([]string(nil), nodes...),
+		owners: make(map[uint32]string, len(nodes)*virtualNodes),
+	}
+	sort.Strings(r.nodes)
+
+	for _, node := range r.nodes {
+		for i := 0; i < virtualNodes; i++ {
+			point := hashKey(node + "#" + strconv.Itoa(i))
+			// On the rare collision keep the smaller node ID, so every instance builds the same ring
+			if owner, ok := r.owners[point]; ok && owner < node {
+				continue
+			}
+			if _, ok := r.owners[point]; !ok {
+				r.points = append(r.points, point)
+			}
+			r.owners[point] = node
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// Owner returns the node responsible for key, or "" if the ring has no nodes.
+func (r *HashRing) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0 // wrap around
+	}
+	return r.owners[r.points[i]]
+}
+
+// Nodes returns the ring's members in sorted order.
+func (r *HashRing) Nodes() []string {
+	return append([]string(nil), r.nodes...)
+}
+
+// hashKey uses SHA-256 rather than a faster hash because node and task IDs share long
+// prefixes, which FNV spreads unevenly around the ring.
+func hashKey(key string) uint32 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
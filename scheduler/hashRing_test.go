@@ -0,0 +1,107 @@
+package scheduler
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func ringKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("user_%d_task_%d", i%97, i)
+	}
+	return keys
+}
+
+func ringNodes(n int) []string {
+	nodes := make([]string, n)
+	for i := range nodes {
+		nodes[i] = fmt.Sprintf("ip-10-0-1-%d.ec2.internal", i+10)
+	}
+	return nodes
+}
+
+func TestHashRingEmpty(t *testing.T) {
+	for _, r := range []*HashRing{NewHashRing(nil, 64), NewHashRing([]string{}, 0)} {
+		if owner := r.Owner("user_1_task_1"); owner != "" {
+			t.Fatalf("an empty ring assigned a key to %q", owner)
+		}
+		if nodes := r.Nodes(); len(nodes) != 0 {
+			t.Fatalf("an empty ring has nodes %v", nodes)
+		}
+	}
+	// Fewer than one virtual node still places the node
+	if owner := NewHashRing([]string{"a"}, 0).Owner("user_1_task_1"); owner != "a" {
+		t.Fatalf("a single-node ring assigned a key to %q", owner)
+	}
+}
+
+func TestHashRingDistribution(t *testing.T) {
+	nodes := ringNodes(5)
+	r := NewHashRing(nodes, 64)
+	keys := ringKeys(50_000)
+	counts := make(map[string]int)
+	for _, key := range keys {
+		counts[r.Owner(key)]++
+	}
+
+	fair := len(keys) / len(nodes)
+	for _, node := range nodes {
+		if n := counts[node]; n < fair*6/10 || n > fair*14/10 {
+			t.Errorf("%s owns %d keys; a fair share is %d", node, n, fair)
+		}
+	}
+	if len(counts) != len(nodes) {
+		t.Fatalf("keys went to %d owners: %v", len(counts), counts)
+	}
+
+	// Every instance must build the same ring whatever order it lists the members in
+	shuffled := NewHashRing([]string{nodes[3], nodes[0], nodes[4], nodes[2], nodes[1]}, 64)
+	if !slices.Equal(shuffled.Nodes(), r.Nodes()) {
+		t.Fatalf("Nodes() = %v; want %v", shuffled.Nodes(), r.Nodes())
+	}
+	for _, key := range keys[:1000] {
+		if shuffled.Owner(key) != r.Owner(key) {
+			t.Fatalf("%s is owned by %s or %s depending on member order", key, shuffled.Owner(key), r.Owner(key))
+		}
+	}
+}
+
+func TestHashRingMovesFewKeys(t *testing.T) {
+	nodes := ringNodes(5)
+	before := NewHashRing(nodes[:4], 64)
+	after := NewHashRing(nodes, 64)
+	keys := ringKeys(20_000)
+
+	// A joining node only takes keys; nobody else's change hands
+	moved := 0
+	for _, key := range keys {
+		if from, to := before.Owner(key), after.Owner(key); from != to {
+			if to != nodes[4] {
+				t.Fatalf("%s moved from %s to %s when %s joined", key, from, to, nodes[4])
+			}
+			moved++
+		}
+	}
+	if share := float64(moved) / float64(len(keys)); share < 0.1 || share > 0.3 {
+		t.Fatalf("%.0f%% of keys moved when a fifth node joined; want about 20%%", share*100)
+	}
+
+	// A leaving node's keys are spread over the others, and only its keys move
+	left := NewHashRing(slices.Delete(slices.Clone(nodes), 1, 2), 64)
+	receivers := make(map[string]bool)
+	for _, key := range keys {
+		from, to := after.Owner(key), left.Owner(key)
+		if from != nodes[1] {
+			if to != from {
+				t.Fatalf("%s moved from %s to %s when %s left", key, from, to, nodes[1])
+			}
+			continue
+		}
+		receivers[to] = true
+	}
+	if len(receivers) < 3 {
+		t.Fatalf("the leaving node's keys went to %d nodes; want them spread", len(receivers))
+	}
+}
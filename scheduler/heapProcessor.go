@@ -0,0 +1,100 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// heapProcessor dispatches due jobs until ctx is done. Between dispatches it waits on a
+// single timer set for the next job, or on the wake channel when the queue changes.
+// Because wake leaves a token in the buffered channel, a job queued at any point after
+// the queue was examined still interrupts the following wait.
+func (s *Scheduler) heapProcessor(ctx context.Context) {
+	callerMethod := "heapProcessor"
+	timer := s.clock.NewTimer(s.maxSleep)
+	defer timer.Stop()
+
+	for {
+		sleepDuration := s.dispatchDue()
+
+		// Stop and drain so a stale fire can't cut the new wait short
+		if !timer.Stop() {
+			select {
+			case <-timer.C():
+			default:
+			}
+		}
+		timer.Reset(sleepDuration)
+		s.log(callerMethod, fmt.Sprintf("Sleeping for %s", sleepDuration))
+		if s.beforeSleep != nil {
+			s.beforeSleep()
+		}
+
+		select {
+		case <-ctx.Done():
+			s.log(callerMethod, "Stopped")
+			return
+		case <-s.wakeCh:
+			s.log(callerMethod, "Woken up by a queue change")
+		case <-timer.C():
+			s.log(callerMethod, fmt.Sprintf("Slept for %s", sleepDuration))
+		}
+	}
+}
+
+// dispatchDue hands every due job to the Executor and returns how long to wait for the next one.
+func (s *Scheduler) dispatchDue() time.Duration {
+	callerMethod := "dispatchDue"
+	s.queueLock.Lock() // Lock the queue to safely access/modify it
+	defer s.queueLock.Unlock()
+
+	s.log(callerMethod, fmt.Sprintf("jobQueue size %d", s.jobQueue.Len()))
+	currTime := s.clock.Now().Unix()
+	for {
+		job, ok := s.jobQueue.PopDue(currTime)
+		if !ok {
+			break
+		}
+		s.log(callerMethod, fmt.Sprintf("Calling executor for jobId: %s with time %d", job.ID, job.Time))
+		//Instead of executing the jobs one at a time, execute them concurrently using go routines. The execution may take time.
+		s.startExecution(job)
+	}
+
+	sleepDuration := s.maxSleep
+	if next, ok := s.jobQueue.NextTime(); ok {
+		s.log(callerMethod, fmt.Sprintf("Next wake-up for jobs at %s", time.Unix(next, 0).Format("2006-01-02 15:04:05")))
+		if d := time.Duration(next-currTime) * time.Second; d < sleepDuration {
+			sleepDuration = d
+		}
+	}
+	s.nextWake = currTime + int64(sleepDuration/time.Second)
+	return sleepDuration
+}
+
+// startExecution runs the job on its own goroutine and tracks it until it finishes.
+func (s *Scheduler) startExecution(job Job) {
+	s.runningLock.Lock()
+	s.running[job.ID] = s.clock.Now()
+	s.runningLock.Unlock()
+	s.inFlight.Add(1)
+
+	ctx := s.execCtx
+	go func() {
+		defer func() {
+			s.runningLock.Lock()
+			delete(s.running, job.ID)
+			s.runningLock.Unlock()
+			s.inFlight.Done()
+		}()
+		s.execute(ctx, job)
+	}()
+}
+
+// execute hands a due job to the Executor and queues the task's next run, if any.
+func (s *Scheduler) execute(ctx context.Context, job Job) {
+	next, again := s.executor.Execute(ctx, job.ID)
+	if again {
+		s.Schedule(job.ID, next)
+	}
+}
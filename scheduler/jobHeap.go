@@ -0,0 +1,95 @@
+package scheduler
+
+import "container/heap"
+
+// jobHeap is the default Queue: a min-heap of jobs ordered by Time. index maps a task ID
+// to the job's position in items, so a job can be removed or rescheduled in O(log n)
+// instead of being left in the queue and skipped later.
+type jobHeap struct {
+	items []Job
+	index map[string]int
+}
+
+func newJobHeap() *jobHeap {
+	return &jobHeap{
+		items: make([]Job, 0),
+		index: make(map[string]int),
+	}
+}
+
+// Implementing heap.Interface methods for jobHeap
+func (h *jobHeap) Len() int           { return len(h.items) }
+func (h *jobHeap) Less(i, j int) bool { return h.items[i].Time < h.items[j].Time }
+func (h *jobHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.index[h.items[i].ID] = i
+	h.index[h.items[j].ID] = j
+}
+
+func (h *jobHeap) Peek() Job {
+	if len(h.items) == 0 {
+		return Job{} // Return an empty Job if the heap is empty
+	}
+	return h.items[0]
+}
+
+// Push and Pop are for container/heap only; use heap.Push/heap.Pop or the methods below.
+func (h *jobHeap) Push(x interface{}) {
+	job := x.(Job)
+	h.index[job.ID] = len(h.items)
+	h.items = append(h.items, job)
+}
+
+// Pop removes the last element: heap.Pop has already swapped the minimum there.
+func (h *jobHeap) Pop() interface{} {
+	n := len(h.items)
+	job := h.items[n-1]
+	h.items = h.items[:n-1]
+	delete(h.index, job.ID)
+	return job
+}
+
+// Upsert adds the job, or moves it to the new time if a job with the same ID is queued.
+func (h *jobHeap) Upsert(job Job) {
+	if !h.Reschedule(job.ID, job.Time) {
+		heap.Push(h, job)
+	}
+}
+
+// Remove takes the job with the given ID out of the heap. It reports whether it was queued.
+func (h *jobHeap) Remove(id string) (Job, bool) {
+	i, ok := h.index[id]
+	if !ok {
+		return Job{}, false
+	}
+	return heap.Remove(h, i).(Job), true
+}
+
+// Reschedule moves a queued job to a new time. It reports whether the job was queued.
+func (h *jobHeap) Reschedule(id string, time int64) bool {
+	i, ok := h.index[id]
+	if !ok {
+		return false
+	}
+	h.items[i].Time = time
+	heap.Fix(h, i)
+	return true
+}
+
+func (h *jobHeap) PopDue(now int64) (Job, bool) {
+	if len(h.items) == 0 || h.items[0].Time > now {
+		return Job{}, false
+	}
+	return heap.Pop(h).(Job), true
+}
+
+func (h *jobHeap) NextTime() (int64, bool) {
+	if len(h.items) == 0 {
+		return 0, false
+	}
+	return h.items[0].Time, true
+}
+
+func (h *jobHeap) Jobs() []Job {
+	return append([]Job(nil), h.items...)
+}
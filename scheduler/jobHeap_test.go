@@ -0,0 +1,205 @@
+package scheduler
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"testing"
+)
+
+// queueModel is the reference the Queue implementations are checked against: a slice of
+// jobs kept sorted by time, then ID.
+type queueModel struct {
+	jobs []Job
+}
+
+func (m *queueModel) find(id string) int {
+	return slices.IndexFunc(m.jobs, func(job Job) bool { return job.ID == id })
+}
+
+func (m *queueModel) upsert(job Job) {
+	if i := m.find(job.ID); i >= 0 {
+		m.jobs = slices.Delete(m.jobs, i, i+1)
+	}
+	i := sort.Search(len(m.jobs), func(i int) bool {
+		return m.jobs[i].Time > job.Time || (m.jobs[i].Time == job.Time && m.jobs[i].ID >= job.ID)
+	})
+	m.jobs = slices.Insert(m.jobs, i, job)
+}
+
+func (m *queueModel) remove(id string) (Job, bool) {
+	i := m.find(id)
+	if i < 0 {
+		return Job{}, false
+	}
+	job := m.jobs[i]
+	m.jobs = slices.Delete(m.jobs, i, i+1)
+	return job, true
+}
+
+func (m *queueModel) reschedule(id string, time int64) bool {
+	if m.find(id) < 0 {
+		return false
+	}
+	m.upsert(Job{ID: id, Time: time})
+	return true
+}
+
+// queueTimes draws the time of a job relative to now.
+type queueTimes func(rng *rand.Rand, now int64) int64
+
+// checkQueue applies ops random operations to q and to the model and fails at the first
+// difference. now only moves forward, as it does in the scheduler. If ordered is set,
+// PopDue must return the earliest job and NextTime its exact time; otherwise PopDue may
+// return any due job and NextTime may be early, or up to now if a job is overdue.
+func checkQueue(t *testing.T, q Queue, rng *rand.Rand, now int64, ops int, times queueTimes, ordered bool) {
+	t.Helper()
+	model := &queueModel{}
+	ids := make([]string, 64)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("task_%d", i)
+	}
+
+	for op := 0; op < ops; op++ {
+		id := ids[rng.IntN(len(ids))]
+		switch r := rng.IntN(100); {
+		case r < 35:
+			job := Job{ID: id, Time: times(rng, now)}
+			q.Upsert(job)
+			model.upsert(job)
+		case r < 50:
+			got, ok := q.Remove(id)
+			want, wantOK := model.remove(id)
+			if ok != wantOK || got != want {
+				t.Fatalf("op %d: Remove(%s) = %v, %v; want %v, %v", op, id, got, ok, want, wantOK)
+			}
+		case r < 65:
+			time := times(rng, now)
+			if ok, wantOK := q.Reschedule(id, time), model.reschedule(id, time); ok != wantOK {
+				t.Fatalf("op %d: Reschedule(%s, %d) = %v; want %v", op, id, time, ok, wantOK)
+			}
+		case r < 75:
+			now += rng.Int64N(600)
+		default:
+			job, ok := q.PopDue(now)
+			due := len(model.jobs) > 0 && model.jobs[0].Time <= now
+			if ok != due {
+				t.Fatalf("op %d: PopDue(%d) returned %v; want a job: %v (earliest %v)", op, now, ok, due, model.jobs)
+			}
+			if !ok {
+				break
+			}
+			if job.Time > now {
+				t.Fatalf("op %d: PopDue(%d) returned %v, which is not due", op, now, job)
+			}
+			if ordered && job.Time != model.jobs[0].Time {
+				t.Fatalf("op %d: PopDue(%d) returned %v; want the earliest, at %d", op, now, job, model.jobs[0].Time)
+			}
+			if want, wantOK := model.remove(job.ID); !wantOK || want != job {
+				t.Fatalf("op %d: PopDue returned %v; the model has %v, %v", op, job, want, wantOK)
+			}
+		}
+
+		if q.Len() != len(model.jobs) {
+			t.Fatalf("op %d: Len() = %d; want %d", op, q.Len(), len(model.jobs))
+		}
+		next, ok := q.NextTime()
+		if ok != (len(model.jobs) > 0) {
+			t.Fatalf("op %d: NextTime() reported %v with %d jobs queued", op, ok, len(model.jobs))
+		}
+		if !ok {
+			continue
+		}
+		latest := model.jobs[0].Time
+		if !ordered {
+			latest = max(latest, now)
+		}
+		if next > latest || (ordered && next != model.jobs[0].Time) {
+			t.Fatalf("op %d: NextTime() = %d; the earliest job is at %d", op, next, model.jobs[0].Time)
+		}
+	}
+
+	jobs := q.Jobs()
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Time < jobs[j].Time || (jobs[i].Time == jobs[j].Time && jobs[i].ID < jobs[j].ID)
+	})
+	if !slices.Equal(jobs, model.jobs) {
+		t.Fatalf("Jobs() = %v; want %v", jobs, model.jobs)
+	}
+}
+
+// checkHeapInvariants fails unless every item is at the position index records and no
+// parent is later than its children.
+func checkHeapInvariants(t *testing.T, h *jobHeap) {
+	t.Helper()
+	if len(h.index) != len(h.items) {
+		t.Fatalf("index has %d entries for %d items", len(h.index), len(h.items))
+	}
+	for i, job := range h.items {
+		if h.index[job.ID] != i {
+			t.Fatalf("index[%s] = %d; the job is at %d", job.ID, h.index[job.ID], i)
+		}
+		if parent := (i - 1) / 2; i > 0 && h.items[parent].Time > job.Time {
+			t.Fatalf("item %d (%v) is earlier than its parent %v", i, job, h.items[parent])
+		}
+	}
+}
+
+func TestJobHeapMatchesModel(t *testing.T) {
+	// Few distinct times, so ties are common
+	times := func(rng *rand.Rand, now int64) int64 { return now - 300 + rng.Int64N(1200) }
+	for seed := uint64(1); seed <= 50; seed++ {
+		t.Run(fmt.Sprint(seed), func(t *testing.T) {
+			h := newJobHeap()
+			checkQueue(t, h, rand.New(rand.NewPCG(seed, 28)), 1_700_000_000, 2000, times, true)
+			checkHeapInvariants(t, h)
+		})
+	}
+}
+
+func TestJobHeapPopsInTimeOrder(t *testing.T) {
+	rng := rand.New(rand.NewPCG(7, 28))
+	h := newJobHeap()
+	for i := 0; i < 1000; i++ {
+		h.Upsert(Job{ID: fmt.Sprintf("task_%d", i), Time: rng.Int64N(500)})
+	}
+	for i := 0; i < 300; i++ {
+		h.Reschedule(fmt.Sprintf("task_%d", rng.IntN(1000)), rng.Int64N(500))
+		h.Remove(fmt.Sprintf("task_%d", rng.IntN(1000)))
+	}
+	checkHeapInvariants(t, h)
+
+	want := h.Len()
+	last := int64(-1)
+	for n := 0; n < want; n++ {
+		job, ok := h.PopDue(500)
+		if !ok {
+			t.Fatalf("PopDue stopped after %d of %d jobs", n, want)
+		}
+		if job.Time < last {
+			t.Fatalf("PopDue returned %v after a job at %d", job, last)
+		}
+		last = job.Time
+	}
+	if h.Len() != 0 || len(h.index) != 0 {
+		t.Fatalf("heap not empty after popping every job: %d items, %d indexed", h.Len(), len(h.index))
+	}
+}
+
+func TestJobHeapPopDueLeavesFutureJobs(t *testing.T) {
+	h := newJobHeap()
+	h.Upsert(Job{ID: "a", Time: 100})
+	h.Upsert(Job{ID: "b", Time: 200})
+	h.Upsert(Job{ID: "a", Time: 300}) // moves a rather than queueing it twice
+
+	if job, ok := h.PopDue(250); !ok || job.ID != "b" {
+		t.Fatalf("PopDue(250) = %v, %v; want b", job, ok)
+	}
+	if job, ok := h.PopDue(250); ok {
+		t.Fatalf("PopDue(250) = %v; want nothing until 300", job)
+	}
+	if next, _ := h.NextTime(); next != 300 {
+		t.Fatalf("NextTime() = %d; want 300", next)
+	}
+}
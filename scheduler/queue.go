@@ -0,0 +1,39 @@
+package scheduler
+
+// Queue holds the pending jobs. The scheduler guards it with its own lock, so
+// implementations need not be safe for concurrent use. Every job ID is queued at most once.
+type Queue interface {
+	Len() int
+	// Upsert adds the job, or moves it to the new time if a job with the same ID is queued.
+	Upsert(job Job)
+	// Remove takes the job with the given ID out of the queue. It reports whether it was queued.
+	Remove(id string) (Job, bool)
+	// Reschedule moves a queued job to a new time. It reports whether the job was queued.
+	Reschedule(id string, time int64) bool
+	// PopDue removes and returns a job whose time is at or before now, if there is one.
+	PopDue(now int64) (Job, bool)
+	// NextTime returns the earliest time at which PopDue may next return a job. It may be
+	// earlier than the next job's time, but never later, except that a job that is
+	// already due may be reported at the time of the last PopDue instead of its own.
+	NextTime() (int64, bool)
+	// Jobs returns a snapshot of the queued jobs in no particular order.
+	Jobs() []Job
+}
+
+// Queue implementations selectable by name, e.g. from configuration.
+const (
+	QueueHeap  = "heap"
+	QueueWheel = "wheel"
+)
+
+// NewQueue returns an empty queue of the named kind. now is the current Unix time, which
+// the timing wheel starts from.
+func NewQueue(kind string, now int64) (Queue, bool) {
+	switch kind {
+	case "", QueueHeap:
+		return newJobHeap(), true
+	case QueueWheel:
+		return newTimingWheel(now), true
+	}
+	return nil, false
+}
@@ -0,0 +1,80 @@
+package scheduler
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"testing"
+)
+
+// BenchmarkQueue times the operations the scheduler performs on each Queue at sizes a
+// busy deployment reaches, with the jobs spread over the next week. Each operation keeps
+// the queue at its size. Run it with
+//
+//	go test -run '^$' -bench Queue ./scheduler
+func BenchmarkQueue(b *testing.B) {
+	const week = 7 * 24 * 60 * 60
+	for _, size := range []int{100_000, 1_000_000} {
+		for _, kind := range []string{QueueHeap, QueueWheel} {
+			b.Run(fmt.Sprintf("%s/%d", kind, size), func(b *testing.B) {
+				ids := make([]string, size)
+				for i := range ids {
+					ids[i] = fmt.Sprintf("task_%d", i)
+				}
+				// fill returns a queue of size jobs and the time it starts at
+				fill := func(rng *rand.Rand) (Queue, int64) {
+					now := int64(1_700_000_000)
+					q, _ := NewQueue(kind, now)
+					for _, id := range ids {
+						q.Upsert(Job{ID: id, Time: now + 1 + rng.Int64N(week)})
+					}
+					return q, now
+				}
+
+				b.Run("Upsert", func(b *testing.B) {
+					rng := rand.New(rand.NewPCG(1, 36))
+					q, now := fill(rng)
+					i := 0
+					for b.Loop() {
+						q.Upsert(Job{ID: ids[i%size], Time: now + 1 + rng.Int64N(week)})
+						i++
+					}
+				})
+				b.Run("Reschedule", func(b *testing.B) {
+					rng := rand.New(rand.NewPCG(2, 36))
+					q, now := fill(rng)
+					i := 0
+					for b.Loop() {
+						q.Reschedule(ids[i%size], now+1+rng.Int64N(week))
+						i++
+					}
+				})
+				b.Run("RemoveAndUpsert", func(b *testing.B) {
+					rng := rand.New(rand.NewPCG(3, 36))
+					q, _ := fill(rng)
+					i := 0
+					for b.Loop() {
+						job, _ := q.Remove(ids[i%size])
+						q.Upsert(job)
+						i++
+					}
+				})
+				// Each op is one second of dispatching: every job due then is popped and
+				// queued again a random time up to a week later, as its next run
+				b.Run("PopDuePerSecond", func(b *testing.B) {
+					rng := rand.New(rand.NewPCG(4, 36))
+					q, now := fill(rng)
+					for b.Loop() {
+						now++
+						for {
+							job, ok := q.PopDue(now)
+							if !ok {
+								break
+							}
+							q.Upsert(Job{ID: job.ID, Time: now + 1 + rng.Int64N(week)})
+						}
+					}
+				})
+			})
+		}
+	}
+}
@@ -0,0 +1,355 @@
+// Package scheduler keeps an in-memory queue of pending task executions and dispatches
+// each one to an Executor when it falls due. Persistence, execution and logging are
+// injected so the scheduler can be embedded in other services or driven by a test.
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Job is a single pending execution of a task.
+type Job struct {
+	ID   string
+	Time int64 // Unix seconds
+}
+
+// Executor runs a task. It returns the time of the task's next run, or false if the
+// task should not be scheduled again.
+type Executor interface {
+	Execute(ctx context.Context, taskID string) (next time.Time, again bool)
+}
+
+// Store supplies the jobs to queue when the scheduler starts.
+type Store interface {
+	LoadJobs(ctx context.Context) ([]Job, error)
+}
+
+// Logger has the same shape as the service's log function.
+type Logger func(callerMethod string, msg string)
+
+// Options configures a Scheduler. Executor is required; everything else has a default.
+type Options struct {
+	Store    Store
+	Executor Executor
+	Clock    Clock
+	Logger   Logger
+	// MaxSleep bounds how long the processor sleeps when the queue is empty or the next
+	// job is far away.
+	MaxSleep time.Duration
+	// Queue holds the pending jobs; the default is a binary heap. Use NewQueue to pick
+	// an implementation by name.
+	Queue Queue
+	// ResyncInterval, if set, reloads every job from the Store this often and merges it
+	// into the queue. Use it when other processes can add jobs to the Store.
+	ResyncInterval time.Duration
+}
+
+// Scheduler dispatches queued jobs to its Executor when they fall due.
+type Scheduler struct {
+	store    Store
+	executor Executor
+	clock    Clock
+	logger   Logger
+	maxSleep time.Duration
+	resync   time.Duration
+
+	queueLock sync.Mutex
+	jobQueue  Queue
+	// nextWake is when the processor plans to wake up, so queue changes only wake it
+	// early when they add an earlier job
+	nextWake int64
+	// wakeCh holds at most one pending wake-up for the processor
+	wakeCh chan struct{}
+
+	// lifecycle serialises Start and Stop; a Scheduler can be started again after Stop
+	lifecycle sync.Mutex
+	started   bool
+	cancel    context.CancelFunc
+	done      chan struct{}
+
+	// Executions run under execCtx, which outlives dispatching so Stop can let them finish
+	execCtx     context.Context
+	execCancel  context.CancelFunc
+	inFlight    sync.WaitGroup
+	runningLock sync.Mutex
+	running     map[string]time.Time
+
+	// beforeSleep, if set, runs on the processor each time it is about to wait. Simulate
+	// uses it to move the clock once the scheduler has nothing left to do.
+	beforeSleep func()
+}
+
+var errAlreadyStarted = errors.New("scheduler already started")
+
+// New creates a stopped Scheduler.
+func New(opts Options) *Scheduler {
+	s := &Scheduler{
+		store:    opts.Store,
+		executor: opts.Executor,
+		clock:    opts.Clock,
+		logger:   opts.Logger,
+		maxSleep: opts.MaxSleep,
+		resync:   opts.ResyncInterval,
+		jobQueue: opts.Queue,
+		wakeCh:   make(chan struct{}, 1),
+		running:  make(map[string]time.Time),
+	}
+	if s.clock == nil {
+		s.clock = RealClock{}
+	}
+	if s.jobQueue == nil {
+		s.jobQueue = newJobHeap()
+	}
+	if s.logger == nil {
+		s.logger = func(string, string) {}
+	}
+	if s.maxSleep <= 0 {
+		s.maxSleep = time.Hour
+	}
+	return s
+}
+
+// Start loads the existing jobs from the Store and starts dispatching. The scheduler runs
+// until ctx is cancelled or Stop is called. A stopped Scheduler may be started again; its
+// queue is kept and the Store's jobs are merged into it.
+func (s *Scheduler) Start(ctx context.Context) error {
+	callerMethod := "Start"
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
+	if s.started {
+		return errAlreadyStarted
+	}
+
+	s.execCtx, s.execCancel = context.WithCancel(context.WithoutCancel(ctx))
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.done = make(chan struct{})
+
+	if err := s.loadJobs(ctx); err != nil {
+		s.log(callerMethod, fmt.Sprintf("Error loading jobs: %s", err.Error()))
+		s.cancel()
+		s.execCancel()
+		close(s.done)
+		return err
+	}
+
+	s.started = true
+	var loops sync.WaitGroup
+	loops.Add(1)
+	go func() {
+		defer loops.Done()
+		s.heapProcessor(ctx)
+	}()
+	if s.store != nil && s.resync > 0 {
+		loops.Add(1)
+		go func() {
+			defer loops.Done()
+			s.resyncLoop(ctx)
+		}()
+	}
+	go func() {
+		loops.Wait()
+		close(s.done)
+	}()
+	return nil
+}
+
+// loadJobs merges every job in the Store into the queue. Tasks that are executing are
+// skipped: the Store still shows the run in progress as due, and the execution queues the
+// next run itself when it finishes.
+func (s *Scheduler) loadJobs(ctx context.Context) error {
+	if s.store == nil {
+		return nil
+	}
+	jobs, err := s.store.LoadJobs(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.queueLock.Lock()
+	defer s.queueLock.Unlock()
+	s.runningLock.Lock()
+	defer s.runningLock.Unlock()
+	loaded := 0
+	for _, job := range jobs {
+		if _, running := s.running[job.ID]; running {
+			continue
+		}
+		s.jobQueue.Upsert(job)
+		loaded++
+	}
+	s.log("loadJobs", fmt.Sprintf("Loaded %d jobs, skipped %d running", loaded, len(jobs)-loaded))
+	s.wake()
+	return nil
+}
+
+// resyncLoop reloads the Store every resync interval until ctx is done.
+func (s *Scheduler) resyncLoop(ctx context.Context) {
+	callerMethod := "resyncLoop"
+	timer := s.clock.NewTimer(s.resync)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C():
+		}
+		if err := s.loadJobs(ctx); err != nil {
+			s.log(callerMethod, fmt.Sprintf("Error reloading jobs: %s", err.Error()))
+		}
+		timer.Reset(s.resync)
+	}
+}
+
+// Stop stops dispatching new jobs and waits for running executions to finish. If ctx
+// expires first, the remaining executions are logged and their context is cancelled, and
+// Stop returns ctx's error.
+func (s *Scheduler) Stop(ctx context.Context) error {
+	callerMethod := "Stop"
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
+	if !s.started {
+		return nil
+	}
+	s.started = false
+	s.cancel()
+	<-s.done
+	s.log(callerMethod, fmt.Sprintf("Dispatching stopped, waiting for %d running executions", len(s.Running())))
+
+	drained := make(chan struct{})
+	go func() {
+		s.inFlight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		s.log(callerMethod, "All executions finished")
+		s.execCancel()
+		return nil
+	case <-ctx.Done():
+		abandoned := s.Running()
+		s.log(callerMethod, fmt.Sprintf("Abandoning %d running executions: %s", len(abandoned), strings.Join(abandoned, ", ")))
+		s.execCancel()
+		return ctx.Err()
+	}
+}
+
+// Running returns the IDs of the tasks currently being executed.
+func (s *Scheduler) Running() []string {
+	s.runningLock.Lock()
+	defer s.runningLock.Unlock()
+
+	ids := make([]string, 0, len(s.running))
+	for id := range s.running {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Schedule queues a run of the task at the given time, replacing any run already queued.
+func (s *Scheduler) Schedule(taskID string, at time.Time) {
+	startTime := time.Now()
+	callerMethod := "Schedule"
+	s.log(callerMethod, "Start")
+	s.queueLock.Lock()
+	s.log(callerMethod, "Locked the queue")
+	defer func() {
+		s.queueLock.Unlock()
+		s.endLog(callerMethod, startTime)
+	}()
+
+	// Upsert so a task is never queued twice
+	s.jobQueue.Upsert(Job{ID: taskID, Time: at.Unix()})
+	s.log(callerMethod, fmt.Sprintf("Added job %s to heap", taskID))
+	s.wakeBefore(at.Unix())
+}
+
+// Cancel drops a task's pending run so it is never dispatched. It reports whether a run
+// was queued; a run that was already dispatched may still be executing.
+func (s *Scheduler) Cancel(taskID string) bool {
+	callerMethod := "Cancel"
+	s.queueLock.Lock()
+	defer s.queueLock.Unlock()
+
+	_, ok := s.jobQueue.Remove(taskID)
+	s.log(callerMethod, fmt.Sprintf("Removed job %s from heap: %v", taskID, ok))
+	return ok
+}
+
+// Reschedule moves a task's queued run to a new time. It reports whether a run was queued.
+func (s *Scheduler) Reschedule(taskID string, at time.Time) bool {
+	callerMethod := "Reschedule"
+	s.queueLock.Lock()
+	defer s.queueLock.Unlock()
+
+	ok := s.jobQueue.Reschedule(taskID, at.Unix())
+	s.log(callerMethod, fmt.Sprintf("Rescheduled job %s to %d: %v", taskID, at.Unix(), ok))
+	if ok {
+		s.wakeBefore(at.Unix())
+	}
+	return ok
+}
+
+// Retain drops every queued job for which keep returns false and returns how many were
+// dropped. It is meant for handing tasks over to another scheduler.
+func (s *Scheduler) Retain(keep func(taskID string) bool) int {
+	callerMethod := "Retain"
+	s.queueLock.Lock()
+	defer s.queueLock.Unlock()
+
+	dropped := make([]string, 0)
+	for _, job := range s.jobQueue.Jobs() {
+		if !keep(job.ID) {
+			dropped = append(dropped, job.ID)
+		}
+	}
+	for _, id := range dropped {
+		s.jobQueue.Remove(id)
+	}
+	s.log(callerMethod, fmt.Sprintf("Dropped %d jobs", len(dropped)))
+	return len(dropped)
+}
+
+// Reload merges the Store's jobs into the queue now rather than at the next resync.
+func (s *Scheduler) Reload(ctx context.Context) error {
+	return s.loadJobs(ctx)
+}
+
+// Len returns the number of queued jobs.
+func (s *Scheduler) Len() int {
+	s.queueLock.Lock()
+	defer s.queueLock.Unlock()
+	return s.jobQueue.Len()
+}
+
+// wakeBefore wakes the processor if it plans to sleep past the given time. Callers hold queueLock.
+func (s *Scheduler) wakeBefore(time int64) {
+	if time < s.nextWake {
+		s.wake()
+	}
+}
+
+// wake makes the processor re-examine the queue, whether it is asleep now or about to be.
+func (s *Scheduler) wake() {
+	select {
+	case s.wakeCh <- struct{}{}:
+	default: // a wake-up is already pending
+	}
+}
+
+func (s *Scheduler) log(callerMethod string, msg string) {
+	s.logger(callerMethod, msg)
+}
+
+func (s *Scheduler) endLog(callerMethod string, startTime time.Time) {
+	elapsedTime := time.Since(startTime)
+	s.log(callerMethod, fmt.Sprintf("Exiting Method. Time Taken: %.0f.%03d.%06d", elapsedTime.Seconds(), elapsedTime.Milliseconds(), elapsedTime.Microseconds()))
+}
@@ -0,0 +1,420 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testEpoch = time.Unix(1_700_000_000, 0)
+
+type stubStore struct {
+	jobs []Job
+}
+
+func (s stubStore) LoadJobs(ctx context.Context) ([]Job, error) {
+	return slices.Clone(s.jobs), nil
+}
+
+// stubExecutor reports every call on calls, then runs execute if set. Without it a task
+// is not scheduled again.
+type stubExecutor struct {
+	calls   chan string
+	execute func(ctx context.Context, taskID string) (time.Time, bool)
+}
+
+func (e *stubExecutor) Execute(ctx context.Context, taskID string) (time.Time, bool) {
+	e.calls <- taskID
+	if e.execute != nil {
+		return e.execute(ctx, taskID)
+	}
+	return time.Time{}, false
+}
+
+// testScheduler runs a Scheduler on a FakeClock. The processor logs "Sleeping for" once
+// its timer is armed, so a test that waits for that before advancing the clock never
+// races with it.
+type testScheduler struct {
+	*Scheduler
+	clock    *FakeClock
+	executor *stubExecutor
+	sleeping chan struct{}
+}
+
+func startTestScheduler(t *testing.T, jobs []Job, execute func(ctx context.Context, taskID string) (time.Time, bool)) *testScheduler {
+	t.Helper()
+	ts := &testScheduler{
+		clock:    NewFakeClock(testEpoch),
+		executor: &stubExecutor{calls: make(chan string, 100), execute: execute},
+		sleeping: make(chan struct{}, 100),
+	}
+	ts.Scheduler = New(Options{
+		Store:    stubStore{jobs: jobs},
+		Executor: ts.executor,
+		Clock:    ts.clock,
+		MaxSleep: time.Hour,
+		Logger: func(callerMethod string, msg string) {
+			if callerMethod == "heapProcessor" && strings.HasPrefix(msg, "Sleeping for") {
+				select {
+				case ts.sleeping <- struct{}{}:
+				default: // a test that stopped listening must not block the processor
+				}
+			}
+		},
+	})
+	if err := ts.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ts.Stop(ctx)
+	})
+	ts.waitAsleep(t)
+	return ts
+}
+
+// waitAsleep waits for the processor to go to sleep once more.
+func (ts *testScheduler) waitAsleep(t *testing.T) {
+	t.Helper()
+	select {
+	case <-ts.sleeping:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the processor did not go back to sleep")
+	}
+}
+
+// advance moves the clock and waits for the processor to handle it. It must only be
+// used when the move fires the processor's timer.
+func (ts *testScheduler) advance(t *testing.T, d time.Duration) {
+	t.Helper()
+	ts.clock.Advance(d)
+	ts.waitAsleep(t)
+}
+
+func (ts *testScheduler) expectCall(t *testing.T, want string) {
+	t.Helper()
+	select {
+	case got := <-ts.executor.calls:
+		if got != want {
+			t.Fatalf("executed %s; want %s", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s was not executed", want)
+	}
+}
+
+func (ts *testScheduler) expectNoCall(t *testing.T) {
+	t.Helper()
+	select {
+	case got := <-ts.executor.calls:
+		t.Fatalf("executed %s; want nothing", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func at(seconds int) int64 {
+	return testEpoch.Unix() + int64(seconds)
+}
+
+func TestSchedulerDispatchesInTimeOrder(t *testing.T) {
+	ts := startTestScheduler(t, []Job{{ID: "c", Time: at(30)}, {ID: "a", Time: at(10)}, {ID: "b", Time: at(20)}}, nil)
+
+	ts.clock.Advance(5 * time.Second) // before the timer's deadline, so nothing wakes
+	ts.expectNoCall(t)
+	ts.advance(t, 5*time.Second)
+	ts.expectCall(t, "a")
+	ts.advance(t, 10*time.Second)
+	ts.expectCall(t, "b")
+	ts.advance(t, 10*time.Second)
+	ts.expectCall(t, "c")
+	ts.expectNoCall(t)
+	if ts.Len() != 0 {
+		t.Fatalf("Len() = %d after every job ran", ts.Len())
+	}
+}
+
+func TestSchedulerQueuesTheNextRun(t *testing.T) {
+	runs := 0
+	ts := startTestScheduler(t, []Job{{ID: "a", Time: at(10)}}, func(ctx context.Context, taskID string) (time.Time, bool) {
+		runs++
+		return testEpoch.Add(time.Duration(10+60*runs) * time.Second), runs < 2
+	})
+
+	ts.advance(t, 10*time.Second)
+	ts.expectCall(t, "a")
+	ts.waitAsleep(t) // woken again by the next run being queued
+	ts.advance(t, 60*time.Second)
+	ts.expectCall(t, "a")
+	ts.clock.Advance(time.Hour)
+	ts.expectNoCall(t)
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	ts := startTestScheduler(t, []Job{{ID: "a", Time: at(10)}, {ID: "b", Time: at(20)}}, nil)
+
+	if !ts.Cancel("a") {
+		t.Fatal("Cancel(a) = false; want true")
+	}
+	if ts.Cancel("a") || ts.Cancel("missing") {
+		t.Fatal("Cancel reported a job that is not queued")
+	}
+	ts.advance(t, 10*time.Second) // a's wake-up still fires, but finds nothing due
+	ts.expectNoCall(t)
+	ts.advance(t, 10*time.Second)
+	ts.expectCall(t, "b")
+	ts.expectNoCall(t)
+}
+
+func TestSchedulerReschedule(t *testing.T) {
+	ts := startTestScheduler(t, []Job{{ID: "a", Time: at(100)}, {ID: "b", Time: at(10)}}, nil)
+
+	// Earlier than the planned wake-up, so the processor wakes to re-plan
+	if !ts.Reschedule("a", testEpoch.Add(5*time.Second)) {
+		t.Fatal("Reschedule(a) = false; want true")
+	}
+	ts.waitAsleep(t)
+	// Later: b is only found when the processor next re-plans
+	if !ts.Reschedule("b", testEpoch.Add(50*time.Second)) {
+		t.Fatal("Reschedule(b) = false; want true")
+	}
+	if ts.Reschedule("missing", testEpoch) {
+		t.Fatal("Reschedule(missing) = true; want false")
+	}
+
+	ts.advance(t, 5*time.Second)
+	ts.expectCall(t, "a")
+	ts.clock.Advance(5 * time.Second) // b's old time
+	ts.expectNoCall(t)
+	ts.advance(t, 40*time.Second)
+	ts.expectCall(t, "b")
+}
+
+func TestSchedulerStopWaitsForRunningExecutions(t *testing.T) {
+	release := make(chan struct{})
+	ts := startTestScheduler(t, []Job{{ID: "a", Time: at(10)}}, func(ctx context.Context, taskID string) (time.Time, bool) {
+		<-release
+		return testEpoch.Add(20 * time.Second), true
+	})
+	ts.advance(t, 10*time.Second)
+	ts.expectCall(t, "a")
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- ts.Stop(context.Background()) }()
+	select {
+	case err := <-stopped:
+		t.Fatalf("Stop returned %v while a was running", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if running := ts.Running(); !slices.Equal(running, []string{"a"}) {
+		t.Fatalf("Running() = %v; want [a]", running)
+	}
+
+	close(release)
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatalf("Stop() = %v; want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not return once a finished")
+	}
+	// The run a queued on its way out is kept, but nothing is dispatched any more
+	if ts.Len() != 1 {
+		t.Fatalf("Len() = %d; want a's next run queued", ts.Len())
+	}
+	ts.clock.Advance(time.Minute)
+	ts.expectNoCall(t)
+}
+
+func TestSchedulerStopGivesUpOnSlowExecutions(t *testing.T) {
+	cancelled := make(chan struct{})
+	ts := startTestScheduler(t, []Job{{ID: "a", Time: at(10)}}, func(ctx context.Context, taskID string) (time.Time, bool) {
+		<-ctx.Done()
+		close(cancelled)
+		return time.Time{}, false
+	})
+	ts.advance(t, 10*time.Second)
+	ts.expectCall(t, "a")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := ts.Stop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Stop() = %v; want the deadline error", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the abandoned execution's context was not cancelled")
+	}
+}
+
+func TestSchedulerReloadSkipsRunningTasks(t *testing.T) {
+	release := make(chan struct{})
+	var runs atomic.Int32
+	ts := startTestScheduler(t, []Job{{ID: "a", Time: at(10)}, {ID: "b", Time: at(30)}}, func(ctx context.Context, taskID string) (time.Time, bool) {
+		<-release
+		return testEpoch.Add(70 * time.Second), taskID == "a" && runs.Add(1) == 1
+	})
+	ts.advance(t, 10*time.Second)
+	ts.expectCall(t, "a")
+
+	// The Store still has a's run in progress as due; queueing it would run it twice
+	if err := ts.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ts.waitAsleep(t)
+	if ts.Len() != 1 {
+		t.Fatalf("Len() = %d after Reload; want only b queued", ts.Len())
+	}
+	ts.clock.Advance(time.Second)
+	ts.expectNoCall(t)
+
+	// a queues its next run as it finishes, before it stops counting as running
+	close(release)
+	for len(ts.Running()) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ts.advance(t, 19*time.Second)
+	ts.expectCall(t, "b")
+	ts.advance(t, 40*time.Second)
+	ts.expectCall(t, "a")
+}
+
+func TestSchedulerRestartKeepsTheQueue(t *testing.T) {
+	ts := startTestScheduler(t, []Job{{ID: "a", Time: at(10)}}, nil)
+	ts.Schedule("b", testEpoch.Add(20*time.Second))
+	ts.waitAsleep(t)
+	if err := ts.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ts.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Start(context.Background()); err == nil {
+		t.Fatal("a second Start succeeded")
+	}
+	ts.waitAsleep(t)
+	ts.advance(t, 10*time.Second)
+	ts.expectCall(t, "a")
+	ts.advance(t, 10*time.Second)
+	ts.expectCall(t, "b")
+}
+
+// TestSchedulerConcurrentUse hammers the queue from several goroutines while the
+// scheduler is started and stopped, resyncs from its Store and dispatches. Run it with
+// -race; it also checks the queue comes out consistent.
+func TestSchedulerConcurrentUse(t *testing.T) {
+	ids := make([]string, 32)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("task_%d", i)
+	}
+	soon := func(rng *rand.Rand) time.Time {
+		return time.Now().Add(time.Duration(rng.IntN(20)) * time.Millisecond)
+	}
+
+	jobs := make([]Job, 0, len(ids)/2)
+	for _, id := range ids[:len(ids)/2] {
+		jobs = append(jobs, Job{ID: id, Time: time.Now().Unix()})
+	}
+	var executed sync.Map
+	s := New(Options{
+		Store: stubStore{jobs: jobs},
+		Executor: executorFunc(func(ctx context.Context, taskID string) (time.Time, bool) {
+			executed.Store(taskID, true)
+			return time.Now(), len(taskID)%2 == 0
+		}),
+		MaxSleep:       10 * time.Millisecond,
+		ResyncInterval: time.Millisecond,
+	})
+
+	deadline := time.Now().Add(500 * time.Millisecond)
+	var wg sync.WaitGroup
+	for worker := uint64(0); worker < 4; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rng := rand.New(rand.NewPCG(worker, 31))
+			for time.Now().Before(deadline) {
+				id := ids[rng.IntN(len(ids))]
+				switch rng.IntN(6) {
+				case 0, 1:
+					s.Schedule(id, soon(rng))
+				case 2:
+					s.Cancel(id)
+				case 3:
+					s.Reschedule(id, soon(rng))
+				case 4:
+					s.Retain(func(taskID string) bool { return taskID != id })
+				default:
+					s.Len()
+					s.Running()
+				}
+			}
+		}()
+	}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for time.Now().Before(deadline) {
+			if err := s.Start(context.Background()); err != nil {
+				t.Errorf("Start() = %v", err)
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+			if err := s.Stop(context.Background()); err != nil {
+				t.Errorf("Stop() = %v", err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for time.Now().Before(deadline) {
+			s.Reload(context.Background())
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	wg.Wait()
+
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if running := s.Running(); len(running) != 0 {
+		t.Fatalf("Running() = %v after Stop", running)
+	}
+	count := 0
+	executed.Range(func(any, any) bool { count++; return true })
+	if count == 0 {
+		t.Fatal("nothing was executed")
+	}
+
+	s.queueLock.Lock()
+	defer s.queueLock.Unlock()
+	queued := s.jobQueue.Jobs()
+	seen := make(map[string]bool, len(queued))
+	for _, job := range queued {
+		if seen[job.ID] {
+			t.Fatalf("%s is queued twice: %v", job.ID, queued)
+		}
+		seen[job.ID] = true
+	}
+	if s.jobQueue.Len() != len(queued) {
+		t.Fatalf("Len() = %d with %d jobs queued", s.jobQueue.Len(), len(queued))
+	}
+	checkHeapInvariants(t, s.jobQueue.(*jobHeap))
+}
+
+type executorFunc func(ctx context.Context, taskID string) (time.Time, bool)
+
+func (f executorFunc) Execute(ctx context.Context, taskID string) (time.Time, bool) {
+	return f(ctx, taskID)
+}
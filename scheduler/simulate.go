@@ -0,0 +1,91 @@
+package scheduler
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Simulate runs a Scheduler over jobs on a virtual clock until no job is due before
+// until. Whenever the scheduler has nothing left to do, meaning its executions have
+// finished and the processor is going to sleep, the clock jumps to the processor's next
+// wake-up, so a week of schedule takes milliseconds. It returns the dispatched jobs, each
+// with the time it ran, sorted by time and then ID so the result is deterministic.
+func Simulate(ctx context.Context, clock *FakeClock, executor Executor, jobs []Job, until time.Time) []Job {
+	recorder := &recordingExecutor{clock: clock, executor: executor}
+	s := New(Options{Store: jobList(jobs), Executor: recorder, Clock: clock})
+
+	finished := make(chan struct{})
+	s.beforeSleep = func() {
+		select {
+		case <-finished:
+			return
+		default:
+		}
+		// Only the processor starts executions, so nothing is added while this waits
+		s.inFlight.Wait()
+		if len(s.wakeCh) > 0 {
+			return // an execution queued an earlier run; let the processor look again first
+		}
+
+		s.queueLock.Lock()
+		next, ok := s.jobQueue.NextTime()
+		wakeAt := s.nextWake
+		s.queueLock.Unlock()
+		if !ok || next > until.Unix() || ctx.Err() != nil {
+			close(finished)
+			return
+		}
+		// The processor's timer was set for exactly nextWake, so this fires it
+		clock.Set(time.Unix(wakeAt, 0))
+	}
+
+	if err := s.Start(ctx); err != nil {
+		return nil
+	}
+	select {
+	case <-finished:
+	case <-ctx.Done():
+	}
+	s.Stop(context.Background())
+	if until.After(clock.Now()) {
+		clock.Set(until)
+	}
+	return recorder.sorted()
+}
+
+// jobList is a Store holding a fixed set of jobs.
+type jobList []Job
+
+func (l jobList) LoadJobs(ctx context.Context) ([]Job, error) {
+	return l, nil
+}
+
+// recordingExecutor passes executions through and notes when each one ran.
+type recordingExecutor struct {
+	clock    Clock
+	executor Executor
+
+	mu    sync.Mutex
+	fired []Job
+}
+
+func (r *recordingExecutor) Execute(ctx context.Context, taskID string) (time.Time, bool) {
+	r.mu.Lock()
+	r.fired = append(r.fired, Job{ID: taskID, Time: r.clock.Now().Unix()})
+	r.mu.Unlock()
+	return r.executor.Execute(ctx, taskID)
+}
+
+func (r *recordingExecutor) sorted() []Job {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Jobs dispatched together run concurrently, so their order is only fixed here
+	sort.Slice(r.fired, func(i, j int) bool {
+		a, b := r.fired[i], r.fired[j]
+		return a.Time < b.Time || (a.Time == b.Time && a.ID < b.ID)
+	})
+	return r.fired
+}
@@ -0,0 +1,60 @@
+package scheduler
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// everyExecutor runs each task every period seconds, limit times in all.
+type everyExecutor struct {
+	clock  Clock
+	period map[string]int64
+	limit  int
+
+	mu   sync.Mutex
+	runs map[string]int
+}
+
+func (e *everyExecutor) Execute(ctx context.Context, taskID string) (time.Time, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.runs[taskID]++
+	return e.clock.Now().Add(time.Duration(e.period[taskID]) * time.Second), e.runs[taskID] < e.limit
+}
+
+func TestSimulateRunsTheScheduler(t *testing.T) {
+	clock := NewFakeClock(testEpoch)
+	executor := &everyExecutor{clock: clock, period: map[string]int64{"a": 60, "b": 90, "c": 30}, limit: 3, runs: map[string]int{}}
+	jobs := []Job{{ID: "a", Time: at(0)}, {ID: "b", Time: at(0)}, {ID: "c", Time: at(7200)}}
+
+	fired := Simulate(context.Background(), clock, executor, jobs, testEpoch.Add(7230*time.Second))
+	want := []Job{
+		{ID: "a", Time: at(0)}, {ID: "b", Time: at(0)}, // same second: ordered by ID
+		{ID: "a", Time: at(60)}, {ID: "b", Time: at(90)}, {ID: "a", Time: at(120)}, {ID: "b", Time: at(180)},
+		// c is hours after the others, past several of the processor's hour-long sleeps
+		{ID: "c", Time: at(7200)}, {ID: "c", Time: at(7230)},
+	}
+	if !slices.Equal(fired, want) {
+		t.Fatalf("Simulate() = %v; want %v", fired, want)
+	}
+	if want := testEpoch.Add(7230 * time.Second); !clock.Now().Equal(want) {
+		t.Fatalf("clock at %s afterwards; want %s", clock.Now(), want)
+	}
+}
+
+func TestSimulateStopsAtUntil(t *testing.T) {
+	clock := NewFakeClock(testEpoch)
+	executor := &everyExecutor{clock: clock, period: map[string]int64{"a": 100}, limit: 1000, runs: map[string]int{}}
+
+	fired := Simulate(context.Background(), clock, executor, []Job{{ID: "a", Time: at(0)}}, testEpoch.Add(250*time.Second))
+	want := []Job{{ID: "a", Time: at(0)}, {ID: "a", Time: at(100)}, {ID: "a", Time: at(200)}}
+	if !slices.Equal(fired, want) {
+		t.Fatalf("Simulate() = %v; want %v", fired, want)
+	}
+	if want := testEpoch.Add(250 * time.Second); !clock.Now().Equal(want) {
+		t.Fatalf("clock at %s afterwards; want until, %s", clock.Now(), want)
+	}
+}
@@ -0,0 +1,228 @@
+package scheduler
+
+// timingWheel is a hierarchical timing wheel Queue with one-second ticks. Level 0 has a
+// slot per second for the next 256 seconds; each higher level has 64 slots, each
+// covering a whole turn of the level below. Jobs far in the future sit in a coarse slot
+// and cascade down a level whenever the wheel below completes a turn, until they reach
+// level 0 and become due on their exact second. Upsert, Remove and Reschedule are O(1);
+// advancing costs one step per elapsed second while level 0 holds jobs, and one step per
+// turn of level 0 otherwise.
+type timingWheel struct {
+	current  int64 // Unix second the wheel has advanced to; every slotted job is later
+	levels   [wheelLevels][]map[string]Job
+	overflow map[string]Job // beyond the top level's range
+	ready    map[string]Job // due, waiting for PopDue
+	index    map[string]wheelPosition
+	// level0Len counts the jobs in level 0, so advance can skip a turn with none
+	level0Len int
+}
+
+// wheelPosition records where a job is so it can be removed without searching.
+type wheelPosition struct {
+	level int // -1 for ready, wheelLevels for overflow
+	slot  int
+}
+
+const (
+	wheelLevels     = 5
+	wheelLevel0Bits = 8 // 256 one-second slots
+	wheelLevelBits  = 6 // 64 slots per higher level
+	positionReady   = -1
+)
+
+func newTimingWheel(now int64) *timingWheel {
+	w := &timingWheel{
+		current:  now,
+		overflow: make(map[string]Job),
+		ready:    make(map[string]Job),
+		index:    make(map[string]wheelPosition),
+	}
+	for level := range w.levels {
+		w.levels[level] = make([]map[string]Job, 1<<levelSlotBits(level))
+	}
+	return w
+}
+
+// levelShift is how many low bits of a time are below the given level's slot index.
+func levelShift(level int) uint {
+	if level == 0 {
+		return 0
+	}
+	return wheelLevel0Bits + uint(level-1)*wheelLevelBits
+}
+
+func levelSlotBits(level int) uint {
+	if level == 0 {
+		return wheelLevel0Bits
+	}
+	return wheelLevelBits
+}
+
+// levelSpan is how far ahead of current a job may be to go into the given level.
+func levelSpan(level int) int64 {
+	return 1 << (levelShift(level) + levelSlotBits(level))
+}
+
+func (w *timingWheel) Len() int { return len(w.index) }
+
+func (w *timingWheel) Upsert(job Job) {
+	w.Remove(job.ID)
+	w.place(job)
+}
+
+func (w *timingWheel) Remove(id string) (Job, bool) {
+	pos, ok := w.index[id]
+	if !ok {
+		return Job{}, false
+	}
+	bucket := w.bucket(pos)
+	job := bucket[id]
+	delete(bucket, id)
+	delete(w.index, id)
+	if pos.level == 0 {
+		w.level0Len--
+	}
+	return job, true
+}
+
+func (w *timingWheel) Reschedule(id string, time int64) bool {
+	job, ok := w.Remove(id)
+	if !ok {
+		return false
+	}
+	job.Time = time
+	w.place(job)
+	return true
+}
+
+func (w *timingWheel) PopDue(now int64) (Job, bool) {
+	w.advance(now)
+	for id, job := range w.ready {
+		delete(w.ready, id)
+		delete(w.index, id)
+		return job, true
+	}
+	return Job{}, false
+}
+
+func (w *timingWheel) NextTime() (int64, bool) {
+	if len(w.ready) > 0 {
+		return w.current, true
+	}
+	if len(w.index) == 0 {
+		return 0, false
+	}
+	// Level 0 only holds jobs within 256 seconds of current, each in its own second's
+	// slot. The higher levels cascade at the next turn of level 0 and a job may be due
+	// right then, so wake at the first occupied second before that turn, or at the turn.
+	nextTurn := (w.current>>wheelLevel0Bits + 1) << wheelLevel0Bits
+	slots := w.levels[0]
+	mask := int64(len(slots) - 1)
+	for t := w.current + 1; t < nextTurn; t++ {
+		if len(slots[t&mask]) > 0 {
+			return t, true
+		}
+	}
+	return nextTurn, true
+}
+
+func (w *timingWheel) Jobs() []Job {
+	jobs := make([]Job, 0, len(w.index))
+	for id, pos := range w.index {
+		jobs = append(jobs, w.bucket(pos)[id])
+	}
+	return jobs
+}
+
+// advance moves the wheel forward to now, cascading and collecting due jobs on the way.
+func (w *timingWheel) advance(now int64) {
+	if len(w.index) == len(w.ready) && now > w.current {
+		// Nothing is slotted, so there is nothing to step through
+		w.current = now
+		return
+	}
+	for w.current < now {
+		if w.level0Len == 0 {
+			// Nothing can fire before the next turn, so go straight there
+			nextTurn := (w.current>>wheelLevel0Bits + 1) << wheelLevel0Bits
+			if now < nextTurn {
+				w.current = now
+				return
+			}
+			w.current = nextTurn - 1
+		}
+		w.current++
+		w.cascade()
+		slot := w.current & int64(len(w.levels[0])-1)
+		for id, job := range w.levels[0][slot] {
+			w.ready[id] = job
+			w.index[id] = wheelPosition{level: positionReady}
+		}
+		w.level0Len -= len(w.levels[0][slot])
+		w.levels[0][slot] = nil
+	}
+}
+
+// cascade re-places the jobs of every higher level whose slot comes round at current.
+// It runs from the top level down so a job can fall several levels in one step.
+func (w *timingWheel) cascade() {
+	if w.current&(1<<wheelLevel0Bits-1) != 0 {
+		return
+	}
+	top := 1
+	for top < wheelLevels-1 && w.current&(1<<levelShift(top+1)-1) == 0 {
+		top++
+	}
+	if top == wheelLevels-1 && w.current&(1<<(levelShift(top)+wheelLevelBits)-1) == 0 {
+		w.replace(w.overflow)
+		w.overflow = make(map[string]Job)
+	}
+	for level := top; level >= 1; level-- {
+		slot := (w.current >> levelShift(level)) & (1<<wheelLevelBits - 1)
+		jobs := w.levels[level][slot]
+		w.levels[level][slot] = nil
+		w.replace(jobs)
+	}
+}
+
+func (w *timingWheel) replace(jobs map[string]Job) {
+	for _, job := range jobs {
+		w.place(job)
+	}
+}
+
+// place puts a job into the finest level that can hold it.
+func (w *timingWheel) place(job Job) {
+	delta := job.Time - w.current
+	if delta <= 0 {
+		w.ready[job.ID] = job
+		w.index[job.ID] = wheelPosition{level: positionReady}
+		return
+	}
+	for level := 0; level < wheelLevels; level++ {
+		if delta < levelSpan(level) {
+			slot := int((job.Time >> levelShift(level)) & (1<<levelSlotBits(level) - 1))
+			if w.levels[level][slot] == nil {
+				w.levels[level][slot] = make(map[string]Job)
+			}
+			w.levels[level][slot][job.ID] = job
+			w.index[job.ID] = wheelPosition{level: level, slot: slot}
+			if level == 0 {
+				w.level0Len++
+			}
+			return
+		}
+	}
+	w.overflow[job.ID] = job
+	w.index[job.ID] = wheelPosition{level: wheelLevels}
+}
+
+func (w *timingWheel) bucket(pos wheelPosition) map[string]Job {
+	switch pos.level {
+	case positionReady:
+		return w.ready
+	case wheelLevels:
+		return w.overflow
+	}
+	return w.levels[pos.level][pos.slot]
+}
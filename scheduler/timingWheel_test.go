@@ -0,0 +1,222 @@
+package scheduler
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"testing"
+)
+
+// wheelEpoch is a start time in the middle of every level's turn, so cascades at each
+// level happen at different points of a test
+const wheelEpoch = int64(1_700_000_123)
+
+func TestTimingWheelMatchesModel(t *testing.T) {
+	// Mostly near jobs, so they fall due and ties are common, plus jobs for every level
+	// and the overflow
+	times := func(rng *rand.Rand, now int64) int64 {
+		switch r := rng.IntN(10); {
+		case r < 6:
+			return now - 300 + rng.Int64N(1200)
+		case r < 8:
+			return now + rng.Int64N(levelSpan(1))
+		case r < 9:
+			return now + rng.Int64N(levelSpan(wheelLevels-1))
+		default:
+			return now + levelSpan(wheelLevels-1) + rng.Int64N(1<<40)
+		}
+	}
+	for seed := uint64(1); seed <= 50; seed++ {
+		t.Run(fmt.Sprint(seed), func(t *testing.T) {
+			w := newTimingWheel(wheelEpoch)
+			checkQueue(t, w, rand.New(rand.NewPCG(seed, 36)), wheelEpoch, 2000, times, false)
+			checkWheelInvariants(t, w)
+		})
+	}
+}
+
+// checkWheelInvariants fails unless every job is where index says, in the slot its time
+// maps to, and level0Len counts level 0.
+func checkWheelInvariants(t *testing.T, w *timingWheel) {
+	t.Helper()
+	count, level0 := len(w.ready)+len(w.overflow), 0
+	for id, job := range w.ready {
+		if pos := w.index[id]; pos.level != positionReady || job.Time > w.current {
+			t.Fatalf("ready job %v at %+v; the wheel is at %d", job, pos, w.current)
+		}
+	}
+	for level, slots := range w.levels {
+		for slot, jobs := range slots {
+			for id, job := range jobs {
+				count++
+				if level == 0 {
+					level0++
+				}
+				want := int((job.Time >> levelShift(level)) & (1<<levelSlotBits(level) - 1))
+				if pos := w.index[id]; pos.level != level || pos.slot != slot || slot != want {
+					t.Fatalf("%v is in level %d slot %d, indexed as %+v; its time maps to slot %d", job, level, slot, pos, want)
+				}
+				if job.Time <= w.current || job.Time-w.current >= levelSpan(level) {
+					t.Fatalf("%v is in level %d, %d seconds ahead of the wheel", job, level, job.Time-w.current)
+				}
+			}
+		}
+	}
+	if count != len(w.index) {
+		t.Fatalf("%d jobs in the wheel, %d indexed", count, len(w.index))
+	}
+	if level0 != w.level0Len {
+		t.Fatalf("level0Len = %d; level 0 holds %d jobs", w.level0Len, level0)
+	}
+}
+
+// popAt pops every job due at now.
+func popAt(w *timingWheel, now int64) []Job {
+	jobs := make([]Job, 0)
+	for {
+		job, ok := w.PopDue(now)
+		if !ok {
+			return jobs
+		}
+		jobs = append(jobs, job)
+	}
+}
+
+// followNextTime drives the wheel like the scheduler does: it sleeps until NextTime and
+// pops what is due, until a job comes out or steps wake-ups have passed.
+func followNextTime(t *testing.T, w *timingWheel, steps int) ([]Job, int64) {
+	t.Helper()
+	for i := 0; i < steps; i++ {
+		next, ok := w.NextTime()
+		if !ok {
+			t.Fatal("NextTime() reported an empty wheel")
+		}
+		if jobs := popAt(w, next); len(jobs) > 0 {
+			return jobs, next
+		}
+	}
+	t.Fatalf("nothing fell due after %d wake-ups", steps)
+	return nil, 0
+}
+
+func TestTimingWheelCascadesFromEveryLevel(t *testing.T) {
+	for level := 1; level <= wheelLevels; level++ {
+		// Just past what the level below can hold, and with odd low bits so the job
+		// lands mid-slot at every level it passes through
+		offsets := []int64{levelSpan(level-1) + 12_345, levelSpan(level - 1)}
+		if level < wheelLevels {
+			offsets = append(offsets, levelSpan(level)-1)
+		}
+		for _, offset := range offsets {
+			t.Run(fmt.Sprintf("level%d/+%d", level, offset), func(t *testing.T) {
+				w := newTimingWheel(wheelEpoch)
+				job := Job{ID: "a", Time: wheelEpoch + offset}
+				w.Upsert(job)
+				if pos := w.index["a"]; pos.level != level {
+					t.Fatalf("placed in level %d; want %d", pos.level, level)
+				}
+
+				// Jump through the wheel in uneven steps, never past the job
+				rng := rand.New(rand.NewPCG(uint64(level), uint64(offset)))
+				for now := wheelEpoch; now < job.Time-1; {
+					now = min(now+1+rng.Int64N(offset/7+1), job.Time-1)
+					if jobs := popAt(w, now); len(jobs) > 0 {
+						t.Fatalf("popped %v at %d", jobs, now)
+					}
+					checkWheelInvariants(t, w)
+				}
+				if jobs := popAt(w, job.Time); !slices.Equal(jobs, []Job{job}) {
+					t.Fatalf("PopDue(%d) = %v; want %v", job.Time, jobs, job)
+				}
+				if w.Len() != 0 {
+					t.Fatalf("Len() = %d after popping the only job", w.Len())
+				}
+			})
+		}
+	}
+}
+
+func TestTimingWheelNextTimeReachesFarJobs(t *testing.T) {
+	for _, offset := range []int64{100, 256, 257, 100_000, levelSpan(2) + 3, levelSpan(3) + 5} {
+		t.Run(fmt.Sprint(offset), func(t *testing.T) {
+			w := newTimingWheel(wheelEpoch)
+			w.Upsert(Job{ID: "a", Time: wheelEpoch + offset})
+			// At most one wake-up per turn of level 0, plus the last partial turn
+			jobs, at := followNextTime(t, w, int(offset>>wheelLevel0Bits)+2)
+			if at != wheelEpoch+offset || len(jobs) != 1 {
+				t.Fatalf("popped %v at %d; want a at %d", jobs, at, wheelEpoch+offset)
+			}
+		})
+	}
+}
+
+func TestTimingWheelSameSlotTies(t *testing.T) {
+	w := newTimingWheel(wheelEpoch)
+	// Ten jobs on the same second far enough out to start in level 1, and ten more that
+	// share their level 1 slot but not their second
+	at := ((wheelEpoch>>levelShift(1))+2)<<levelShift(1) + 17
+	want := make(map[int64][]Job)
+	for i := 0; i < 10; i++ {
+		same := Job{ID: fmt.Sprintf("same_%d", i), Time: at}
+		near := Job{ID: fmt.Sprintf("near_%d", i), Time: at + 1 + int64(i)*20}
+		w.Upsert(same)
+		w.Upsert(near)
+		want[same.Time] = append(want[same.Time], same)
+		want[near.Time] = append(want[near.Time], near)
+	}
+	if pos := w.index["same_0"]; pos.level != 1 || w.index["near_9"] != pos {
+		t.Fatalf("same_0 at %+v, near_9 at %+v; want both in the same level 1 slot", pos, w.index["near_9"])
+	}
+
+	for now := wheelEpoch; now <= at+200; now++ {
+		got := popAt(w, now)
+		sort.Slice(got, func(i, j int) bool { return got[i].ID < got[j].ID })
+		if !slices.Equal(got, want[now]) {
+			t.Fatalf("PopDue at %d = %v; want %v", now, got, want[now])
+		}
+	}
+	if w.Len() != 0 {
+		t.Fatalf("Len() = %d after every job fell due", w.Len())
+	}
+}
+
+func TestTimingWheelFarFutureAndPastJobs(t *testing.T) {
+	w := newTimingWheel(wheelEpoch)
+	far := Job{ID: "far", Time: wheelEpoch + levelSpan(wheelLevels-1) + 1_000}
+	w.Upsert(far)
+	w.Upsert(Job{ID: "past", Time: wheelEpoch - 3600})
+	if pos := w.index["far"]; pos.level != wheelLevels {
+		t.Fatalf("far placed at %+v; want the overflow", pos)
+	}
+	if next, ok := w.NextTime(); !ok || next != wheelEpoch {
+		t.Fatalf("NextTime() = %d, %v; want %d for the overdue job", next, ok, wheelEpoch)
+	}
+	if jobs := popAt(w, wheelEpoch); len(jobs) != 1 || jobs[0].ID != "past" {
+		t.Fatalf("PopDue(%d) = %v; want only past", wheelEpoch, jobs)
+	}
+
+	// Jobs in the overflow can still be found, moved and removed
+	if !w.Reschedule("far", wheelEpoch+10) {
+		t.Fatal("Reschedule(far) = false")
+	}
+	if jobs := popAt(w, wheelEpoch+10); len(jobs) != 1 || jobs[0].ID != "far" {
+		t.Fatalf("PopDue = %v; want far at its new time", jobs)
+	}
+	w.Upsert(far)
+	if job, ok := w.Remove("far"); !ok || job != far {
+		t.Fatalf("Remove(far) = %v, %v", job, ok)
+	}
+	checkWheelInvariants(t, w)
+
+	// A job out in the overflow comes down once the top level turns
+	w.Upsert(far)
+	for now := wheelEpoch + 10; now < far.Time; now += levelSpan(wheelLevels-2) - 1 {
+		if jobs := popAt(w, now); len(jobs) > 0 {
+			t.Fatalf("popped %v at %d", jobs, now)
+		}
+	}
+	if jobs := popAt(w, far.Time); len(jobs) != 1 || jobs[0] != far {
+		t.Fatalf("PopDue(%d) = %v; want far", far.Time, jobs)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"daria.com/jobScheduler/scheduler"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/gin-gonic/gin"
+)
+
+// In shard mode every node heartbeats a membership row (leaseName "node#<instanceId>") in
+// daria_scheduler_leases. The live rows form a consistent-hash ring over taskId, and each
+// node only queues and executes the tasks the ring assigns to it. When membership changes
+// every node rebuilds the ring, drops the jobs it no longer owns and reloads the ones it
+// gained. While nodes briefly disagree about membership two of them may both think they
+// own a task, so shard mode also claims each run like claim mode does.
+//
+// Sharding divides the executions, not the reads: every load and resync still scans all
+// of daria_tasks and drops the rows another node owns, so each node reads every row.
+// Ownership moves whenever membership changes, so a stored shard key would have to be
+// rewritten on every rebalance to be queried.
+
+const nodeLeasePrefix = "node#"
+
+// shardRing is the ring for the current membership; nil until the node has joined.
+var shardRing atomic.Pointer[scheduler.HashRing]
+
+// nodeMember is a membership row as stored in daria_scheduler_leases.
+type nodeMember struct {
+	LeaseName   string `json:"leaseName"`
+	OwnerID     string `json:"ownerId"`
+	ExpiresAt   int64  `json:"expiresAt"`
+	HeartbeatAt int64  `json:"heartbeatAt"`
+}
+
+// ownsTask reports whether this instance should queue and execute the task.
+func ownsTask(taskID string) bool {
+	if config.Mode != modeShard {
+		return true
+	}
+	ring := shardRing.Load()
+	return ring != nil && ring.Owner(taskID) == config.InstanceID
+}
+
+// shardJobStore loads only the jobs this node owns, out of a scan of every task.
+type shardJobStore struct{}
+
+func (shardJobStore) LoadJobs(ctx context.Context) ([]scheduler.Job, error) {
+	jobs, err := loadExistingJobs()
+	if err != nil {
+		return nil, err
+	}
+	owned := jobs[:0]
+	for _, job := range jobs {
+		if ownsTask(job.ID) {
+			owned = append(owned, job)
+		}
+	}
+	return owned, nil
+}
+
+// joinShardRing registers this node and builds the first ring. It must run before the
+// scheduler starts so the initial load already sees the right shard.
+func joinShardRing() error {
+	if err := heartbeatNode(clock.Now()); err != nil {
+		return err
+	}
+	_, err := refreshShardRing()
+	return err
+}
+
+// runShardMembership heartbeats this node and rebalances on membership changes until ctx
+// is done, then removes the node's row so the others take over its shard right away.
+func runShardMembership(ctx context.Context) {
+	callerMethod := "runShardMembership"
+	timer := clock.NewTimer(config.HeartbeatInterval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := leaveShardRing(); err != nil {
+				log(callerMethod, fmt.Sprintf("Error leaving the ring: %s", err.Error()))
+			}
+			return
+		case <-timer.C():
+		}
+
+		if err := heartbeatNode(clock.Now()); err != nil {
+			log(callerMethod, fmt.Sprintf("Error sending heartbeat: %s", err.Error()))
+		}
+		changed, err := refreshShardRing()
+		if err != nil {
+			log(callerMethod, fmt.Sprintf("Error reading membership: %s", err.Error()))
+		} else if changed {
+			rebalanceShard(ctx)
+		}
+		timer.Reset(config.HeartbeatInterval)
+	}
+}
+
+// refreshShardRing rebuilds the ring from the live membership rows. It reports whether
+// the membership differs from the current ring.
+func refreshShardRing() (bool, error) {
+	members, err := listLiveNodes(clock.Now())
+	if err != nil {
+		return false, err
+	}
+	nodes := make([]string, 0, len(members))
+	for _, member := range members {
+		nodes = append(nodes, member.OwnerID)
+	}
+	// Our own row may not be visible yet (Scan is eventually consistent), but we are a member
+	if !slices.Contains(nodes, config.InstanceID) {
+		nodes = append(nodes, config.InstanceID)
+	}
+	sort.Strings(nodes)
+
+	if current := shardRing.Load(); current != nil && strings.Join(current.Nodes(), ",") == strings.Join(nodes, ",") {
+		return false, nil
+	}
+	log("refreshShardRing", fmt.Sprintf("Shard membership is now: %s", strings.Join(nodes, ", ")))
+	shardRing.Store(scheduler.NewHashRing(nodes, config.ShardVirtualNodes))
+	return true, nil
+}
+
+// rebalanceShard hands off the jobs this node lost and queues the ones it gained.
+func rebalanceShard(ctx context.Context) {
+	callerMethod := "rebalanceShard"
+	dropped := sched.Retain(ownsTask)
+	log(callerMethod, fmt.Sprintf("Handed off %d jobs", dropped))
+	if err := sched.Reload(ctx); err != nil {
+		// The regular resync will pick them up
+		log(callerMethod, fmt.Sprintf("Error loading gained jobs: %s", err.Error()))
+	}
+}
+
+func heartbeatNode(now time.Time) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String("daria_scheduler_leases"),
+		Key: map[string]*dynamodb.AttributeValue{
+			"leaseName": {
+				S: aws.String(nodeLeasePrefix + config.InstanceID),
+			},
+		},
+		UpdateExpression: aws.String("SET ownerId = :me, expiresAt = :exp, heartbeatAt = :now"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":me": {
+				S: aws.String(config.InstanceID),
+			},
+			":exp": {
+				N: aws.String(strconv.FormatInt(now.Add(config.LeaderTTL).Unix(), 10)),
+			},
+			":now": {
+				N: aws.String(strconv.FormatInt(now.Unix(), 10)),
+			},
+		},
+	}
+	_, err := db.svc.UpdateItem(input)
+	return err
+}
+
+func leaveShardRing() error {
+	input := &dynamodb.DeleteItemInput{
+		TableName: aws.String("daria_scheduler_leases"),
+		Key: map[string]*dynamodb.AttributeValue{
+			"leaseName": {
+				S: aws.String(nodeLeasePrefix + config.InstanceID),
+			},
+		},
+	}
+	_, err := db.svc.DeleteItem(input)
+	return err
+}
+
+// listLiveNodes returns the membership rows whose heartbeat has not expired.
+func listLiveNodes(now time.Time) ([]nodeMember, error) {
+	input := &dynamodb.ScanInput{
+		TableName:        aws.String("daria_scheduler_leases"),
+		FilterExpression: aws.String("begins_with(leaseName, :prefix) AND expiresAt >= :now"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":prefix": {
+				S: aws.String(nodeLeasePrefix),
+			},
+			":now": {
+				N: aws.String(strconv.FormatInt(now.Unix(), 10)),
+			},
+		},
+	}
+
+	members := make([]nodeMember, 0)
+	err := db.svc.ScanPages(input, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			var member nodeMember
+			if err := dynamodbattribute.UnmarshalMap(item, &member); err != nil {
+				log("listLiveNodes", fmt.Sprintf("Error unmarshalling member: %s", err.Error()))
+				continue
+			}
+			members = append(members, member)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// getShards is the admin view of the ring: the live nodes, how many tasks each owns, and
+// optionally the owner of one task given as ?taskId=.
+func getShards(c *gin.Context) {
+	callerMethod := "getShards"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	if config.Mode != modeShard {
+		respondError(c, http.StatusConflict, codeShardingDisabled, fmt.Sprintf("Sharding is not enabled (mode is %s)", config.Mode))
+		return
+	}
+	ring := shardRing.Load()
+	if ring == nil {
+		respondError(c, http.StatusServiceUnavailable, codeUnavailable, "This node has not joined the ring yet")
+		return
+	}
+
+	if taskID := c.Query("taskId"); taskID != "" {
+		c.JSON(http.StatusOK, gin.H{"taskId": taskID, "owner": ring.Owner(taskID)})
+		return
+	}
+
+	members, err := listLiveNodes(clock.Now())
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to read membership")
+		return
+	}
+	jobs, err := loadExistingJobs()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to read tasks")
+		return
+	}
+	owned := make(map[string]int)
+	for _, job := range jobs {
+		owned[ring.Owner(job.ID)]++
+	}
+
+	nodes := make([]gin.H, 0, len(members))
+	for _, member := range members {
+		nodes = append(nodes, gin.H{
+			"instanceId":  member.OwnerID,
+			"heartbeatAt": time.Unix(member.HeartbeatAt, 0).UTC(),
+			"expiresAt":   time.Unix(member.ExpiresAt, 0).UTC(),
+			"tasks":       owned[member.OwnerID],
+			"inRing":      slices.Contains(ring.Nodes(), member.OwnerID),
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"self":         config.InstanceID,
+		"ring":         ring.Nodes(),
+		"virtualNodes": config.ShardVirtualNodes,
+		"nodes":        nodes,
+		"queued":       sched.Len(),
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"daria.com/jobScheduler/scheduler"
+)
+
+// simulatedTask is one entry of the simulation input: a create request plus an optional
+// task ID to show in the timeline.
+type simulatedTask struct {
+	TaskID string `json:"taskId"`
+	CreateTaskInput
+}
+
+// simulatedFire is one line of the simulation output.
+type simulatedFire struct {
+	Time   time.Time `json:"time"`
+	TaskID string    `json:"taskId"`
+	Run    int       `json:"run"`
+}
+
+// simulationExecutor applies the real scheduling rules to in-memory tasks without calling
+// their APIs or touching the database.
+type simulationExecutor struct {
+	tasks map[string]*Task
+}
+
+func (e *simulationExecutor) Execute(ctx context.Context, taskID string) (time.Time, bool) {
+	task := e.tasks[taskID]
+	again := recordExecution(task, clock.Now())
+	return task.NextExecution, again
+}
+
+// runSimulation implements `jobScheduler simulate`: it replays a set of tasks on a virtual
+// clock and prints when each one would fire.
+func runSimulation(args []string) error {
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	tasksFile := flags.String("tasks", "data.json", "JSON array of tasks in the POST /tasks format, each with an optional taskId")
+	from := flags.String("from", "", "virtual start time as \"2006-01-02 15:04:05\" UTC (default: earliest startFrom)")
+	duration := flags.Duration("for", 7*24*time.Hour, "how much virtual time to simulate")
+	asJSON := flags.Bool("json", false, "print the timeline as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(*tasksFile)
+	if err != nil {
+		return err
+	}
+	var inputs []simulatedTask
+	if err := json.Unmarshal(data, &inputs); err != nil {
+		return fmt.Errorf("parsing %s: %w", *tasksFile, err)
+	}
+	if len(inputs) == 0 {
+		return errors.New("no tasks to simulate")
+	}
+
+	tasks := make(map[string]*Task, len(inputs))
+	jobs := make([]scheduler.Job, 0, len(inputs))
+	var start time.Time
+	for i, input := range inputs {
+		startFrom, err := time.Parse("2006-01-02 15:04:05", input.StartFrom)
+		if err != nil {
+			return fmt.Errorf("task %d: startFrom must be in the format 2000-12-02 01:01:01", i)
+		}
+		taskID := input.TaskID
+		if taskID == "" {
+			taskID = fmt.Sprintf("task_%d", i+1)
+		}
+		task := createTaskStruct(input.CreateTaskInput, taskID, "simulation")
+		tasks[taskID] = &task
+		jobs = append(jobs, scheduler.Job{ID: taskID, Time: startFrom.Unix()})
+		if start.IsZero() || startFrom.Before(start) {
+			start = startFrom
+		}
+	}
+	if *from != "" {
+		if start, err = time.Parse("2006-01-02 15:04:05", *from); err != nil {
+			return errors.New("-from must be in the format 2000-12-02 01:01:01")
+		}
+	}
+
+	fakeClock := scheduler.NewFakeClock(start)
+	clock = fakeClock
+	fired := scheduler.Simulate(context.Background(), fakeClock, &simulationExecutor{tasks: tasks}, jobs, start.Add(*duration))
+
+	runs := make(map[string]int, len(tasks))
+	timeline := make([]simulatedFire, 0, len(fired))
+	for _, job := range fired {
+		runs[job.ID]++
+		timeline = append(timeline, simulatedFire{Time: time.Unix(job.Time, 0).UTC(), TaskID: job.ID, Run: runs[job.ID]})
+	}
+	return printTimeline(os.Stdout, timeline, *asJSON)
+}
+
+func printTimeline(w io.Writer, timeline []simulatedFire, asJSON bool) error {
+	if asJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(timeline)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME (UTC)\tTASK\tRUN")
+	for _, fire := range timeline {
+		fmt.Fprintf(tw, "%s\t%s\t%d\n", fire.Time.Format("2006-01-02 15:04:05"), fire.TaskID, fire.Run)
+	}
+	return tw.Flush()
+}
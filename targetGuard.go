@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"daria.com/jobScheduler/api"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/gin-gonic/gin"
+)
+
+// Tasks call URLs on behalf of anyone holding an API key, so by default they may not
+// reach this host, the VPC or the EC2 metadata service. A task's URL is checked when it is
+// saved, and every connection the executor opens is checked again after DNS resolution,
+// so a hostname that later resolves somewhere internal, or a redirect to one, is still
+// refused. Admins can allowlist hosts and networks per user in daria_target_allowlists.
+
+var errTargetBlocked = errors.New("target is blocked")
+
+// blockedTargetError is the refusal to call an address; it matches errTargetBlocked.
+type blockedTargetError struct {
+	addr netip.Addr
+}
+
+func (e *blockedTargetError) Error() string {
+	return fmt.Sprintf("%s is in a private, loopback or reserved range", e.addr)
+}
+
+func (e *blockedTargetError) Is(target error) bool {
+	return target == errTargetBlocked
+}
+
+// blockedPrefixes are the ranges blockedAddress refuses beyond what netip classifies as
+// loopback, private, link-local, multicast or unspecified.
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // "this network"
+	netip.MustParsePrefix("100.64.0.0/10"),  // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),  // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),    // reserved, and broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64, which can embed any IPv4 address
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local-use NAT64
+	netip.MustParsePrefix("2002::/16"),      // 6to4, likewise
+	netip.MustParsePrefix("::/96"),          // deprecated IPv4-compatible, likewise
+	netip.MustParsePrefix("fec0::/10"),      // deprecated site-local
+	netip.MustParsePrefix("100::/64"),       // discard-only
+	netip.MustParsePrefix("2001:db8::/32"),  // documentation
+}
+
+// blockedAddress reports whether tasks may not call addr unless allowlisted.
+// 169.254.169.254 (EC2 metadata) is link-local and fd00:ec2::254 is private.
+func blockedAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() {
+		return true
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// targetAllowlist is what one user may call despite blockedAddress: exact hostnames, and
+// addresses or networks. A nil allowlist allows nothing.
+type targetAllowlist struct {
+	hosts    map[string]bool
+	networks []netip.Prefix
+}
+
+// parseAllowlist reads allowlist entries: a CIDR network, an IP address or a hostname.
+func parseAllowlist(entries []string) (*targetAllowlist, error) {
+	allowlist := &targetAllowlist{hosts: make(map[string]bool)}
+	for _, entry := range entries {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			allowlist.networks = append(allowlist.networks, prefix.Masked())
+			continue
+		}
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			allowlist.networks = append(allowlist.networks, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		if !validHostname(entry) {
+			return nil, fmt.Errorf("%q is not a hostname, IP address or CIDR network", entry)
+		}
+		allowlist.hosts[strings.TrimSuffix(entry, ".")] = true
+	}
+	return allowlist, nil
+}
+
+func validHostname(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (a *targetAllowlist) allowsHost(host string) bool {
+	return a != nil && a.hosts[strings.TrimSuffix(strings.ToLower(host), ".")]
+}
+
+func (a *targetAllowlist) allowsAddr(addr netip.Addr) bool {
+	if a == nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, network := range a.networks {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAddress fails with errTargetBlocked if addr may not be called.
+func (a *targetAllowlist) checkAddress(addr netip.Addr) error {
+	if config.AllowPrivateTargets || !blockedAddress(addr) || a.allowsAddr(addr) {
+		return nil
+	}
+	return &blockedTargetError{addr: addr.Unmap()}
+}
+
+// checkTargetURL checks a task URL when the task is saved: a literal address, or every
+// address its hostname resolves to, must be allowed. A hostname that does not resolve is
+// accepted, since the dialer checks it again on every run.
+func checkTargetURL(ctx context.Context, userID string, rawURL string) error {
+	if config.AllowPrivateTargets {
+		return nil
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	host := parsed.Hostname()
+	allowlist, err := loadAllowlist(userID)
+	if err != nil {
+		return err
+	}
+	if allowlist.allowsHost(host) {
+		return nil
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return allowlist.checkAddress(addr)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		log("checkTargetURL", fmt.Sprintf("Could not resolve %s: %s", host, err.Error()))
+		return nil
+	}
+	for _, addr := range addrs {
+		if err := allowlist.checkAddress(addr); err != nil {
+			return fmt.Errorf("%s: %w", host, err)
+		}
+	}
+	return nil
+}
+
+// targetFieldError turns a checkTargetURL error into a validation error on field. Other
+// errors, such as a failed allowlist read, are returned as they are.
+func targetFieldError(field string, err error) error {
+	if !errors.Is(err, errTargetBlocked) {
+		return err
+	}
+	message := fmt.Sprintf("%s is not allowed: %s; ask an admin to allowlist it", field, err.Error())
+	return fieldErrors{{Field: field, Code: "blocked", Message: message}}
+}
+
+// respondTargetError answers a failed checkTargetURL.
+func respondTargetError(c *gin.Context, field string, err error) {
+	err = targetFieldError(field, err)
+	var errs fieldErrors
+	if errors.As(err, &errs) {
+		respondInvalid(c, err)
+		return
+	}
+	log("respondTargetError", err.Error())
+	respondError(c, http.StatusInternalServerError, codeInternal, "Failed to read the URL allowlist")
+}
+
+// allowlistContextKey carries the task owner's allowlist from the executor to dialTarget.
+type allowlistContextKey struct{}
+
+// targetTransport is the executor's transport. Keep-alives are off so a connection opened
+// to one user's allowlisted host is never reused for another user's task, and proxies from
+// the environment are ignored so the check applies to the real destination.
+var targetTransport = &http.Transport{
+	Proxy:               nil,
+	DialContext:         dialTarget,
+	DisableKeepAlives:   true,
+	ForceAttemptHTTP2:   true,
+	TLSHandshakeTimeout: 10 * time.Second,
+}
+
+// dialTarget checks the resolved address of every connection just before it is made.
+func dialTarget(ctx context.Context, network string, address string) (net.Conn, error) {
+	allowlist, _ := ctx.Value(allowlistContextKey{}).(*targetAllowlist)
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	if host, _, err := net.SplitHostPort(address); err != nil || !allowlist.allowsHost(host) {
+		dialer.Control = func(network string, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			return allowlist.checkAddress(addrPort.Addr())
+		}
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// withTargetAllowlist prepares ctx for a call on behalf of userID. If the allowlist cannot
+// be read the call goes ahead without it, so only public addresses are reachable.
+func withTargetAllowlist(ctx context.Context, userID string) context.Context {
+	allowlist, err := loadAllowlist(userID)
+	if err != nil {
+		log("withTargetAllowlist", fmt.Sprintf("Error loading allowlist of %s: %s", userID, err.Error()))
+	}
+	return context.WithValue(ctx, allowlistContextKey{}, allowlist)
+}
+
+// Allowlists are cached briefly since every execution needs its owner's. Changes made
+// through this instance apply at once; other instances see them within allowlistCacheTTL.
+const allowlistCacheTTL = time.Minute
+
+type cachedAllowlist struct {
+	allowlist *targetAllowlist
+	expiresAt time.Time
+}
+
+var allowlistCache = struct {
+	sync.Mutex
+	entries map[string]cachedAllowlist
+}{entries: make(map[string]cachedAllowlist)}
+
+func loadAllowlist(userID string) (*targetAllowlist, error) {
+	allowlistCache.Lock()
+	cached, ok := allowlistCache.entries[userID]
+	allowlistCache.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.allowlist, nil
+	}
+
+	record, err := getAllowlistRecord(userID)
+	if err != nil {
+		return nil, err
+	}
+	allowlist, err := parseAllowlist(record.Entries)
+	if err != nil {
+		return nil, err
+	}
+	allowlistCache.Lock()
+	allowlistCache.entries[userID] = cachedAllowlist{allowlist: allowlist, expiresAt: time.Now().Add(allowlistCacheTTL)}
+	allowlistCache.Unlock()
+	return allowlist, nil
+}
+
+// getAllowlistRecord reads a user's allowlist; a user without one gets an empty list.
+func getAllowlistRecord(userID string) (api.Allowlist, error) {
+	record := api.Allowlist{UserID: userID, Entries: []string{}}
+	input := &dynamodb.GetItemInput{
+		TableName: aws.String("daria_target_allowlists"),
+		Key: map[string]*dynamodb.AttributeValue{
+			"userId": {
+				S: aws.String(userID),
+			},
+		},
+	}
+	result, err := db.svc.GetItem(input)
+	if err != nil || result.Item == nil {
+		return record, err
+	}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &record); err != nil {
+		return record, err
+	}
+	return record, nil
+}
+
+func putAllowlistRecord(record api.Allowlist) error {
+	item, err := dynamodbattribute.MarshalMap(record)
+	if err != nil {
+		return err
+	}
+	_, err = db.svc.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String("daria_target_allowlists"),
+		Item:      item,
+	})
+	if err == nil {
+		allowlistCache.Lock()
+		delete(allowlistCache.entries, record.UserID)
+		allowlistCache.Unlock()
+	}
+	return err
+}
+
+// getTargetAllowlist handles GET /admin/users/:userId/allowlist.
+func getTargetAllowlist(c *gin.Context) {
+	callerMethod := "getTargetAllowlist"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	record, err := getAllowlistRecord(c.Param("userId"))
+	if err != nil {
+		log(callerMethod, err.Error())
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to read the allowlist")
+		return
+	}
+	c.JSON(http.StatusOK, record)
+}
+
+// putTargetAllowlist handles PUT /admin/users/:userId/allowlist, replacing the user's
+// allowlist with the entries given.
+func putTargetAllowlist(c *gin.Context) {
+	callerMethod := "putTargetAllowlist"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	body, err := c.GetRawData()
+	if err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "Failed to read request body")
+		return
+	}
+	if err := validateRequest("AllowlistInput", body); err != nil {
+		respondInvalid(c, err)
+		return
+	}
+	var input api.AllowlistInput
+	if err := json.Unmarshal(body, &input); err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	for i, entry := range input.Entries {
+		if _, err := parseAllowlist([]string{entry}); err != nil {
+			field := fmt.Sprintf("entries[%d]", i)
+			respondInvalid(c, fieldErrors{{Field: field, Code: "format", Message: field + ": " + err.Error()}})
+			return
+		}
+		input.Entries[i] = strings.ToLower(strings.TrimSpace(entry))
+	}
+
+	record := api.Allowlist{UserID: c.Param("userId"), Entries: input.Entries, UpdatedAt: time.Now().UTC()}
+	if err := putAllowlistRecord(record); err != nil {
+		log(callerMethod, err.Error())
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to save the allowlist")
+		return
+	}
+	log(callerMethod, fmt.Sprintf("Allowlist of %s set to %v", record.UserID, record.Entries))
+	c.JSON(http.StatusOK, record)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestBlockedAddress(t *testing.T) {
+	tests := []struct {
+		addr    string
+		blocked bool
+	}{
+		{"127.0.0.1", true},
+		{"127.1.2.3", true},
+		{"::1", true},
+		{"10.0.0.1", true},
+		{"172.16.0.1", true},
+		{"172.31.255.255", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true}, // EC2 metadata
+		{"fd00:ec2::254", true},   // EC2 metadata over IPv6
+		{"fe80::1", true},
+		{"0.0.0.0", true},
+		{"::", true},
+		{"100.64.0.1", true},
+		{"198.18.0.1", true},
+		{"255.255.255.255", true},
+		{"224.0.0.1", true},
+		{"ff02::1", true},
+		{"::ffff:127.0.0.1", true},       // IPv4-mapped
+		{"::ffff:169.254.169.254", true}, // IPv4-mapped
+		{"::127.0.0.1", true},            // IPv4-compatible
+		{"::a9fe:a9fe", true},            // IPv4-compatible 169.254.169.254
+		{"64:ff9b::7f00:1", true},        // NAT64 of 127.0.0.1
+		{"64:ff9b::a9fe:a9fe", true},     // NAT64 of 169.254.169.254
+		{"64:ff9b:1::a00:1", true},       // local-use NAT64 of 10.0.0.1
+		{"2002:7f00:1::", true},          // 6to4 of 127.0.0.1
+		{"2002:a9fe:a9fe::1", true},      // 6to4 of 169.254.169.254
+		{"fec0::1", true},                // site-local
+		{"2001:db8::1", true},
+		{"8.8.8.8", false},
+		{"1.1.1.1", false},
+		{"172.32.0.1", false},
+		{"::ffff:8.8.8.8", false},
+		{"2606:4700:4700::1111", false},
+	}
+	for _, test := range tests {
+		if got := blockedAddress(netip.MustParseAddr(test.addr)); got != test.blocked {
+			t.Errorf("blockedAddress(%s) = %v; want %v", test.addr, got, test.blocked)
+		}
+	}
+}
+
+func TestParseAllowlist(t *testing.T) {
+	allowlist, err := parseAllowlist([]string{" Internal.Example.com. ", "10.1.0.0/16", "192.168.1.7", "::ffff:172.16.0.9", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := []struct {
+		host    string
+		allowed bool
+	}{
+		{"internal.example.com", true},
+		{"INTERNAL.example.com.", true},
+		{"other.example.com", false},
+		{"sub.internal.example.com", false},
+		{"10.1.2.3", false}, // networks allow addresses, not host names
+	}
+	for _, test := range hosts {
+		if got := allowlist.allowsHost(test.host); got != test.allowed {
+			t.Errorf("allowsHost(%s) = %v; want %v", test.host, got, test.allowed)
+		}
+	}
+	addrs := []struct {
+		addr    string
+		allowed bool
+	}{
+		{"10.1.2.3", true},
+		{"::ffff:10.1.2.3", true},
+		{"10.2.0.1", false},
+		{"192.168.1.7", true},
+		{"192.168.1.8", false},
+		{"172.16.0.9", true},
+		{"fd00:ec2::254", true},
+		{"127.0.0.1", false},
+	}
+	for _, test := range addrs {
+		if got := allowlist.allowsAddr(netip.MustParseAddr(test.addr)); got != test.allowed {
+			t.Errorf("allowsAddr(%s) = %v; want %v", test.addr, got, test.allowed)
+		}
+	}
+
+	var none *targetAllowlist
+	if none.allowsHost("internal.example.com") || none.allowsAddr(netip.MustParseAddr("10.1.2.3")) {
+		t.Error("a nil allowlist allows something")
+	}
+	for _, entry := range []string{"http://example.com", "exa mple.com", "-bad.example.com", "10.0.0.0/33", ""} {
+		if _, err := parseAllowlist([]string{entry}); err == nil {
+			t.Errorf("parseAllowlist(%q) accepted the entry", entry)
+		}
+	}
+}
+
+// useAllowlist gives user_1 the allowlist until the test ends.
+func useAllowlist(t *testing.T, entries ...string) *targetAllowlist {
+	t.Helper()
+	t.Chdir(t.TempDir()) // log() appends to logfile.txt in the working directory
+	allowlist, err := parseAllowlist(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowlistCache.Lock()
+	allowlistCache.entries["user_1"] = cachedAllowlist{allowlist: allowlist, expiresAt: time.Now().Add(time.Hour)}
+	allowlistCache.Unlock()
+	t.Cleanup(func() {
+		allowlistCache.Lock()
+		delete(allowlistCache.entries, "user_1")
+		allowlistCache.Unlock()
+	})
+	return allowlist
+}
+
+func TestCheckTargetURL(t *testing.T) {
+	useAllowlist(t, "allowed.internal", "10.1.0.0/16")
+	tests := []struct {
+		url     string
+		blocked bool
+	}{
+		{"https://8.8.8.8/hook", false},
+		{"http://127.0.0.1:8080/", true},
+		{"http://[::1]/", true},
+		{"http://169.254.169.254/latest/meta-data/", true},
+		{"http://[fd00:ec2::254]/", true},
+		{"http://[::ffff:127.0.0.1]/", true},
+		{"http://[64:ff9b::a9fe:a9fe]/", true},
+		{"http://[2002:a9fe:a9fe::]/", true},
+		{"http://10.1.2.3/", false}, // allowlisted network
+		{"http://10.2.0.1/", true},  // outside it
+		{"http://localhost:8080/", true},
+		{"http://allowed.internal/", false}, // allowlisted host, resolved or not
+		{"http://nothing.invalid/", false},  // unresolvable; the dialer checks it on every run
+	}
+	for _, test := range tests {
+		err := checkTargetURL(context.Background(), "user_1", test.url)
+		if got := errors.Is(err, errTargetBlocked); got != test.blocked {
+			t.Errorf("checkTargetURL(%s) = %v; want blocked: %v", test.url, err, test.blocked)
+		}
+	}
+
+	var errs fieldErrors
+	err := targetFieldError("tasks[3].apiURL", checkTargetURL(context.Background(), "user_1", "http://127.0.0.1/"))
+	if !errors.As(err, &errs) || errs[0].Field != "tasks[3].apiURL" || errs[0].Code != "blocked" {
+		t.Fatalf("targetFieldError = %v; want a blocked error on tasks[3].apiURL", err)
+	}
+}
+
+// TestDialTargetChecksResolvedAddress stands in for DNS rebinding: the URL names a host,
+// and only the address it resolves to when the connection is made is private.
+func TestDialTargetChecksResolvedAddress(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	target, _ := url.Parse(srv.URL)
+	_, port, _ := net.SplitHostPort(target.Host)
+	hostURL := "http://localhost:" + port + "/"
+
+	get := func(allowlist *targetAllowlist, rawURL string) error {
+		ctx := context.WithValue(context.Background(), allowlistContextKey{}, allowlist)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := (&http.Client{Transport: targetTransport}).Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	for _, rawURL := range []string{hostURL, srv.URL} {
+		if err := get(nil, rawURL); !errors.Is(err, errTargetBlocked) {
+			t.Errorf("GET %s without an allowlist = %v; want blocked", rawURL, err)
+		}
+	}
+	hostOnly, _ := parseAllowlist([]string{"other.example.com"})
+	if err := get(hostOnly, hostURL); !errors.Is(err, errTargetBlocked) {
+		t.Errorf("GET %s allowlisting another host = %v; want blocked", hostURL, err)
+	}
+
+	for _, entries := range [][]string{{"localhost"}, {"127.0.0.0/8", "::1"}} {
+		allowlist, _ := parseAllowlist(entries)
+		if err := get(allowlist, hostURL); err != nil {
+			t.Errorf("GET %s allowlisting %v = %v; want it allowed", hostURL, entries, err)
+		}
+	}
+}
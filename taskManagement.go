@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"daria.com/jobScheduler/api"
+	"github.com/gin-gonic/gin"
+)
+
+// How much of the log file GET /tasks/:taskID/logs reads per request
+const logReadWindow = 1 << 20
+
+// loadOwnedTask fetches the task named in the path and checks that the caller owns it.
+// When it can't, it writes the error response and returns false.
+func loadOwnedTask(c *gin.Context) (*Task, bool) {
+	taskID := c.Param("taskID")
+	if taskID == "" {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "Task ID is required")
+		return nil, false
+	}
+
+	task, err := getTaskFromDB(taskID)
+	if errors.Is(err, errTaskNotFound) {
+		respondError(c, http.StatusNotFound, codeNotFound, "Task not found")
+		return nil, false
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to fetch the task")
+		return nil, false
+	}
+
+	if !verifyOwnership(task, c.GetString("userId")) {
+		respondError(c, http.StatusForbidden, codeForbidden, "You do not have permission to access this task")
+		return nil, false
+	}
+	return task, true
+}
+
+func listTasks(c *gin.Context) {
+	callerMethod := "listTasks"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	tasks, err := listUserTasks(c.GetString("userId"))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to read tasks")
+		return
+	}
+	c.JSON(http.StatusOK, api.TaskList{Tasks: tasks})
+}
+
+func getTask(c *gin.Context) {
+	callerMethod := "getTask"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	task, ok := loadOwnedTask(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, task)
+}
+
+// updateTask handles PATCH /tasks/:taskID, changing only the fields in the body.
+func updateTask(c *gin.Context) {
+	callerMethod := "updateTask"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	var patch UpdateTaskInput
+	body, err := c.GetRawData()
+	if err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "Failed to read request body")
+		return
+	}
+	if err := validateRequest("UpdateTaskInput", body); err != nil {
+		respondInvalid(c, err)
+		return
+	}
+	if err := json.Unmarshal(body, &patch); err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	task, ok := loadOwnedTask(c)
+	if !ok {
+		return
+	}
+
+	input := CreateTaskInput{
+		APIMethod:         task.APIMethod,
+		APIURL:            task.APIURL,
+		StartFrom:         task.StartFrom,
+		Frequency:         task.Frequency,
+		APIBody:           task.APIBody,
+		DeliveryGuarantee: task.DeliveryGuarantee,
+		Name:              task.Name,
+	}
+	if patch.Name != nil {
+		input.Name = *patch.Name
+	}
+	if patch.APIMethod != nil {
+		input.APIMethod = *patch.APIMethod
+	}
+	if patch.APIURL != nil {
+		input.APIURL = *patch.APIURL
+	}
+	if patch.StartFrom != nil {
+		input.StartFrom = *patch.StartFrom
+	}
+	if patch.Frequency != nil {
+		input.Frequency = *patch.Frequency
+	}
+	if patch.APIBody != nil {
+		input.APIBody = patch.APIBody
+	}
+	if patch.DeliveryGuarantee != nil {
+		input.DeliveryGuarantee = *patch.DeliveryGuarantee
+	}
+
+	// The merged task must still be valid, e.g. a patch cannot clear apiURL
+	if err := validateTaskInput(input); err != nil {
+		respondInvalid(c, err)
+		return
+	}
+	if patch.APIURL != nil {
+		if err := checkTargetURL(c.Request.Context(), task.UserID, input.APIURL); err != nil {
+			respondTargetError(c, "apiURL", err)
+			return
+		}
+	}
+	if input.Name != "" && input.Name != task.Name {
+		tasks, err := listUserTasks(task.UserID)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, codeInternal, "Failed to read tasks")
+			return
+		}
+		for _, other := range tasks {
+			if other.Name == input.Name && other.TaskID != task.TaskID {
+				respondError(c, http.StatusConflict, codeNameTaken, nameTakenError{input.Name}.Error())
+				return
+			}
+		}
+	}
+
+	err = updateTaskFromInput(task, input)
+	if errors.Is(err, errTaskNotFound) {
+		respondError(c, http.StatusNotFound, codeNotFound, "Task not found")
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to update the task")
+		return
+	}
+	c.JSON(http.StatusOK, task)
+}
+
+func pauseTask(c *gin.Context) {
+	callerMethod := "pauseTask"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	task, ok := loadOwnedTask(c)
+	if !ok {
+		return
+	}
+	if task.Paused {
+		c.JSON(http.StatusOK, task)
+		return
+	}
+
+	task.Paused = true
+	if !saveTaskState(c, task) {
+		return
+	}
+	// Other replicas drop it when it comes due and they see it paused
+	sched.Cancel(task.TaskID)
+	c.JSON(http.StatusOK, task)
+}
+
+// resumeTask queues a paused task again. A run missed while it was paused happens right
+// away, once; the ones before it are skipped.
+func resumeTask(c *gin.Context) {
+	callerMethod := "resumeTask"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	task, ok := loadOwnedTask(c)
+	if !ok {
+		return
+	}
+	if !task.Paused {
+		c.JSON(http.StatusOK, task)
+		return
+	}
+
+	task.Paused = false
+	if now := clock.Now(); task.NextExecution.Before(now) {
+		task.NextExecution = now
+	}
+	if !saveTaskState(c, task) {
+		return
+	}
+	scheduleTask(task)
+	c.JSON(http.StatusOK, task)
+}
+
+// runTaskNow moves the task's next run to now. Its schedule continues from this run.
+func runTaskNow(c *gin.Context) {
+	callerMethod := "runTaskNow"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	task, ok := loadOwnedTask(c)
+	if !ok {
+		return
+	}
+	if task.Paused {
+		respondError(c, http.StatusConflict, codeTaskPaused, "Task is paused; resume it first")
+		return
+	}
+	if task.TotalExecutions >= maxExecutions {
+		respondError(c, http.StatusConflict, codeTaskFinished, fmt.Sprintf("Task has already run %d times", task.TotalExecutions))
+		return
+	}
+
+	task.NextExecution = clock.Now()
+	if !saveTaskState(c, task) {
+		return
+	}
+	scheduleTask(task)
+	c.JSON(http.StatusOK, task)
+}
+
+func saveTaskState(c *gin.Context, task *Task) bool {
+	err := updateTaskState(task)
+	if errors.Is(err, errTaskNotFound) {
+		respondError(c, http.StatusNotFound, codeNotFound, "Task not found")
+		return false
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to update the task")
+		return false
+	}
+	return true
+}
+
+// scheduleTask queues the task's next run here if this instance runs it; otherwise the
+// instance that does picks the change up on its next resync.
+func scheduleTask(task *Task) {
+	if ownsTask(task.TaskID) && task.TotalExecutions < maxExecutions {
+		sched.Schedule(task.TaskID, task.NextExecution)
+	}
+}
+
+// getTaskHistory handles GET /tasks/:taskID/history?limit=N from the execution journal.
+func getTaskHistory(c *gin.Context) {
+	callerMethod := "getTaskHistory"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	limit := int64(20)
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 1 || parsed > 100 {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "limit must be between 1 and 100")
+			return
+		}
+		limit = parsed
+	}
+
+	task, ok := loadOwnedTask(c)
+	if !ok {
+		return
+	}
+	executions, err := listExecutions(task.TaskID, limit)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to read the execution history")
+		return
+	}
+	c.JSON(http.StatusOK, api.History{TaskID: task.TaskID, Executions: executions})
+}
+
+// getTaskLogs handles GET /tasks/:taskID/logs?cursor=N: the lines of this instance's log
+// that mention the task, from byte offset cursor on, and the cursor to continue from.
+// Without a cursor it returns the most recent lines.
+func getTaskLogs(c *gin.Context) {
+	callerMethod := "getTaskLogs"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	task, ok := loadOwnedTask(c)
+	if !ok {
+		return
+	}
+
+	cursor := int64(-1)
+	if value := c.Query("cursor"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "cursor must be a non-negative number")
+			return
+		}
+		cursor = parsed
+	}
+
+	lines, next, err := readTaskLogLines("logfile.txt", task.TaskID, cursor)
+	if err != nil {
+		log(callerMethod, fmt.Sprintf("Error reading log: %s", err.Error()))
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to read the log")
+		return
+	}
+	c.JSON(http.StatusOK, api.LogLines{InstanceID: config.InstanceID, Lines: lines, Cursor: next})
+}
+
+// readTaskLogLines returns the complete lines mentioning taskID in up to logReadWindow
+// bytes of the file from offset, or from the end of the file if offset is negative.
+// The file is truncated on restart, so an offset past its end starts over.
+func readTaskLogLines(filename string, taskID string, offset int64) ([]string, int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	size := info.Size()
+	fromTail := offset < 0
+	if fromTail {
+		offset = max(size-logReadWindow, 0)
+	} else if offset > size {
+		offset = 0
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+
+	lines := make([]string, 0)
+	reader := bufio.NewReader(io.LimitReader(file, logReadWindow))
+	next := offset
+	if fromTail && offset > 0 {
+		// Starting mid-file, so the first line is probably cut off
+		skipped, err := reader.ReadString('\n')
+		if err != nil {
+			return lines, offset, nil
+		}
+		next += int64(len(skipped))
+	}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			// A partial line is still being written; read it next time
+			break
+		}
+		next += int64(len(line))
+		if strings.Contains(line, taskID) {
+			lines = append(lines, strings.TrimRight(line, "\n"))
+		}
+	}
+	return lines, next, nil
+}
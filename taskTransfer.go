@@ -0,0 +1,411 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"daria.com/jobScheduler/api"
+	"github.com/gin-gonic/gin"
+)
+
+type exportedTask = api.ExportedTask
+
+// exportColumns is the CSV header; apiBody is a JSON object in its column.
+var exportColumns = []string{"taskId", "name", "apiMethod", "apiURL", "startFrom", "frequency", "apiBody", "deliveryGuarantee", "nextExecution", "totalExecutions"}
+
+type batchItemResult = api.BatchItemResult
+
+// batchItem is a task to create along with when it first runs, or why it can't be created.
+// totalExecutions is only set on import.
+type batchItem struct {
+	input           CreateTaskInput
+	firstRun        time.Time
+	totalExecutions int
+	err             error
+}
+
+// createTaskBatch handles POST /tasks:batch: a JSON array of create requests, each
+// created independently and reported on in order.
+func createTaskBatch(c *gin.Context) {
+	callerMethod := "createTaskBatch"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	var bodies []json.RawMessage
+	if err := json.NewDecoder(c.Request.Body).Decode(&bodies); err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "Body must be a JSON array of tasks")
+		return
+	}
+	if !checkBatchSize(c, len(bodies)) {
+		return
+	}
+
+	items := make([]batchItem, len(bodies))
+	for i, body := range bodies {
+		// Validate each item as it was sent, so type errors are reported per field
+		var input CreateTaskInput
+		if err := validateRequest("CreateTaskInput", body); err != nil {
+			items[i] = batchItem{err: err}
+		} else if err := json.Unmarshal(body, &input); err != nil {
+			items[i] = batchItem{err: err}
+		} else {
+			items[i] = newBatchItem(input, "", 0)
+		}
+	}
+	checkBatchTargets(c, items)
+	if !checkBatchNames(c, items) {
+		return
+	}
+	respondBatch(c, createBatchItems(c.GetString("userId"), items))
+}
+
+// importTasks handles POST /tasks:import with a JSON array or CSV file in the export format.
+func importTasks(c *gin.Context) {
+	callerMethod := "importTasks"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	format := transferFormat(c, c.ContentType())
+	var records []exportedTask
+	var err error
+	switch format {
+	case "csv":
+		records, err = readTasksCSV(c.Request.Body)
+	case "json":
+		err = json.NewDecoder(c.Request.Body).Decode(&records)
+	default:
+		respondError(c, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, "Import must be JSON or CSV")
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Invalid %s: %s", format, err.Error()))
+		return
+	}
+	if !checkBatchSize(c, len(records)) {
+		return
+	}
+
+	items := make([]batchItem, len(records))
+	for i, record := range records {
+		items[i] = importItem(record)
+	}
+	checkBatchTargets(c, items)
+	if !checkBatchNames(c, items) {
+		return
+	}
+	respondBatch(c, createBatchItems(c.GetString("userId"), items))
+}
+
+// importItem validates an imported task like a create request, keeping its schedule.
+func importItem(record exportedTask) batchItem {
+	return newBatchItem(CreateTaskInput{
+		APIMethod:         record.APIMethod,
+		APIURL:            record.APIURL,
+		StartFrom:         record.StartFrom,
+		Frequency:         record.Frequency,
+		APIBody:           record.APIBody,
+		DeliveryGuarantee: record.DeliveryGuarantee,
+		Name:              record.Name,
+	}, record.NextExecution, record.TotalExecutions)
+}
+
+// exportTasks handles GET /tasks:export?format=json|csv with every task the user owns.
+func exportTasks(c *gin.Context) {
+	callerMethod := "exportTasks"
+	startTime := time.Now()
+	log(callerMethod, "Start")
+	defer func() {
+		endLog(callerMethod, startTime)
+	}()
+
+	format := transferFormat(c, c.GetHeader("Accept"))
+	if format != "json" && format != "csv" {
+		respondError(c, http.StatusNotAcceptable, codeNotAcceptable, "Export format must be json or csv")
+		return
+	}
+
+	tasks, err := listUserTasks(c.GetString("userId"))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to read tasks")
+		return
+	}
+	records := make([]exportedTask, 0, len(tasks))
+	for _, task := range tasks {
+		records = append(records, exportTask(task))
+	}
+
+	filename := fmt.Sprintf("tasks-%s.%s", time.Now().UTC().Format("20060102-150405"), format)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	if format == "json" {
+		c.JSON(http.StatusOK, records)
+		return
+	}
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Status(http.StatusOK)
+	if err := writeTasksCSV(c.Writer, records); err != nil {
+		log(callerMethod, fmt.Sprintf("Error writing CSV: %s", err.Error()))
+	}
+}
+
+func exportTask(task Task) exportedTask {
+	record := exportedTask{
+		TaskID:            task.TaskID,
+		Name:              task.Name,
+		APIMethod:         task.APIMethod,
+		APIURL:            task.APIURL,
+		StartFrom:         task.StartFrom,
+		Frequency:         task.Frequency,
+		APIBody:           task.APIBody,
+		DeliveryGuarantee: task.DeliveryGuarantee,
+		TotalExecutions:   task.TotalExecutions,
+	}
+	if task.TotalExecutions < maxExecutions {
+		record.NextExecution = task.NextExecution.UTC().Format("2006-01-02 15:04:05")
+	}
+	return record
+}
+
+// transferFormat picks json or csv from ?format=, falling back to the given media type.
+func transferFormat(c *gin.Context, mediaType string) string {
+	if format := c.Query("format"); format != "" {
+		return strings.ToLower(format)
+	}
+	switch {
+	case strings.Contains(mediaType, "text/csv"):
+		return "csv"
+	case mediaType == "" || strings.Contains(mediaType, "json") || strings.Contains(mediaType, "*/*"):
+		return "json"
+	}
+	return mediaType
+}
+
+func checkBatchSize(c *gin.Context, size int) bool {
+	if size == 0 {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "No tasks given")
+		return false
+	}
+	if size > maxBatchTasks {
+		respondError(c, http.StatusRequestEntityTooLarge, codePayloadTooLarge, fmt.Sprintf("At most %d tasks can be created per request", maxBatchTasks))
+		return false
+	}
+	return true
+}
+
+// newBatchItem validates a create request. nextExecution, if given, overrides startFrom
+// as the first run. totalExecutions carries an exported task's run count over, so an
+// import keeps its remaining runs; a task that had finished is imported finished.
+func newBatchItem(input CreateTaskInput, nextExecution string, totalExecutions int) batchItem {
+	if err := validateTaskInput(input); err != nil {
+		return batchItem{err: err}
+	}
+	if totalExecutions < 0 || totalExecutions > maxExecutions {
+		return batchItem{err: fmt.Errorf("totalExecutions must be between 0 and %d", maxExecutions)}
+	}
+	timeUTC, err := time.Parse("2006-01-02 15:04:05", input.StartFrom)
+	if nextExecution != "" {
+		if timeUTC, err = time.Parse("2006-01-02 15:04:05", nextExecution); err != nil {
+			return batchItem{err: errors.New("nextExecution is in UTC and needs to be in the format: 2000-12-02 01:01:01")}
+		}
+	}
+	return batchItem{input: input, firstRun: timeUTC, totalExecutions: totalExecutions}
+}
+
+// checkBatchTargets fails the valid items whose URL the user may not call.
+func checkBatchTargets(c *gin.Context, items []batchItem) {
+	for i := range items {
+		if items[i].err != nil {
+			continue
+		}
+		if err := checkTargetURL(c.Request.Context(), c.GetString("userId"), items[i].input.APIURL); err != nil {
+			items[i].err = targetFieldError("apiURL", err)
+		}
+	}
+}
+
+// checkBatchNames fails the valid items whose name is taken. It answers 500 and reports
+// false if the user's tasks could not be read.
+func checkBatchNames(c *gin.Context, items []batchItem) bool {
+	names, err := taskNames(c.GetString("userId"))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to read tasks")
+		return false
+	}
+	failTakenNames(items, names)
+	return true
+}
+
+// failTakenNames fails the valid items named like one of names or like an earlier valid
+// item of the batch.
+func failTakenNames(items []batchItem, names map[string]bool) {
+	for i := range items {
+		name := items[i].input.Name
+		if items[i].err != nil || name == "" {
+			continue
+		}
+		if names[name] {
+			items[i].err = nameTakenError{name}
+			continue
+		}
+		names[name] = true
+	}
+}
+
+// createBatchItems creates the valid items in order. Once the user's job limit is reached
+// the remaining items are rejected without trying.
+func createBatchItems(userID string, items []batchItem) []batchItemResult {
+	results := make([]batchItemResult, len(items))
+	limitReached := false
+	for i, item := range items {
+		result := batchItemResult{Index: i}
+		var taken nameTakenError
+		switch {
+		case errors.As(item.err, &taken):
+			result.Status = http.StatusConflict
+			result.Error = taken.Error()
+		case item.err != nil:
+			result.Status = http.StatusBadRequest
+			result.Error = item.err.Error()
+			var errs fieldErrors
+			if errors.As(item.err, &errs) {
+				result.Fields = errs
+			}
+		case limitReached:
+			result.Status = http.StatusTooManyRequests
+			result.Error = "Maximum job limit has been reached"
+		default:
+			taskID, err := insertTask(userID, item.input, item.firstRun, item.totalExecutions)
+			switch {
+			case err == nil:
+				result.Status = http.StatusCreated
+				result.TaskID = taskID
+			case errors.Is(err, errJobLimitReached):
+				limitReached = true
+				result.Status = http.StatusTooManyRequests
+				result.Error = "Maximum job limit has been reached"
+			default:
+				result.Status = http.StatusInternalServerError
+				result.Error = "Failed to insert into db"
+			}
+		}
+		results[i] = result
+	}
+	return results
+}
+
+func respondBatch(c *gin.Context, results []batchItemResult) {
+	created := 0
+	for _, result := range results {
+		if result.Status == http.StatusCreated {
+			created++
+		}
+	}
+	c.JSON(http.StatusOK, api.BatchResult{
+		Created: created,
+		Failed:  len(results) - created,
+		Results: results,
+	})
+}
+
+func writeTasksCSV(w io.Writer, records []exportedTask) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(exportColumns); err != nil {
+		return err
+	}
+	for _, record := range records {
+		body, err := json.Marshal(record.APIBody)
+		if err != nil {
+			return err
+		}
+		row := []string{
+			record.TaskID,
+			record.Name,
+			record.APIMethod,
+			record.APIURL,
+			record.StartFrom,
+			strconv.Itoa(record.Frequency),
+			string(body),
+			record.DeliveryGuarantee,
+			record.NextExecution,
+			strconv.Itoa(record.TotalExecutions),
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// readTasksCSV reads rows by header name, so columns may be in any order and the
+// informational ones may be left out.
+func readTasksCSV(r io.Reader) ([]exportedTask, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, required := range []string{"apiMethod", "apiURL", "startFrom", "frequency"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("missing column %s", required)
+		}
+	}
+
+	records := make([]exportedTask, 0)
+	for line := 2; ; line++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+
+		record := exportedTask{
+			Name:              field("name"),
+			APIMethod:         field("apiMethod"),
+			APIURL:            field("apiURL"),
+			StartFrom:         field("startFrom"),
+			DeliveryGuarantee: field("deliveryGuarantee"),
+			NextExecution:     field("nextExecution"),
+		}
+		if record.Frequency, err = strconv.Atoi(field("frequency")); err != nil {
+			return nil, fmt.Errorf("line %d: frequency must be a number", line)
+		}
+		if total := field("totalExecutions"); total != "" {
+			if record.TotalExecutions, err = strconv.Atoi(total); err != nil {
+				return nil, fmt.Errorf("line %d: totalExecutions must be a number", line)
+			}
+		}
+		if body := field("apiBody"); body != "" {
+			if err := json.Unmarshal([]byte(body), &record.APIBody); err != nil {
+				return nil, fmt.Errorf("line %d: apiBody must be a JSON object", line)
+			}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFailTakenNames(t *testing.T) {
+	items := []batchItem{
+		newBatchItem(manifestTask("nightly", "https://example.com/a"), "", 0), // taken by an existing task
+		newBatchItem(manifestTask("hourly", "https://example.com/b"), "", 0),
+		newBatchItem(manifestTask("hourly", "https://example.com/c"), "", 0), // taken by item 1
+		{input: manifestTask("weekly", "https://example.com/d"), err: errors.New("invalid")},
+		newBatchItem(manifestTask("weekly", "https://example.com/e"), "", 0), // item 3 failed, so it is free
+		newBatchItem(manifestTask("", "https://example.com/f"), "", 0),
+		newBatchItem(manifestTask("", "https://example.com/g"), "", 0),
+	}
+	failTakenNames(items, map[string]bool{"nightly": true})
+
+	want := []bool{true, false, true, false, false, false, false}
+	for i, item := range items {
+		var taken nameTakenError
+		if errors.As(item.err, &taken) != want[i] {
+			t.Fatalf("item %d: err = %v; want name taken: %v", i, item.err, want[i])
+		}
+	}
+
+	// createBatchItems reports taken names as conflicts without inserting anything
+	results := createBatchItems("user_1", []batchItem{items[0], items[2]})
+	for i, result := range results {
+		if result.Status != http.StatusConflict || result.TaskID != "" {
+			t.Fatalf("result %d = %+v; want status 409", i, result)
+		}
+	}
+}
+
+func TestTasksCSVRoundTrip(t *testing.T) {
+	next := time.Date(2026, 10, 3, 8, 30, 0, 0, time.UTC)
+	tasks := []Task{
+		{
+			TaskID: "user_1_task_1", Name: "say, \"hi\"", APIMethod: "POST", APIURL: "https://example.com/hook?a=1,2",
+			StartFrom: "2026-10-01 08:30:00", Frequency: 60, DeliveryGuarantee: deliveryAtMostOnce,
+			APIBody: map[string]interface{}{
+				"message": "line one, \"quoted\"\nline two",
+				"count":   1.5,
+				"tags":    []interface{}{"a", "b"},
+				"nested":  map[string]interface{}{"ok": true, "none": nil},
+			},
+			NextExecution: next, TotalExecutions: 2,
+		},
+		{
+			TaskID: "user_1_task_2", APIMethod: "POST", APIURL: "https://example.com/done",
+			StartFrom: "2026-09-01 00:00:00", Frequency: 3600, APIBody: map[string]interface{}{},
+			NextExecution: next, TotalExecutions: maxExecutions,
+		},
+	}
+	records := []exportedTask{exportTask(tasks[0]), exportTask(tasks[1])}
+	var buf bytes.Buffer
+	if err := writeTasksCSV(&buf, records); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readTasksCSV(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range records {
+		records[i].TaskID = "" // an import creates new tasks
+	}
+	if !reflect.DeepEqual(read, records) {
+		t.Fatalf("read back %+v\nwant %+v", read, records)
+	}
+
+	// The running task keeps its phase and count; the finished one is imported finished
+	item := importItem(read[0])
+	if item.err != nil || !item.firstRun.Equal(next) || item.totalExecutions != 2 {
+		t.Fatalf("running task imported as %+v; want its next run %s and 2 runs done", item, next)
+	}
+	if read[1].NextExecution != "" {
+		t.Fatalf("a finished task was exported with its next run %q", read[1].NextExecution)
+	}
+	item = importItem(read[1])
+	if item.err != nil || item.totalExecutions != maxExecutions || !item.firstRun.Equal(time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("finished task imported as %+v; want it finished, with its first run at startFrom", item)
+	}
+}
+
+func TestReadTasksCSVColumns(t *testing.T) {
+	// Columns in another order, the optional ones left out and one nobody knows
+	csv := "frequency,notes,apiBody,startFrom,apiURL,apiMethod\n" +
+		"60,ignored,\"{\"\"a\"\": 1}\",2026-10-01 12:00:00,https://example.com/hook,POST\n" +
+		" 120 , ,{}, 2026-10-02 12:00:00 ,https://example.com/other,GET\n"
+	read, err := readTasksCSV(strings.NewReader(csv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []exportedTask{
+		{APIMethod: "POST", APIURL: "https://example.com/hook", StartFrom: "2026-10-01 12:00:00", Frequency: 60, APIBody: map[string]interface{}{"a": 1.0}},
+		{APIMethod: "GET", APIURL: "https://example.com/other", StartFrom: "2026-10-02 12:00:00", Frequency: 120, APIBody: map[string]interface{}{}},
+	}
+	if !reflect.DeepEqual(read, want) {
+		t.Fatalf("read %+v\nwant %+v", read, want)
+	}
+	// Without nextExecution the first run is at startFrom
+	if item := importItem(read[0]); item.err != nil || !item.firstRun.Equal(time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)) || item.totalExecutions != 0 {
+		t.Fatalf("imported as %+v; want a new task first running at startFrom", item)
+	}
+
+	for _, test := range []struct{ csv, want string }{
+		{"apiMethod,apiURL,startFrom\n", "missing column frequency"},
+		{"apiMethod,apiURL,startFrom,frequency\nPOST,https://example.com,2026-10-01 12:00:00,often\n", "line 2: frequency must be a number"},
+		{"apiMethod,apiURL,startFrom,frequency,apiBody\nPOST,https://example.com,2026-10-01 12:00:00,60,[1]\n", "line 2: apiBody must be a JSON object"},
+		{"apiMethod,apiURL,startFrom,frequency,totalExecutions\nPOST,https://example.com,2026-10-01 12:00:00,60,x\n", "line 2: totalExecutions must be a number"},
+	} {
+		if _, err := readTasksCSV(strings.NewReader(test.csv)); err == nil || err.Error() != test.want {
+			t.Errorf("reading %q = %v; want %q", test.csv, err, test.want)
+		}
+	}
+}